@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"teletalkie/internal/acme"
+	"teletalkie/internal/room"
+	"teletalkie/internal/token"
+)
+
+// envPrefix — переменные окружения TELETALKIE_<ФЛАГ> переопределяют файл
+// конфигурации: --max-talk ↔ TELETALKIE_MAX_TALK.
+const envPrefix = "TELETALKIE_"
+
+// config — настройки сервера. Источники по возрастанию приоритета:
+// значения по умолчанию, файл --config (JSON), переменные окружения,
+// флаги командной строки.
+type config struct {
+	Addr         string                `json:"addr"`
+	TLS          tlsConfig             `json:"tls"`
+	ACME         acmeConfig            `json:"acme"`
+	DataDir      string                `json:"data_dir"`
+	RecordDir    string                `json:"record_dir"`
+	AuthSecret   string                `json:"auth_secret"`
+	ResumeGrace  duration              `json:"resume_grace"`
+	FloorQueue   bool                  `json:"floor_queue"`
+	RoomDefaults roomConfig            `json:"room_defaults"`
+	Rooms        map[string]roomConfig `json:"rooms"`
+	SlowConsumer duration              `json:"slow_consumer_timeout"`
+	DrainTimeout duration              `json:"drain_timeout"`
+	Metrics      bool                  `json:"metrics"`
+	MDNS         bool                  `json:"mdns"`
+	Log          logConfig             `json:"log"`
+	QR           qrConfig              `json:"qr"`
+}
+
+// tlsConfig — HTTPS. Cert и Key — PEM-файлы; без них при Enabled
+// сертификаты выпускает локальный CA из data_dir (если data_dir пуст —
+// самоподписанный сертификат).
+type tlsConfig struct {
+	Enabled bool   `json:"enabled"`
+	Cert    string `json:"cert"`
+	Key     string `json:"key"`
+}
+
+// acmeConfig — публичный сертификат для Domains по ACME (по умолчанию от
+// Let's Encrypt); хранится в data_dir/acme. HTTPAddr — где отвечать на
+// проверки HTTP-01 и перенаправлять остальное на HTTPS; пусто — только
+// TLS-ALPN-01, он проходит, если addr доступен снаружи на порту 443.
+type acmeConfig struct {
+	Domains   []string `json:"domains"`
+	Email     string   `json:"email"`
+	Directory string   `json:"directory"`
+	HTTPAddr  string   `json:"http_addr"`
+}
+
+// roomConfig — настройки комнаты. В room_defaults действуют на все
+// комнаты, в rooms — на одну; незаданные поля берутся из room_defaults.
+type roomConfig struct {
+	MaxTalk   *duration `json:"max_talk"`
+	MediaIdle *duration `json:"media_idle"`
+	MaxPeers  *int      `json:"max_peers"`
+	// Password делает комнату приватной с этим паролем. Только в rooms.
+	Password string `json:"password"`
+}
+
+// qrConfig — QR-код ссылки для входа, который печатается при старте.
+// Room и Token попадают в ссылку: клиент откроет форму входа с этой
+// комнатой или войдёт по join-токену.
+type qrConfig struct {
+	Enabled bool   `json:"enabled"`
+	Room    string `json:"room"`
+	Token   string `json:"token"`
+}
+
+type logConfig struct {
+	Format string `json:"format"`
+	Level  string `json:"level"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Addr:        ":8080",
+		DataDir:     defaultDataDir(),
+		ACME:        acmeConfig{Directory: acme.LetsEncrypt, HTTPAddr: ":80"},
+		ResumeGrace: duration(room.DefaultResumeGrace),
+		RoomDefaults: roomConfig{
+			MaxTalk:   ptr(duration(5 * time.Minute)),
+			MediaIdle: ptr(duration(15 * time.Second)),
+			MaxPeers:  ptr(0),
+		},
+		SlowConsumer: duration(room.DefaultSlowConsumerTimeout),
+		DrainTimeout: duration(10 * time.Second),
+		MDNS:         true,
+		Log:          logConfig{Format: "text", Level: "info"},
+		QR:           qrConfig{Enabled: true},
+	}
+}
+
+// defaultDataDir — teletalkie в os.UserConfigDir (~/.config/teletalkie
+// на Linux); пусто, если домашний каталог неизвестен.
+func defaultDataDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "teletalkie")
+}
+
+func ptr[T any](v T) *T { return &v }
+
+// flagSet привязывает флаги к полям c: флаг, заданный в командной строке
+// или окружении, перезаписывает значение из файла.
+func (c *config) flagSet(configPath *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("teletalkie", flag.ContinueOnError)
+	fs.StringVar(configPath, "config", "", "read settings from this JSON file (flags and $"+envPrefix+"* override it)")
+	fs.StringVar(&c.Addr, "addr", c.Addr, "listen address")
+	fs.BoolVar(&c.TLS.Enabled, "tls", c.TLS.Enabled, "enable HTTPS with a certificate from the local CA (required for mobile camera access)")
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "serve HTTPS with this PEM certificate (with --tls-key)")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "PEM private key for --tls-cert")
+	fs.Var((*stringList)(&c.ACME.Domains), "acme-domain", "obtain and renew a public certificate for these comma-separated domains via ACME")
+	fs.StringVar(&c.ACME.Email, "acme-email", c.ACME.Email, "contact email for the ACME account (expiry and problem notices)")
+	fs.StringVar(&c.ACME.Directory, "acme-directory", c.ACME.Directory, "ACME directory URL (e.g. a local Pebble for testing)")
+	fs.StringVar(&c.ACME.HTTPAddr, "acme-http-addr", c.ACME.HTTPAddr, "answer ACME HTTP-01 challenges and redirect to HTTPS on this address (empty = TLS-ALPN-01 only)")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "keep the local CA for --tls and ACME certificates in this directory (empty = self-signed certificate)")
+	fs.StringVar(&c.RecordDir, "record-dir", c.RecordDir, "record every PTT transmission to this directory (empty = disabled)")
+	fs.StringVar(&c.AuthSecret, "auth-secret", c.AuthSecret, "require HMAC join tokens signed with this secret (default $"+secretEnv+")")
+	fs.Var(&c.ResumeGrace, "resume-grace", "keep a dropped peer (and its floor) this long waiting for reconnect (0 = leave immediately)")
+	fs.BoolVar(&c.FloorQueue, "floor-queue", c.FloorQueue, "queue PTT requests while the floor is busy and hand the floor over in order")
+	fs.Var(c.RoomDefaults.MaxTalk, "max-talk", "revoke the floor after this long in one transmission (0 = unlimited)")
+	fs.Var(c.RoomDefaults.MediaIdle, "media-idle", "revoke the floor if the talker sends no media for this long (0 = never)")
+	fs.IntVar(c.RoomDefaults.MaxPeers, "max-peers", *c.RoomDefaults.MaxPeers, "maximum peers per room (0 = unlimited)")
+	fs.Var(&c.SlowConsumer, "slow-consumer-timeout", "disconnect a listener that cannot keep up with the media stream for this long (0 = only on control backlog)")
+	fs.BoolVar(&c.Metrics, "metrics", c.Metrics, "serve Prometheus metrics at /metrics (unauthenticated: expose only to your monitoring)")
+	fs.BoolVar(&c.MDNS, "mdns", c.MDNS, "advertise the server on the LAN via mDNS as teletalkie.local (_teletalkie._tcp service with the room list)")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "log format: text or json")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "minimum log level: debug, info, warn or error")
+	fs.BoolVar(&c.QR.Enabled, "qr", c.QR.Enabled, "print a QR code with the join link at startup")
+	fs.StringVar(&c.QR.Room, "qr-room", c.QR.Room, "prefill this room in the startup QR link")
+	fs.StringVar(&c.QR.Token, "qr-token", c.QR.Token, "put this join token (teletalkie token issue) in the startup QR link")
+	fs.Var(&c.DrainTimeout, "drain-timeout", "on SIGINT/SIGTERM, wait this long for clients to disconnect and recordings to finish")
+	return fs
+}
+
+// loadConfig собирает настройки из файла, окружения и аргументов.
+// Ошибки валидации возвращаются все сразу.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (*config, error) {
+	// Первый проход — только чтобы узнать --config: файл ложится
+	// под окружение и флаги, поэтому читается раньше них.
+	var path string
+	probe := defaultConfig().flagSet(&path)
+	probe.SetOutput(io.Discard)
+	probe.Parse(args)
+	if path == "" {
+		path, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+
+	cfg := defaultConfig()
+	if path != "" {
+		if err := cfg.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	fs := cfg.flagSet(&path)
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := lookupEnv(name); ok && f.Name != "config" {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("$%s: %w", name, err))
+			}
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.validate()
+}
+
+// readFile накладывает на c файл конфигурации. Незнакомые поля — ошибка:
+// опечатка в имени не должна молча оставлять значение по умолчанию.
+func (c *config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	// null в room_defaults — то же, что не задано.
+	def := defaultConfig().RoomDefaults
+	c.RoomDefaults.MaxTalk = cmp.Or(c.RoomDefaults.MaxTalk, def.MaxTalk)
+	c.RoomDefaults.MediaIdle = cmp.Or(c.RoomDefaults.MediaIdle, def.MediaIdle)
+	c.RoomDefaults.MaxPeers = cmp.Or(c.RoomDefaults.MaxPeers, def.MaxPeers)
+	return nil
+}
+
+// validate проверяет настройки целиком и сообщает обо всех ошибках сразу.
+func (c *config) validate() error {
+	var errs []error
+	bad := func(field, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]any{field}, args...)...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		bad("addr", "%v", err)
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		bad("tls", "cert and key must be set together")
+	}
+	if len(c.ACME.Domains) > 0 {
+		c.ACME.validate(bad)
+		if c.TLS.Cert != "" {
+			bad("acme.domains", "use either tls.cert and tls.key or acme.domains")
+		}
+		if c.DataDir == "" {
+			bad("acme.domains", "data_dir is required to store certificates")
+		}
+	}
+	for _, f := range []struct {
+		name string
+		d    duration
+	}{
+		{"resume_grace", c.ResumeGrace},
+		{"slow_consumer_timeout", c.SlowConsumer},
+		{"drain_timeout", c.DrainTimeout},
+	} {
+		if f.d < 0 {
+			bad(f.name, "must not be negative")
+		}
+	}
+	c.RoomDefaults.validate("room_defaults", bad)
+	if c.RoomDefaults.Password != "" {
+		bad("room_defaults.password", "set passwords per room in rooms")
+	}
+	for _, id := range slices.Sorted(maps.Keys(c.Rooms)) {
+		if id == "" {
+			bad("rooms", "room name must not be empty")
+		}
+		c.Rooms[id].validate("rooms."+id, bad)
+	}
+
+	if c.QR.Token != "" {
+		claims, err := token.Verify([]byte(c.AuthSecret), c.QR.Token, time.Now())
+		switch {
+		case c.AuthSecret == "":
+			bad("qr.token", "join tokens need auth_secret")
+		case err != nil:
+			bad("qr.token", "%v", err)
+		case c.QR.Room != "" && c.QR.Room != claims.Room:
+			bad("qr.room", "token is for room %q", claims.Room)
+		}
+	}
+
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		bad("log.level", "%q: want debug, info, warn or error", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		bad("log.format", "%q: want text or json", c.Log.Format)
+	}
+	return errors.Join(errs...)
+}
+
+func (rc roomConfig) validate(prefix string, bad func(field, format string, args ...any)) {
+	if rc.MaxTalk != nil && *rc.MaxTalk < 0 {
+		bad(prefix+".max_talk", "must not be negative")
+	}
+	if rc.MediaIdle != nil && *rc.MediaIdle < 0 {
+		bad(prefix+".media_idle", "must not be negative")
+	}
+	if rc.MaxPeers != nil && *rc.MaxPeers < 0 {
+		bad(prefix+".max_peers", "must not be negative")
+	}
+}
+
+func (a acmeConfig) validate(bad func(field, format string, args ...any)) {
+	for _, d := range a.Domains {
+		switch {
+		case d == "":
+			bad("acme.domains", "domain must not be empty")
+		case net.ParseIP(d) != nil:
+			bad("acme.domains", "%q: IP addresses are not supported", d)
+		case strings.ContainsAny(d, "*/: "):
+			bad("acme.domains", "%q: want a plain domain name (wildcards are not supported)", d)
+		}
+	}
+	if !strings.HasPrefix(a.Directory, "https://") {
+		bad("acme.directory", "%q: want an https:// URL", a.Directory)
+	}
+	if a.HTTPAddr != "" {
+		if _, _, err := net.SplitHostPort(a.HTTPAddr); err != nil {
+			bad("acme.http_addr", "%v", err)
+		}
+	}
+}
+
+// hubOptions переводит настройки комнат в опции room.Hub.
+func (c *config) hubOptions() []room.Option {
+	def := c.RoomDefaults
+	opts := []room.Option{
+		room.WithResumeGrace(time.Duration(c.ResumeGrace)),
+		room.WithFloorQueue(c.FloorQueue),
+		room.WithTalkLimits(room.TalkLimits{MaxTalk: time.Duration(*def.MaxTalk), MediaIdle: time.Duration(*def.MediaIdle)}),
+		room.WithMaxPeers(*def.MaxPeers),
+		room.WithSlowConsumerTimeout(time.Duration(c.SlowConsumer)),
+	}
+	for id, rc := range c.Rooms {
+		if rc.MaxTalk != nil || rc.MediaIdle != nil {
+			limits := room.TalkLimits{
+				MaxTalk:   time.Duration(*cmp.Or(rc.MaxTalk, def.MaxTalk)),
+				MediaIdle: time.Duration(*cmp.Or(rc.MediaIdle, def.MediaIdle)),
+			}
+			opts = append(opts, room.WithRoomTalkLimits(id, limits))
+		}
+		if rc.MaxPeers != nil {
+			opts = append(opts, room.WithRoomMaxPeers(id, *rc.MaxPeers))
+		}
+		if rc.Password != "" {
+			opts = append(opts, room.WithRoomPassword(id, rc.Password))
+		}
+	}
+	return opts
+}
+
+// stringList — список через запятую во флаге и массив строк в JSON.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for v := range strings.SplitSeq(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// duration — time.Duration, которая в JSON и флагах пишется как "15s".
+type duration time.Duration
+
+func (d duration) String() string { return time.Duration(d).String() }
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"15s\": %s", b)
+	}
+	return d.Set(s)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"teletalkie/internal/room"
+	"teletalkie/internal/token"
+)
+
+// writeConfig кладёт JSON-конфигурацию во временный файл.
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "teletalkie.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// env — окружение для loadConfig без настоящих переменных процесса.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	file := writeConfig(t, `{"addr": ":9000", "room_defaults": {"max_talk": "1m"}, "mdns": false}`)
+
+	for _, tc := range []struct {
+		name      string
+		env       map[string]string
+		args      []string
+		addr      string
+		maxTalk   time.Duration
+		mediaIdle time.Duration
+		mdns      bool
+	}{
+		{name: "defaults", addr: ":8080", maxTalk: 5 * time.Minute, mediaIdle: 15 * time.Second, mdns: true},
+		{
+			name: "file", args: []string{"--config", file},
+			addr: ":9000", maxTalk: time.Minute, mediaIdle: 15 * time.Second,
+		},
+		{
+			name: "file from env", env: map[string]string{"TELETALKIE_CONFIG": file},
+			addr: ":9000", maxTalk: time.Minute, mediaIdle: 15 * time.Second,
+		},
+		{
+			name: "env over file",
+			env:  map[string]string{"TELETALKIE_ADDR": ":9100", "TELETALKIE_MAX_TALK": "2m", "TELETALKIE_MDNS": "true"},
+			args: []string{"--config", file},
+			addr: ":9100", maxTalk: 2 * time.Minute, mediaIdle: 15 * time.Second, mdns: true,
+		},
+		{
+			name: "flags over env",
+			env:  map[string]string{"TELETALKIE_ADDR": ":9100", "TELETALKIE_MAX_TALK": "2m"},
+			args: []string{"--config", file, "--addr", ":9200", "--max-talk", "3m", "--media-idle", "0s"},
+			addr: ":9200", maxTalk: 3 * time.Minute,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := loadConfig(tc.args, env(tc.env))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Addr != tc.addr || cfg.MDNS != tc.mdns {
+				t.Errorf("addr %q, mdns %v; want %q, %v", cfg.Addr, cfg.MDNS, tc.addr, tc.mdns)
+			}
+			if got := time.Duration(*cfg.RoomDefaults.MaxTalk); got != tc.maxTalk {
+				t.Errorf("max_talk = %v, want %v", got, tc.maxTalk)
+			}
+			if got := time.Duration(*cfg.RoomDefaults.MediaIdle); got != tc.mediaIdle {
+				t.Errorf("media_idle = %v, want %v", got, tc.mediaIdle)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file string
+		env  map[string]string
+		want string
+	}{
+		{name: "unknown field", file: `{"adr": ":9000"}`, want: `unknown field "adr"`},
+		{name: "unknown room field", file: `{"rooms": {"ops": {"max_talks": "1m"}}}`, want: `unknown field "max_talks"`},
+		{name: "duration as number", file: `{"drain_timeout": 10}`, want: `duration must be a string`},
+		{name: "bad env value", env: map[string]string{"TELETALKIE_MAX_TALK": "soon"}, want: "$TELETALKIE_MAX_TALK"},
+		{name: "validation", file: `{"addr": "8080"}`, want: "addr:"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var args []string
+			if tc.file != "" {
+				args = []string{"--config", writeConfig(t, tc.file)}
+			}
+			_, err := loadConfig(args, env(tc.env))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("got %v, want error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_NullRoomDefaults(t *testing.T) {
+	for _, data := range []string{
+		`{"room_defaults": null}`,
+		`{"room_defaults": {"max_talk": null, "media_idle": null, "max_peers": null}}`,
+	} {
+		cfg, err := loadConfig([]string{"--config", writeConfig(t, data)}, env(nil))
+		if err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		def := defaultConfig().RoomDefaults
+		got := cfg.RoomDefaults
+		if got.MaxTalk == nil || *got.MaxTalk != *def.MaxTalk ||
+			got.MediaIdle == nil || *got.MediaIdle != *def.MediaIdle ||
+			got.MaxPeers == nil || *got.MaxPeers != *def.MaxPeers {
+			t.Errorf("%s: defaults not restored: %+v", data, got)
+		}
+		cfg.hubOptions() // разыменовывает room_defaults
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := "s3cret"
+	tok, err := token.Issue([]byte(secret), token.Claims{Room: "ops", Name: "alice", Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(c *config)
+		want   []string // подстроки ошибки; пусто — ошибки нет
+	}{
+		{name: "defaults", modify: func(c *config) {}},
+		{name: "bad addr", modify: func(c *config) { c.Addr = "8080" }, want: []string{"addr:"}},
+		{name: "cert without key", modify: func(c *config) { c.TLS.Cert = "cert.pem" }, want: []string{"tls: cert and key"}},
+		{
+			name: "negative durations",
+			modify: func(c *config) {
+				c.ResumeGrace, c.SlowConsumer, c.DrainTimeout = -1, -1, -1
+			},
+			want: []string{"resume_grace: must not be negative", "slow_consumer_timeout:", "drain_timeout:"},
+		},
+		{
+			name: "negative room limits",
+			modify: func(c *config) {
+				c.Rooms = map[string]roomConfig{"ops": {MaxPeers: ptr(-1), MaxTalk: ptr(duration(-1))}}
+			},
+			want: []string{"rooms.ops.max_peers: must not be negative", "rooms.ops.max_talk:"},
+		},
+		{name: "empty room name", modify: func(c *config) { c.Rooms = map[string]roomConfig{"": {}} }, want: []string{"rooms: room name must not be empty"}},
+		{name: "default password", modify: func(c *config) { c.RoomDefaults.Password = "x" }, want: []string{"room_defaults.password"}},
+		{
+			name:   "acme domains",
+			modify: func(c *config) { c.ACME.Domains = []string{"192.168.1.1", "*.example.org"}; c.DataDir = "" },
+			want:   []string{"IP addresses are not supported", "wildcards are not supported", "data_dir is required"},
+		},
+		{
+			name:   "acme with cert",
+			modify: func(c *config) { c.ACME.Domains = []string{"talk.example.org"}; c.TLS.Cert, c.TLS.Key = "c", "k" },
+			want:   []string{"use either tls.cert and tls.key or acme.domains"},
+		},
+		{name: "acme plain http", modify: func(c *config) { c.ACME.Domains = []string{"talk.example.org"}; c.ACME.Directory = "http://x" }, want: []string{"acme.directory"}},
+		{name: "qr token without secret", modify: func(c *config) { c.QR.Token = tok }, want: []string{"qr.token: join tokens need auth_secret"}},
+		{name: "qr token", modify: func(c *config) { c.QR.Token, c.AuthSecret = tok, secret }},
+		{name: "qr token wrong secret", modify: func(c *config) { c.QR.Token, c.AuthSecret = tok, "other" }, want: []string{"qr.token:"}},
+		{name: "qr room mismatch", modify: func(c *config) { c.QR.Token, c.AuthSecret, c.QR.Room = tok, secret, "lobby" }, want: []string{`qr.room: token is for room "ops"`}},
+		{
+			name:   "log",
+			modify: func(c *config) { c.Log = logConfig{Format: "xml", Level: "loud"} },
+			want:   []string{"log.level", "log.format"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := defaultConfig()
+			c.DataDir = "/var/lib/teletalkie"
+			tc.modify(c)
+			err := c.validate()
+			if len(tc.want) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors %q", tc.want)
+			}
+			// Все ошибки сообщаются разом.
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHubOptions(t *testing.T) {
+	cfg, err := loadConfig([]string{"--config", writeConfig(t, `{
+		"floor_queue": true,
+		"room_defaults": {"max_peers": 2},
+		"rooms": {
+			"solo": {"max_peers": 1},
+			"ops": {"password": "hunter2"},
+			"fast": {"max_talk": "20ms"}
+		}
+	}`)}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := room.NewHub(cfg.hubOptions()...)
+	revoked := make(chan room.Event, 1)
+	hub.SetEventHandler(func(ev room.Event) {
+		if ev.Type == room.EventFloorRevoked {
+			revoked <- ev
+		}
+	})
+
+	join := func(roomID, name, password string) (*room.Session, error) {
+		return hub.Join(roomID, room.JoinOptions{Name: name, Password: password})
+	}
+	mustJoin := func(roomID, name, password string) *room.Session {
+		t.Helper()
+		s, err := join(roomID, name, password)
+		if err != nil {
+			t.Fatalf("%s/%s: %v", roomID, name, err)
+		}
+		return s
+	}
+
+	// max_peers: из rooms и из room_defaults.
+	mustJoin("solo", "alice", "")
+	if _, err := join("solo", "bob", ""); !errors.Is(err, room.ErrRoomFull) {
+		t.Errorf("solo: expected ErrRoomFull, got %v", err)
+	}
+	alice := mustJoin("lobby", "alice", "").Peer
+	bob := mustJoin("lobby", "bob", "").Peer
+	if _, err := join("lobby", "carol", ""); !errors.Is(err, room.ErrRoomFull) {
+		t.Errorf("lobby: expected ErrRoomFull, got %v", err)
+	}
+
+	// floor_queue: занятый эфир ставит в очередь.
+	alice.Room.TryAcquire(alice)
+	if granted, pos := bob.Room.RequestFloor(bob); granted || pos != 1 {
+		t.Errorf("lobby: expected bob queued first, got granted=%v pos=%d", granted, pos)
+	}
+
+	// password делает комнату приватной.
+	if _, err := join("ops", "alice", ""); !errors.Is(err, room.ErrWrongPassword) {
+		t.Errorf("ops: expected ErrWrongPassword, got %v", err)
+	}
+	if s := mustJoin("ops", "alice", "hunter2"); !s.Peer.Room.Private() {
+		t.Error("ops must be private")
+	}
+
+	// max_talk комнаты; media_idle берётся из room_defaults (15s) и
+	// раньше не сработает.
+	fast := mustJoin("fast", "alice", "")
+	if !fast.Peer.Room.TryAcquire(fast.Peer) {
+		t.Fatal("fast: floor not granted")
+	}
+	select {
+	case ev := <-revoked:
+		if ev.Reason != room.RevokeMaxTalk {
+			t.Errorf("fast: revoked for %v, want max talk", ev.Reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("fast: max_talk from rooms not applied")
+	}
+}
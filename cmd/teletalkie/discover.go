@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"teletalkie/internal/mdns"
+	"teletalkie/internal/room"
+)
+
+// runDiscover обрабатывает подкоманду `teletalkie discover`.
+func runDiscover(args []string) {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 3*time.Second, "how long to wait for answers")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	entries, err := mdns.Browse(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(os.Stderr, "no servers found")
+		os.Exit(1)
+	}
+	for _, e := range entries {
+		tls := e.Get("tls") == "1"
+		port := strconv.Itoa(e.Port)
+		fmt.Println(e.Instance)
+		for _, host := range append([]string{e.Host}, ipStrings(e.Addrs)...) {
+			link := url.URL{Scheme: "http", Host: hostPort(host, port, tls), Path: "/"}
+			if tls {
+				link.Scheme = "https"
+			}
+			fmt.Println("  " + link.String())
+		}
+		if rooms := e.Get("rooms"); rooms != "" {
+			fmt.Println("  rooms: " + strings.ReplaceAll(rooms, ",", ", "))
+		}
+		if e.Get("auth") == "token" {
+			fmt.Println("  join token required")
+		}
+	}
+}
+
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, len(ips))
+	for i, ip := range ips {
+		out[i] = ip.String()
+	}
+	return out
+}
+
+// startMDNS объявляет сервер в LAN, пока не завершён ctx. Возвращённый
+// канал закрывается, когда разослан прощальный пакет или mDNS не
+// запустился.
+func startMDNS(ctx context.Context, cfg *config, hub *room.Hub, tls bool, logger *slog.Logger) (*mdns.Responder, <-chan struct{}) {
+	instance := "TeleTalkie"
+	if h, err := os.Hostname(); err == nil && h != "" {
+		instance += " on " + strings.SplitN(h, ".", 2)[0]
+	}
+	port, _ := strconv.Atoi(listenPort(cfg.Addr))
+	r := mdns.New(port,
+		mdns.WithInstance(instance),
+		mdns.WithTXT(func() []string { return mdnsTXT(hub, tls, cfg.AuthSecret != "") }),
+		mdns.WithLogger(logger),
+	)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := r.Run(ctx); err != nil {
+			logger.Warn("mDNS advertising disabled", "event", "mdns_failed", "err", err)
+		}
+	}()
+	return r, done
+}
+
+// mdnsTXT — TXT-записи службы: версия, схема, нужен ли join-токен и
+// открытые комнаты без пароля. Список комнат обрезается до 255 байт
+// строки TXT; комнаты с запятой в имени в него не попадают. С токенами
+// комнат нет вовсе: mDNS слышит вся сеть без всякой проверки, клиенту
+// хватит auth=token.
+func mdnsTXT(hub *room.Hub, tls, auth bool) []string {
+	txt := []string{"v=1", "tls=0"}
+	if tls {
+		txt[1] = "tls=1"
+	}
+	if auth {
+		return append(txt, "auth=token")
+	}
+
+	var ids []string
+	for _, r := range hub.Rooms() {
+		if !r.Private() && !strings.Contains(r.ID, ",") {
+			ids = append(ids, r.ID)
+		}
+	}
+	slices.Sort(ids)
+	rooms := "rooms="
+	for _, id := range ids {
+		sep := ","
+		if rooms == "rooms=" {
+			sep = ""
+		}
+		if len(rooms)+len(sep)+len(id) > 255 {
+			break
+		}
+		rooms += sep + id
+	}
+	if rooms != "rooms=" {
+		txt = append(txt, rooms)
+	}
+	return txt
+}
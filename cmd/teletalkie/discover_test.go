@@ -0,0 +1,64 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"teletalkie/internal/room"
+)
+
+func TestMDNSTXT(t *testing.T) {
+	hub := room.NewHub(room.WithRoomPassword("secret-ops", "hunter2"))
+	for _, j := range []struct{ room, password string }{
+		{"lobby", ""}, {"alpha", ""}, {"a,b", ""}, {"secret-ops", "hunter2"}, {"side", "s3cret"},
+	} {
+		if _, err := hub.Join(j.room, room.JoinOptions{Name: "alice", Password: j.password}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		tls, auth bool
+		want      []string
+	}{
+		{"open", false, false, []string{"v=1", "tls=0", "rooms=alpha,lobby"}},
+		{"tls", true, false, []string{"v=1", "tls=1", "rooms=alpha,lobby"}},
+		{"auth", false, true, []string{"v=1", "tls=0", "auth=token"}},
+		{"tls and auth", true, true, []string{"v=1", "tls=1", "auth=token"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mdnsTXT(hub, tc.tls, tc.auth)
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+			if !tc.auth {
+				return
+			}
+			// С токенами имена комнат не уходят в сеть ни в каком виде.
+			for _, s := range got {
+				for _, id := range []string{"lobby", "alpha", "secret-ops", "side"} {
+					if strings.Contains(s, id) {
+						t.Errorf("room %q advertised with auth on: %q", id, s)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMDNSTXT_RoomsFitOneString(t *testing.T) {
+	hub := room.NewHub()
+	for i := range 40 {
+		id := strings.Repeat("r", 10) + string(rune('a'+i%26)) + string(rune('a'+i/26))
+		if _, err := hub.Join(id, room.JoinOptions{Name: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	txt := mdnsTXT(hub, false, false)
+	rooms := txt[len(txt)-1]
+	if !strings.HasPrefix(rooms, "rooms=") || len(rooms) > 255 {
+		t.Fatalf("rooms string of %d bytes: %q", len(rooms), rooms)
+	}
+}
@@ -1,11 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"teletalkie/internal/acme"
+	"teletalkie/internal/certfile"
+	"teletalkie/internal/qr"
+	"teletalkie/internal/recorder"
 	"teletalkie/internal/room"
 	"teletalkie/internal/server"
 	"teletalkie/internal/tlsgen"
@@ -13,60 +29,322 @@ import (
 )
 
 func main() {
-	addr := flag.String("addr", ":8080", "listen address")
-	useTLS := flag.Bool("tls", false, "enable HTTPS with self-signed certificate (required for mobile camera access)")
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		if err := runToken(os.Args[2:]); err != nil {
+			fatal(slog.Default(), "token issue failed", "err", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "discover" {
+		runDiscover(os.Args[2:])
+		return
+	}
+
+	cfg, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	hub := room.NewHub()
-	srv := server.New(*addr, web.FS, hub)
+	logger, err := newLogger(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// Сторонний код, пишущий через log или slog.Default, — в тот же поток.
+	slog.SetDefault(logger)
 
-	printAddresses(*addr, *useTLS)
+	hub := room.NewHub(append(cfg.hubOptions(), room.WithLogger(logger))...)
 
-	if *useTLS {
-		cert, err := tlsgen.SelfSigned()
+	opts := []server.Option{
+		server.WithLogger(logger),
+		server.WithMetricsEndpoint(cfg.Metrics),
+	}
+	if cfg.RecordDir != "" {
+		rec, err := recorder.New(cfg.RecordDir, recorder.WithLogger(logger))
 		if err != nil {
-			log.Fatalf("failed to generate TLS certificate: %v", err)
+			fatal(logger, "failed to init recorder", "err", err)
 		}
-		log.Println("Generated self-signed TLS certificate")
-		log.Println("⚠️  Accept the security warning in your browser to proceed")
-		if err := srv.ListenAndServeTLS(cert); err != nil {
-			log.Fatal(err)
+		logger.Info("recording transmissions", "dir", cfg.RecordDir)
+		opts = append(opts, server.WithRecorder(rec))
+	}
+	if cfg.AuthSecret != "" {
+		logger.Info("join tokens required (issue with: teletalkie token issue)")
+		opts = append(opts, server.WithAuthenticator(server.TokenAuth{Secret: []byte(cfg.AuthSecret)}))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	useTLS := cfg.TLS.Enabled || cfg.TLS.Cert != "" || len(cfg.ACME.Domains) > 0
+	var tlsCfg *tls.Config
+	var ca *tlsgen.CA
+	if useTLS {
+		tlsCfg, ca, err = loadTLSConfig(ctx, cfg, logger)
+		if err != nil {
+			fatal(logger, "failed to load TLS certificate", "err", err)
+		}
+		if ca != nil {
+			opts = append(opts, server.WithCACert(ca.DER()))
 		}
+	}
+
+	srv := server.New(cfg.Addr, web.FS, hub, opts...)
+
+	mdnsHost := ""
+	if cfg.MDNS {
+		responder, mdnsDone := startMDNS(ctx, cfg, hub, useTLS, logger)
+		defer func() { <-mdnsDone }() // прощальный пакет до выхода
+		// Имя в баннере — то, что прошло пробы: teletalkie.local может
+		// быть занят другим сервером в сети.
+		select {
+		case <-responder.Ready():
+			mdnsHost = responder.Host()
+		case <-mdnsDone:
+		case <-time.After(2 * time.Second):
+		}
+	}
+	printAddresses(cfg.Addr, useTLS, cfg.ACME.Domains, mdnsHost)
+	if ca != nil {
+		printCAInstall(cfg.Addr)
+	}
+	if cfg.QR.Enabled {
+		printJoinQR(cfg, useTLS)
+	}
+
+	serveErr := make(chan error, 1)
+	if useTLS {
+		go func() { serveErr <- srv.ListenAndServeTLS(tlsCfg) }()
 	} else {
-		log.Println("⚠️  Camera/mic won't work on mobile over HTTP. Use --tls for HTTPS.")
-		if err := srv.ListenAndServe(); err != nil {
-			log.Fatal(err)
+		logger.Warn("camera/mic won't work on mobile over HTTP, use --tls for HTTPS")
+		go func() { serveErr <- srv.ListenAndServe() }()
+	}
+
+	select {
+	case err := <-serveErr:
+		fatal(logger, "server failed", "err", err)
+	case <-ctx.Done():
+	}
+	stop() // повторный сигнал завершает процесс сразу
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.DrainTimeout))
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		logger.Warn("shutdown incomplete", "err", err)
+		return
+	}
+	logger.Info("server stopped")
+}
+
+// loadTLSConfig — сертификат по ACME для acme.domains, из tls.cert/tls.key
+// или, если они не заданы, от локального CA из data_dir (он же
+// возвращается, чтобы раздавать его устройствам), а без data_dir —
+// самоподписанный. Файлы tls.cert/tls.key перечитываются, когда меняются
+// на диске, и по SIGHUP — пока не завершён ctx.
+func loadTLSConfig(ctx context.Context, cfg *config, logger *slog.Logger) (*tls.Config, *tlsgen.CA, error) {
+	c, dataDir := cfg.TLS, cfg.DataDir
+	if len(cfg.ACME.Domains) > 0 {
+		tlsCfg, err := startACME(ctx, cfg, logger)
+		return tlsCfg, nil, err
+	}
+	if c.Cert == "" && dataDir != "" {
+		ca, created, err := tlsgen.LoadOrCreateCA(dataDir)
+		if err != nil {
+			return nil, nil, err
 		}
+		fingerprint := fmt.Sprintf("%X", sha256.Sum256(ca.DER()))
+		if created {
+			logger.Info("created local CA: install it on each phone once", "event", "ca_created", "dir", dataDir, "sha256", fingerprint)
+		} else {
+			logger.Info("using local CA", "dir", dataDir, "sha256", fingerprint)
+		}
+		return &tls.Config{GetCertificate: ca.GetCertificate}, ca, nil
 	}
+	if c.Cert == "" {
+		cert, err := tlsgen.SelfSigned()
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Warn("using self-signed TLS certificate: accept the security warning in your browser")
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil, nil
+	}
+
+	r, err := certfile.New(c.Cert, c.Key, certfile.WithLogger(logger))
+	if err != nil {
+		return nil, nil, err
+	}
+	go r.Watch(ctx, certfile.DefaultPollInterval)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if err := r.Reload(); err != nil {
+					logger.Warn("TLS certificate reload failed, keeping the old one", "event", "cert_reload_failed", "err", err)
+				}
+			}
+		}
+	}()
+	return &tls.Config{GetCertificate: r.GetCertificate}, nil, nil
 }
 
-func printAddresses(addr string, tls bool) {
+// startACME заказывает и продлевает сертификат для acme.domains в фоне,
+// пока не завершён ctx. Проверки HTTP-01 обслуживает отдельный HTTP-сервер
+// на acme.http_addr, остальные запросы он перенаправляет на HTTPS.
+func startACME(ctx context.Context, cfg *config, logger *slog.Logger) (*tls.Config, error) {
+	a := cfg.ACME
+	challenges := []string{acme.ChallengeTLSALPN}
+	if a.HTTPAddr != "" {
+		challenges = []string{acme.ChallengeHTTP, acme.ChallengeTLSALPN}
+	}
+	m, err := acme.New(filepath.Join(cfg.DataDir, "acme"), a.Domains,
+		acme.WithDirectory(a.Directory),
+		acme.WithEmail(a.Email),
+		acme.WithChallenges(challenges...),
+		acme.WithLogger(logger),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.HTTPAddr != "" {
+		httpSrv := &http.Server{Addr: a.HTTPAddr, Handler: m.HTTPHandler(redirectHTTPS(listenPort(cfg.Addr)))}
+		go func() {
+			logger.Info("listening", "addr", a.HTTPAddr, "proto", "http", "purpose", "acme")
+			if err := httpSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("ACME HTTP listener failed, only TLS-ALPN-01 will work", "addr", a.HTTPAddr, "err", err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			httpSrv.Close()
+		}()
+	}
+	go m.Run(ctx)
+	return m.TLSConfig(), nil
+}
+
+// redirectHTTPS перенаправляет запрос на тот же хост и путь по HTTPS.
+func redirectHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		target := hostPort(strings.Trim(host, "[]"), port, true)
+		http.Redirect(w, r, "https://"+target+r.URL.RequestURI(), http.StatusFound)
+	})
+}
+
+func printAddresses(addr string, tls bool, domains []string, mdnsHost string) {
 	scheme := "http"
 	if tls {
 		scheme = "https"
 	}
-
-	_, port, _ := net.SplitHostPort(addr)
-	if port == "" {
-		port = "8080"
-	}
+	port := listenPort(addr)
 
 	fmt.Println()
 	fmt.Println("  ╔══════════════════════════════════════╗")
 	fmt.Println("  ║          📻 TeleTalkie               ║")
 	fmt.Println("  ╠══════════════════════════════════════╣")
 	fmt.Printf("  ║  Local:   %s://localhost:%-5s     ║\n", scheme, port)
+	for _, d := range domains {
+		line := "https://" + hostPort(d, port, true)
+		fmt.Printf("  ║  Public:  %-28s║\n", line)
+	}
+	if mdnsHost != "" {
+		line := scheme + "://" + hostPort(mdnsHost, port, tls)
+		fmt.Printf("  ║  mDNS:    %-28s║\n", line)
+	}
+	for _, ip := range lanIPv4() {
+		line := fmt.Sprintf("%s://%s:%s", scheme, ip, port)
+		fmt.Printf("  ║  LAN:     %-28s║\n", line)
+	}
+	fmt.Println("  ╚══════════════════════════════════════╝")
+	fmt.Println()
+}
 
+// printCAInstall печатает ссылку на сертификат локального CA и QR-код с
+// ней: телефон сканирует код, скачивает сертификат и устанавливает его.
+func printCAInstall(addr string) {
+	if ips := lanIPv4(); len(ips) > 0 {
+		link := url.URL{Scheme: "https", Host: hostPort(ips[0], listenPort(addr), true), Path: "/ca.crt"}
+		printQR("Trust this server on a phone once — scan and install the CA:", link.String())
+	}
+}
+
+// printJoinQR печатает QR-код ссылки для входа: на публичный домен, если
+// сертификат получен по ACME (IP в нём нет), иначе на первый LAN-адрес.
+func printJoinQR(cfg *config, tls bool) {
+	host := ""
+	if len(cfg.ACME.Domains) > 0 {
+		host = cfg.ACME.Domains[0]
+	} else if ips := lanIPv4(); len(ips) > 0 {
+		host = ips[0]
+	}
+	if host == "" {
+		return
+	}
+	link := url.URL{Scheme: "http", Host: hostPort(host, listenPort(cfg.Addr), tls), Path: "/"}
+	if tls {
+		link.Scheme = "https"
+	}
+	q := url.Values{}
+	if cfg.QR.Room != "" {
+		q.Set("room", cfg.QR.Room)
+	}
+	if cfg.QR.Token != "" {
+		q.Set("token", cfg.QR.Token)
+	}
+	link.RawQuery = q.Encode()
+	printQR("Scan to join:", link.String())
+}
+
+func printQR(title, link string) {
+	code, err := qr.Encode([]byte(link), qr.M)
+	if err != nil {
+		return
+	}
+	fmt.Println("  " + title)
+	fmt.Println("  " + link)
+	fmt.Print(code)
+	fmt.Println()
+}
+
+// hostPort — host:port без порта по умолчанию для схемы.
+func hostPort(host, port string, tls bool) string {
+	if tls && port == "443" || !tls && port == "80" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func listenPort(addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
+	if port == "" {
+		port = "8080"
+	}
+	return port
+}
+
+// lanIPv4 — IPv4-адреса интерфейсов, кроме loopback.
+func lanIPv4() []string {
+	var ips []string
 	if addrs, err := net.InterfaceAddrs(); err == nil {
 		for _, a := range addrs {
 			if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
-				ip := ipNet.IP.String()
-				line := fmt.Sprintf("%s://%s:%s", scheme, ip, port)
-				fmt.Printf("  ║  LAN:     %-28s║\n", line)
+				ips = append(ips, ipNet.IP.String())
 			}
 		}
 	}
-
-	fmt.Println("  ╚══════════════════════════════════════╝")
-	fmt.Println()
+	return ips
 }
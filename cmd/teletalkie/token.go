@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"teletalkie/internal/room"
+	"teletalkie/internal/token"
+)
+
+// secretEnv — переменная окружения с секретом join-токенов.
+const secretEnv = "TELETALKIE_AUTH_SECRET"
+
+// runToken обрабатывает подкоманду `teletalkie token issue`.
+func runToken(args []string) error {
+	if len(args) == 0 || args[0] != "issue" {
+		fmt.Fprintln(os.Stderr, "usage: teletalkie token issue --room ROOM --name NAME [--role ROLE] [--ttl 24h] [--secret SECRET]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("token issue", flag.ExitOnError)
+	secret := fs.String("secret", os.Getenv(secretEnv), "HMAC secret (default $"+secretEnv+")")
+	roomID := fs.String("room", "", "room the token grants access to")
+	name := fs.String("name", "", "display name of the participant")
+	role := fs.String("role", "member", "participant role: listener, member, dispatcher or admin")
+	ttl := fs.Duration("ttl", 24*time.Hour, "token lifetime")
+	fs.Parse(args[1:])
+
+	if *secret == "" {
+		return fmt.Errorf("secret is required: pass --secret or set $%s", secretEnv)
+	}
+	if _, err := room.ParseRole(*role); err != nil {
+		return err
+	}
+
+	tok, err := token.Issue([]byte(*secret), token.Claims{
+		Room:    *roomID,
+		Name:    *name,
+		Role:    *role,
+		Expires: time.Now().Add(*ttl).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(tok)
+	return nil
+}
@@ -0,0 +1,518 @@
+// Package acme получает и продлевает публичные TLS-сертификаты по ACME
+// (RFC 8555) — например, у Let's Encrypt — без внешних зависимостей.
+// Владение доменом подтверждается проверкой TLS-ALPN-01 (на том же
+// TLS-порту, через GetCertificate) или HTTP-01 (через HTTPHandler на :80).
+// Сертификат и ключи хранятся в каталоге и переживают перезапуск.
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LetsEncrypt — ACME-каталог Let's Encrypt.
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+// Типы проверок владения доменом.
+const (
+	ChallengeTLSALPN = "tls-alpn-01"
+	ChallengeHTTP    = "http-01"
+)
+
+const (
+	accountKeyFile = "account-key.pem"
+	certFile       = "cert.pem"
+	keyFile        = "key.pem"
+
+	alpnProto     = "acme-tls/1"
+	challengePath = "/.well-known/acme-challenge/"
+	checkInterval = 12 * time.Hour  // как часто Run проверяет срок сертификата
+	obtainTimeout = 5 * time.Minute // на один заказ сертификата целиком
+	minRetry      = time.Minute     // пауза после первой неудачи, дальше удваивается
+	maxRetry      = time.Hour
+)
+
+// idPeAcmeIdentifier — расширение сертификата TLS-ALPN-01 (RFC 8737).
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// Manager — сертификат для domains, пригодный для tls.Config.GetCertificate.
+type Manager struct {
+	dir        string
+	domains    []string
+	email      string
+	challenges []string
+	client     *client
+	log        *slog.Logger
+
+	cert atomic.Pointer[tls.Certificate]
+
+	obtainMu sync.Mutex // один заказ за раз
+
+	mu     sync.Mutex
+	tokens map[string]string           // HTTP-01: токен → key authorization
+	alpn   map[string]*tls.Certificate // TLS-ALPN-01: домен → сертификат проверки
+}
+
+// Option — опция Manager для New.
+type Option func(*Manager)
+
+// WithDirectory задаёт URL ACME-каталога (по умолчанию LetsEncrypt).
+func WithDirectory(url string) Option {
+	return func(m *Manager) {
+		m.client.dirURL = url
+	}
+}
+
+// WithEmail задаёт контакт аккаунта: на него CA пишет о проблемах
+// с сертификатом.
+func WithEmail(email string) Option {
+	return func(m *Manager) {
+		m.email = email
+	}
+}
+
+// WithHTTPClient задаёт HTTP-клиент для запросов к CA — например,
+// с корнем тестового сервера Pebble.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(m *Manager) {
+		m.client.hc = hc
+	}
+}
+
+// WithChallenges задаёт проверки в порядке предпочтения (по умолчанию
+// TLS-ALPN-01, затем HTTP-01). Если проверка не прошла, заказ повторяется
+// со следующей. HTTP-01 имеет смысл, только если HTTPHandler слушает :80.
+func WithChallenges(types ...string) Option {
+	return func(m *Manager) {
+		m.challenges = types
+	}
+}
+
+// WithLogger задаёт логгер (по умолчанию slog.Default()).
+func WithLogger(l *slog.Logger) Option {
+	return func(m *Manager) {
+		m.log = l
+	}
+}
+
+// New готовит Manager: загружает из dir ключ аккаунта (или создаёт его)
+// и сохранённый сертификат, если он покрывает domains. Сам сертификат
+// заказывают Obtain и Run.
+func New(dir string, domains []string, opts ...Option) (*Manager, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("acme: no domains")
+	}
+	m := &Manager{
+		dir:        dir,
+		domains:    domains,
+		challenges: []string{ChallengeTLSALPN, ChallengeHTTP},
+		client:     &client{hc: http.DefaultClient, dirURL: LetsEncrypt},
+		log:        slog.Default(),
+		tokens:     make(map[string]string),
+		alpn:       make(map[string]*tls.Certificate),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("acme: %w", err)
+	}
+	key, err := loadOrCreateKey(filepath.Join(dir, accountKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	m.client.key = key
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, certFile), filepath.Join(dir, keyFile))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		m.log.Warn("ignoring stored ACME certificate", "dir", dir, "err", err)
+	case !covers(cert.Leaf, domains):
+		m.log.Info("stored ACME certificate does not cover all domains, will request a new one", "domains", domains)
+	default:
+		m.cert.Store(&cert)
+	}
+	return m, nil
+}
+
+// TLSConfig — tls.Config для Server.ListenAndServeTLS: сертификат
+// Manager'а и ответы на проверки TLS-ALPN-01. HTTP/2 не предлагается —
+// WebSocket работает поверх HTTP/1.1.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"http/1.1", alpnProto},
+	}
+}
+
+// GetCertificate — для tls.Config.GetCertificate. Пока сертификат не
+// получен, рукопожатия завершаются ошибкой.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if slices.Contains(hello.SupportedProtos, alpnProto) {
+		m.mu.Lock()
+		cert := m.alpn[strings.ToLower(hello.ServerName)]
+		m.mu.Unlock()
+		if cert == nil {
+			return nil, fmt.Errorf("acme: no %s challenge for %q", ChallengeTLSALPN, hello.ServerName)
+		}
+		return cert, nil
+	}
+	if cert := m.cert.Load(); cert != nil {
+		return cert, nil
+	}
+	return nil, errors.New("acme: certificate is not obtained yet")
+}
+
+// HTTPHandler отвечает на проверки HTTP-01, остальные запросы передаёт
+// fallback — обычно это редирект на HTTPS.
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, challengePath)
+		if !ok {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		m.mu.Lock()
+		keyAuth, ok := m.tokens[token]
+		m.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, keyAuth)
+	})
+}
+
+// Run получает сертификат, если его ещё нет, и продлевает его, когда
+// остаётся треть срока, — пока не завершён ctx. Неудачные попытки
+// повторяются с растущей паузой: от минуты до часа.
+func (m *Manager) Run(ctx context.Context) {
+	retry := minRetry
+	for {
+		wait := checkInterval
+		if m.needsRenewal() {
+			if err := m.Obtain(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				m.log.Warn("ACME certificate request failed", "event", "acme_failed", "err", err, "retry_in", retry)
+				wait, retry = retry, min(retry*2, maxRetry)
+			} else {
+				retry = minRetry
+			}
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (m *Manager) needsRenewal() bool {
+	cert := m.cert.Load()
+	if cert == nil {
+		return true
+	}
+	lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+	return time.Until(cert.Leaf.NotAfter) < lifetime/3
+}
+
+// Obtain заказывает новый сертификат, пробуя проверки по очереди,
+// сохраняет его и начинает отдавать в GetCertificate.
+func (m *Manager) Obtain(ctx context.Context) error {
+	m.obtainMu.Lock()
+	defer m.obtainMu.Unlock()
+	var errs []error
+	for _, typ := range m.challenges {
+		err := m.obtain(ctx, typ)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", typ, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *Manager) obtain(ctx context.Context, typ string) error {
+	ctx, cancel := context.WithTimeout(ctx, obtainTimeout)
+	defer cancel()
+
+	c := m.client
+	if c.kid == "" {
+		if err := c.discover(ctx); err != nil {
+			return err
+		}
+		if err := c.register(ctx, m.email); err != nil {
+			return err
+		}
+	}
+
+	req := struct {
+		Identifiers []identifier `json:"identifiers"`
+	}{}
+	for _, d := range m.domains {
+		req.Identifiers = append(req.Identifiers, identifier{Type: "dns", Value: d})
+	}
+	var o order
+	resp, err := c.post(ctx, c.dir.NewOrder, req, &o)
+	if err != nil {
+		return err
+	}
+	orderURL := resp.header.Get("Location")
+	if orderURL == "" {
+		return errors.New("acme: no order URL in response")
+	}
+	for _, authz := range o.Authorizations {
+		if err := m.authorize(ctx, authz, typ); err != nil {
+			return err
+		}
+	}
+	// После проверок заказ переходит в ready — не обязательно мгновенно.
+	if err := poll(ctx, c, orderURL, &o, orderDone("ready")); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("acme: generate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.domains[0]},
+		DNSNames: m.domains,
+	}, key)
+	if err != nil {
+		return fmt.Errorf("acme: create CSR: %w", err)
+	}
+	if _, err := c.post(ctx, o.Finalize, map[string]string{"csr": b64(csr)}, &o); err != nil {
+		return err
+	}
+	if err := poll(ctx, c, orderURL, &o, orderDone("valid")); err != nil {
+		return err
+	}
+	resp, err = c.post(ctx, o.Certificate, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("acme: marshal key: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(resp.body, keyPEM)
+	if err != nil {
+		return fmt.Errorf("acme: issued certificate: %w", err)
+	}
+	// Ключ пишется первым: если запись оборвётся, пара не сойдётся и при
+	// следующем запуске сертификат будет заказан заново.
+	if err := os.WriteFile(filepath.Join(m.dir, keyFile), keyPEM, 0o600); err != nil {
+		return fmt.Errorf("acme: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(m.dir, certFile), resp.body, 0o644); err != nil {
+		return fmt.Errorf("acme: %w", err)
+	}
+	m.cert.Store(&cert)
+	m.log.Info("ACME certificate obtained", "event", "acme_obtained", "domains", m.domains, "challenge", typ, "expires", cert.Leaf.NotAfter)
+	return nil
+}
+
+// orderDone — условие опроса заказа: статус want; invalid — ошибка.
+func orderDone(want string) func(*order) (bool, error) {
+	return func(o *order) (bool, error) {
+		switch o.Status {
+		case want:
+			return true, nil
+		case "invalid":
+			if o.Error != nil {
+				return false, o.Error
+			}
+			return false, errors.New("acme: order is invalid")
+		case "valid":
+			if want == "ready" {
+				return true, nil // уже выпущен по прежнему заказу
+			}
+		}
+		return false, nil
+	}
+}
+
+// authorize проходит проверку typ для одной авторизации заказа.
+func (m *Manager) authorize(ctx context.Context, url, typ string) error {
+	c := m.client
+	var a authorization
+	if _, err := c.post(ctx, url, nil, &a); err != nil {
+		return err
+	}
+	if a.Status == "valid" {
+		return nil
+	}
+	domain := a.Identifier.Value
+	i := slices.IndexFunc(a.Challenges, func(ch challenge) bool { return ch.Type == typ })
+	if i < 0 {
+		return fmt.Errorf("acme: %s: server does not offer %s", domain, typ)
+	}
+	ch := a.Challenges[i]
+	keyAuth, err := c.keyAuthorization(ch.Token)
+	if err != nil {
+		return err
+	}
+	cleanup, err := m.respond(domain, typ, ch.Token, keyAuth)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if _, err := c.post(ctx, ch.URL, struct{}{}, nil); err != nil {
+		return err
+	}
+	return poll(ctx, c, url, &a, func(a *authorization) (bool, error) {
+		switch a.Status {
+		case "valid":
+			return true, nil
+		case "pending":
+			return false, nil
+		}
+		for _, ch := range a.Challenges {
+			if ch.Type == typ && ch.Error != nil {
+				return false, fmt.Errorf("acme: %s: %w", domain, ch.Error)
+			}
+		}
+		return false, fmt.Errorf("acme: %s: authorization is %s", domain, a.Status)
+	})
+}
+
+// respond готовит ответ на проверку и возвращает функцию, убирающую его.
+func (m *Manager) respond(domain, typ, token, keyAuth string) (func(), error) {
+	switch typ {
+	case ChallengeHTTP:
+		m.mu.Lock()
+		m.tokens[token] = keyAuth
+		m.mu.Unlock()
+		return func() {
+			m.mu.Lock()
+			delete(m.tokens, token)
+			m.mu.Unlock()
+		}, nil
+	case ChallengeTLSALPN:
+		cert, err := alpnCert(domain, keyAuth)
+		if err != nil {
+			return nil, err
+		}
+		domain = strings.ToLower(domain)
+		m.mu.Lock()
+		m.alpn[domain] = cert
+		m.mu.Unlock()
+		return func() {
+			m.mu.Lock()
+			delete(m.alpn, domain)
+			m.mu.Unlock()
+		}, nil
+	}
+	return nil, fmt.Errorf("acme: unsupported challenge %q", typ)
+}
+
+// alpnCert — самоподписанный сертификат проверки TLS-ALPN-01: домен
+// и SHA-256 от key authorization в критическом расширении.
+func alpnCert(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("acme: generate key: %w", err)
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	ext, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:    serial,
+		Subject:         pkix.Name{CommonName: domain},
+		NotBefore:       time.Now().Add(-time.Minute),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		DNSNames:        []string{domain},
+		ExtraExtensions: []pkix.Extension{{Id: idPeAcmeIdentifier, Critical: true, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("acme: create challenge certificate: %w", err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// covers сообщает, подходит ли сертификат для всех domains.
+func covers(cert *x509.Certificate, domains []string) bool {
+	for _, d := range domains {
+		if cert.VerifyHostname(d) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func loadOrCreateKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("acme: %s: no PEM data", path)
+		}
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("acme: %s: %w", path, err)
+		}
+		key, ok := k.(*ecdsa.PrivateKey)
+		if !ok || key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("acme: %s: want an ECDSA P-256 key", path)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("acme: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("acme: generate key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("acme: marshal key: %w", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, fmt.Errorf("acme: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,436 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCA — минимальный ACME-сервер в памяти: проверяет подписи JWS
+// и nonce, а проверки владения доменом выполняет через validate.
+type fakeCA struct {
+	t        *testing.T
+	ts       *httptest.Server
+	key      *ecdsa.PrivateKey
+	root     *x509.Certificate
+	validate func(typ, domain, keyAuth string) bool
+
+	mu       sync.Mutex
+	nonces   map[string]bool
+	heads    int  // запросов newNonce
+	badNonce bool // отвергнуть следующий запрос с badNonce
+	accounts map[string]*ecdsa.PublicKey
+	thumbs   map[string]string // kid → отпечаток ключа
+	orders   []*fakeOrder
+	authzs   []*authorization
+}
+
+type fakeOrder struct {
+	order
+	authzs []*authorization
+	cert   []byte
+}
+
+func newFakeCA(t *testing.T, validate func(typ, domain, keyAuth string) bool) *fakeCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake ACME root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := x509.ParseCertificate(der)
+	ca := &fakeCA{
+		t: t, key: key, root: root, validate: validate,
+		badNonce: true,
+		nonces:   map[string]bool{},
+		accounts: map[string]*ecdsa.PublicKey{},
+		thumbs:   map[string]string{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /dir", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(directory{
+			NewNonce: ca.ts.URL + "/nonce", NewAccount: ca.ts.URL + "/account", NewOrder: ca.ts.URL + "/order",
+		})
+	})
+	mux.HandleFunc("HEAD /nonce", func(w http.ResponseWriter, r *http.Request) {
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		ca.heads++
+		ca.nonce(w)
+	})
+	mux.HandleFunc("POST /", ca.handlePost)
+	ca.ts = httptest.NewTLSServer(mux)
+	t.Cleanup(ca.ts.Close)
+	return ca
+}
+
+func (ca *fakeCA) nonce(w http.ResponseWriter) {
+	n := rand.Text()
+	ca.nonces[n] = true
+	w.Header().Set("Replay-Nonce", n)
+}
+
+func (ca *fakeCA) problem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{Status: status, Type: "urn:ietf:params:acme:error:" + typ, Detail: detail})
+}
+
+func (ca *fakeCA) handlePost(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.nonce(w)
+
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		ca.problem(w, 400, "malformed", err.Error())
+		return
+	}
+	var hdr struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  *jwk
+	}
+	if err := json.Unmarshal(decode64(jws.Protected), &hdr); err != nil || hdr.Alg != "ES256" {
+		ca.problem(w, 400, "malformed", "bad protected header")
+		return
+	}
+	if !ca.nonces[hdr.Nonce] {
+		ca.problem(w, 400, "badNonce", "unknown nonce")
+		return
+	}
+	delete(ca.nonces, hdr.Nonce)
+	if ca.badNonce {
+		ca.badNonce = false
+		ca.problem(w, 400, "badNonce", "try again")
+		return
+	}
+	if hdr.URL != ca.ts.URL+r.URL.Path {
+		ca.problem(w, 401, "unauthorized", "url mismatch: "+hdr.URL)
+		return
+	}
+
+	var pub *ecdsa.PublicKey
+	var thumb string
+	if hdr.JWK != nil {
+		if r.URL.Path != "/account" {
+			ca.problem(w, 400, "malformed", "jwk outside newAccount")
+			return
+		}
+		point := slices.Concat([]byte{4}, decode64(hdr.JWK.X), decode64(hdr.JWK.Y))
+		var err error
+		if pub, err = ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point); err != nil {
+			ca.problem(w, 400, "badPublicKey", err.Error())
+			return
+		}
+		sum := sha256.Sum256(fmt.Appendf(nil, `{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, hdr.JWK.X, hdr.JWK.Y))
+		thumb = base64.RawURLEncoding.EncodeToString(sum[:])
+	} else {
+		pub, thumb = ca.accounts[hdr.Kid], ca.thumbs[hdr.Kid]
+		if pub == nil {
+			ca.problem(w, 400, "accountDoesNotExist", hdr.Kid)
+			return
+		}
+	}
+	sig := decode64(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		ca.problem(w, 400, "malformed", "bad signature")
+		return
+	}
+	payload := decode64(jws.Payload)
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	idx := func() int {
+		var i int
+		fmt.Sscan(path[1], &i)
+		return i
+	}
+	switch path[0] {
+	case "account":
+		kid := ca.ts.URL + "/account/" + thumb
+		ca.accounts[kid], ca.thumbs[kid] = pub, thumb
+		w.Header().Set("Location", kid)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(account{Status: "valid"})
+	case "order":
+		if len(path) == 2 {
+			json.NewEncoder(w).Encode(ca.orders[idx()].order)
+			return
+		}
+		var req struct{ Identifiers []identifier }
+		json.Unmarshal(payload, &req)
+		o := &fakeOrder{order: order{Status: "pending", Identifiers: req.Identifiers}}
+		n := len(ca.orders)
+		o.Finalize = fmt.Sprintf("%s/finalize/%d", ca.ts.URL, n)
+		for _, id := range req.Identifiers {
+			a := &authorization{Status: "pending", Identifier: id}
+			m := len(ca.authzs)
+			for _, typ := range []string{ChallengeHTTP, ChallengeTLSALPN, "dns-01"} {
+				a.Challenges = append(a.Challenges, challenge{
+					Type: typ, Status: "pending", Token: fmt.Sprintf("token-%d-%s", m, typ),
+					URL: fmt.Sprintf("%s/chall/%d/%s", ca.ts.URL, m, typ),
+				})
+			}
+			ca.authzs = append(ca.authzs, a)
+			o.authzs = append(o.authzs, a)
+			o.Authorizations = append(o.Authorizations, fmt.Sprintf("%s/authz/%d", ca.ts.URL, m))
+		}
+		ca.orders = append(ca.orders, o)
+		w.Header().Set("Location", fmt.Sprintf("%s/order/%d", ca.ts.URL, n))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(o.order)
+	case "authz":
+		json.NewEncoder(w).Encode(ca.authzs[idx()])
+	case "chall":
+		a := ca.authzs[idx()]
+		i := slices.IndexFunc(a.Challenges, func(ch challenge) bool { return ch.Type == path[2] })
+		ch := &a.Challenges[i]
+		if ca.validate(ch.Type, a.Identifier.Value, ch.Token+"."+thumb) {
+			ch.Status, a.Status = "valid", "valid"
+		} else {
+			ch.Status, a.Status = "invalid", "invalid"
+			ch.Error = &problem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: "wrong response"}
+		}
+		for _, o := range ca.orders {
+			if slices.Contains(o.authzs, a) {
+				o.Status = "ready"
+				for _, a := range o.authzs {
+					if a.Status != "valid" {
+						o.Status = "pending"
+					}
+					if a.Status == "invalid" {
+						o.Status = "invalid"
+						break
+					}
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(ch)
+	case "finalize":
+		o := ca.orders[idx()]
+		if o.Status != "ready" {
+			ca.problem(w, 403, "orderNotReady", o.Status)
+			return
+		}
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		csr, err := x509.ParseCertificateRequest(decode64(req.CSR))
+		if err != nil || csr.CheckSignature() != nil {
+			ca.problem(w, 400, "badCSR", fmt.Sprint(err))
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(idx() + 2)),
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			DNSNames:     csr.DNSNames,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.root, csr.PublicKey, ca.key)
+		if err != nil {
+			ca.t.Error(err)
+		}
+		o.cert = slices.Concat(
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw}),
+		)
+		o.Status = "valid"
+		o.Certificate = fmt.Sprintf("%s/cert/%d", ca.ts.URL, idx())
+		json.NewEncoder(w).Encode(o.order)
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.orders[idx()].cert)
+	default:
+		ca.problem(w, 404, "malformed", r.URL.Path)
+	}
+}
+
+func decode64(s string) []byte {
+	b, _ := base64.RawURLEncoding.DecodeString(s)
+	return b
+}
+
+func newManager(t *testing.T, ca *fakeCA, dir string, opts ...Option) *Manager {
+	t.Helper()
+	m, err := New(dir, []string{"talk.example.org"}, append([]Option{
+		WithDirectory(ca.ts.URL + "/dir"),
+		WithHTTPClient(ca.ts.Client()),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// viaHTTP — проверка HTTP-01: запрос к HTTPHandler, как от CA.
+func viaHTTP(m **Manager) func(typ, domain, keyAuth string) bool {
+	return func(typ, domain, keyAuth string) bool {
+		if typ != ChallengeHTTP {
+			return false
+		}
+		token, _, _ := strings.Cut(keyAuth, ".")
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://"+domain+challengePath+token, nil)
+		(*m).HTTPHandler(http.NotFoundHandler()).ServeHTTP(rec, req)
+		body, _ := io.ReadAll(rec.Body)
+		return rec.Code == http.StatusOK && string(body) == keyAuth
+	}
+}
+
+// viaALPN — проверка TLS-ALPN-01: рукопожатие с acme-tls/1 и SNI домена.
+func viaALPN(m **Manager) func(typ, domain, keyAuth string) bool {
+	return func(typ, domain, keyAuth string) bool {
+		if typ != ChallengeTLSALPN {
+			return false
+		}
+		cert, err := (*m).GetCertificate(&tls.ClientHelloInfo{ServerName: domain, SupportedProtos: []string{alpnProto}})
+		if err != nil {
+			return false
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil || leaf.VerifyHostname(domain) != nil {
+			return false
+		}
+		want := sha256.Sum256([]byte(keyAuth))
+		for _, ext := range leaf.Extensions {
+			var got []byte
+			if ext.Id.Equal(idPeAcmeIdentifier) && ext.Critical {
+				if _, err := asn1.Unmarshal(ext.Value, &got); err == nil && string(got) == string(want[:]) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+func checkCert(t *testing.T, ca *fakeCA, m *Manager) {
+	t.Helper()
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "talk.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.root)
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "talk.example.org"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestObtain(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		challenge string
+		validator func(**Manager) func(typ, domain, keyAuth string) bool
+	}{
+		{"http-01", ChallengeHTTP, viaHTTP},
+		{"tls-alpn-01", ChallengeTLSALPN, viaALPN},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var m *Manager
+			ca := newFakeCA(t, tc.validator(&m))
+			dir := t.TempDir()
+			m = newManager(t, ca, dir, WithChallenges(tc.challenge))
+
+			if _, err := m.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+				t.Fatal("expected an error before the certificate is obtained")
+			}
+			if err := m.Obtain(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+			checkCert(t, ca, m)
+
+			// Ответы на проверки убраны.
+			if len(m.tokens) != 0 || len(m.alpn) != 0 {
+				t.Fatal("challenge responses left behind")
+			}
+		})
+	}
+}
+
+func TestObtain_FallsBackToNextChallenge(t *testing.T) {
+	var m *Manager
+	ca := newFakeCA(t, viaHTTP(&m)) // TLS-ALPN-01 не проходит
+	m = newManager(t, ca, t.TempDir())
+	if err := m.Obtain(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	checkCert(t, ca, m)
+	if got := len(ca.orders); got != 2 {
+		t.Fatalf("expected a second order after the failed challenge, got %d orders", got)
+	}
+	// Nonce берётся из предыдущего ответа, newNonce нужен только первому запросу.
+	if ca.heads != 1 {
+		t.Fatalf("expected one newNonce request, got %d", ca.heads)
+	}
+}
+
+func TestObtain_FailsWithProblem(t *testing.T) {
+	ca := newFakeCA(t, func(string, string, string) bool { return false })
+	m := newManager(t, ca, t.TempDir())
+	err := m.Obtain(t.Context())
+	if err == nil || !strings.Contains(err.Error(), "wrong response") {
+		t.Fatalf("expected the CA's problem detail, got %v", err)
+	}
+}
+
+func TestNew_LoadsStoredCertificate(t *testing.T) {
+	var m *Manager
+	ca := newFakeCA(t, viaHTTP(&m))
+	dir := t.TempDir()
+	m = newManager(t, ca, dir, WithChallenges(ChallengeHTTP))
+	if err := m.Obtain(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, keyFile)); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("certificate key must be private: %v", err)
+	}
+
+	// После перезапуска сертификат берётся с диска, заказывать не нужно.
+	again := newManager(t, ca, dir)
+	if again.needsRenewal() {
+		t.Fatal("expected the stored certificate to be fresh")
+	}
+	checkCert(t, ca, again)
+
+	// Другой набор доменов — сохранённый сертификат не подходит.
+	other, err := New(dir, []string{"other.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !other.needsRenewal() {
+		t.Fatal("expected a new certificate for a different domain")
+	}
+}
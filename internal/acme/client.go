@@ -0,0 +1,315 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxResponse — ответы ACME-сервера больше этого не читаются.
+const maxResponse = 1 << 20
+
+// client — ACME-аккаунт: запросы к серверу, подписанные ключом аккаунта
+// (JWS с ES256, RFC 8555 §6.2).
+type client struct {
+	hc     *http.Client
+	key    *ecdsa.PrivateKey
+	dirURL string
+
+	dir directory
+	kid string // URL аккаунта; пока пуст, запросы подписываются jwk
+
+	mu    sync.Mutex
+	nonce string // Replay-Nonce из последнего ответа
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// problem — ошибка ACME-сервера (RFC 7807).
+type problem struct {
+	Status int    `json:"status"`
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (p *problem) Error() string {
+	return fmt.Sprintf("acme: %s (%d): %s", p.Type, p.Status, p.Detail)
+}
+
+type account struct {
+	Status               string   `json:"status,omitempty"`
+	Contact              []string `json:"contact,omitempty"`
+	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed,omitempty"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	Status         string       `json:"status"`
+	Identifiers    []identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *problem     `json:"error"`
+}
+
+type authorization struct {
+	Status     string      `json:"status"`
+	Identifier identifier  `json:"identifier"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *problem `json:"error"`
+}
+
+// response — прочитанный ответ сервера.
+type response struct {
+	header http.Header
+	body   []byte
+}
+
+func (c *client) discover(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.dirURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(resp.body, &c.dir); err != nil {
+		return fmt.Errorf("acme: directory: %w", err)
+	}
+	if c.dir.NewNonce == "" || c.dir.NewAccount == "" || c.dir.NewOrder == "" {
+		return errors.New("acme: directory is incomplete")
+	}
+	return nil
+}
+
+// register находит или создаёт аккаунт ключа c.key и запоминает его URL.
+func (c *client) register(ctx context.Context, email string) error {
+	acct := account{TermsOfServiceAgreed: true}
+	if email != "" {
+		acct.Contact = []string{"mailto:" + email}
+	}
+	resp, err := c.post(ctx, c.dir.NewAccount, acct, nil)
+	if err != nil {
+		return err
+	}
+	c.kid = resp.header.Get("Location")
+	if c.kid == "" {
+		return errors.New("acme: no account URL in response")
+	}
+	return nil
+}
+
+// post шлёт подписанный запрос и, если out не nil, разбирает JSON-ответ.
+// payload nil — POST-as-GET. Ответ с кодом ≥ 400 — ошибка *problem;
+// badNonce повторяется один раз со свежим nonce.
+func (c *client) post(ctx context.Context, url string, payload, out any) (*response, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		nonce, err := c.takeNonce(ctx)
+		if err != nil {
+			return nil, err
+		}
+		jws, err := c.sign(url, nonce, body)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jws))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		resp, err := c.do(req)
+		var p *problem
+		if errors.As(err, &p) && p.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if out != nil {
+			if err := json.Unmarshal(resp.body, out); err != nil {
+				return nil, fmt.Errorf("acme: %s: %w", url, err)
+			}
+		}
+		return resp, nil
+	}
+}
+
+// do выполняет запрос, запоминает Replay-Nonce и превращает коды ошибок
+// в *problem.
+func (c *client) do(req *http.Request) (*response, error) {
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("acme: %w", err)
+	}
+	defer resp.Body.Close()
+	if n := resp.Header.Get("Replay-Nonce"); n != "" {
+		c.mu.Lock()
+		c.nonce = n
+		c.mu.Unlock()
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return nil, fmt.Errorf("acme: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		p := &problem{Status: resp.StatusCode}
+		if json.Unmarshal(body, p) != nil || p.Type == "" {
+			p.Type, p.Detail = "http", string(body)
+		}
+		return nil, p
+	}
+	return &response{header: resp.Header, body: body}, nil
+}
+
+func (c *client) takeNonce(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	n := c.nonce
+	c.nonce = ""
+	c.mu.Unlock()
+	if n != "" {
+		return n, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	if n = resp.header.Get("Replay-Nonce"); n == "" {
+		return "", errors.New("acme: no nonce in response")
+	}
+	c.mu.Lock()
+	c.nonce = ""
+	c.mu.Unlock()
+	return n, nil
+}
+
+// sign — тело запроса: JWS в flattened JSON.
+func (c *client) sign(url, nonce string, payload []byte) ([]byte, error) {
+	protected := map[string]any{"alg": "ES256", "nonce": nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		k, err := jwkOf(&c.key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		protected["jwk"] = k
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	h64, p64 := b64(header), b64(payload)
+	digest := sha256.Sum256([]byte(h64 + "." + p64))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return json.Marshal(struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}{h64, p64, b64(sig)})
+}
+
+// jwk — открытый ключ P-256 в JWK. Поля — в лексикографическом порядке,
+// как требует отпечаток (RFC 7638).
+type jwk struct {
+	Crv string `json:"crv"`
+	Kty string `json:"kty"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func jwkOf(pub *ecdsa.PublicKey) (jwk, error) {
+	point, err := pub.Bytes() // 0x04 || X || Y
+	if err != nil {
+		return jwk{}, err
+	}
+	return jwk{Crv: "P-256", Kty: "EC", X: b64(point[1:33]), Y: b64(point[33:])}, nil
+}
+
+// keyAuthorization — ответ на проверку: токен и отпечаток ключа аккаунта.
+func (c *client) keyAuthorization(token string) (string, error) {
+	k, err := jwkOf(&c.key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	j, err := json.Marshal(k)
+	if err != nil {
+		return "", err
+	}
+	thumb := sha256.Sum256(j)
+	return token + "." + b64(thumb[:]), nil
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// retryAfter — пауза перед следующим опросом: Retry-After или def.
+func retryAfter(h http.Header, def time.Duration) time.Duration {
+	if s, err := strconv.Atoi(h.Get("Retry-After")); err == nil && s > 0 {
+		return min(time.Duration(s)*time.Second, time.Minute)
+	}
+	return def
+}
+
+// poll опрашивает url (POST-as-GET) в out, пока done не вернёт true или
+// ошибку, выдерживая паузы из Retry-After.
+func poll[T any](ctx context.Context, c *client, url string, out *T, done func(*T) (bool, error)) error {
+	for {
+		resp, err := c.post(ctx, url, nil, out)
+		if err != nil {
+			return err
+		}
+		if ok, err := done(out); ok || err != nil {
+			return err
+		}
+		t := time.NewTimer(retryAfter(resp.header, time.Second))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
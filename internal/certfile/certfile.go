@@ -0,0 +1,139 @@
+// Package certfile отдаёт TLS-сертификат из PEM-файлов и перечитывает
+// их, когда они меняются на диске или по Reload (например, на SIGHUP).
+// Новый сертификат получают только новые TLS-рукопожатия — открытые
+// соединения, в том числе WebSocket'ы, не рвутся.
+package certfile
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPollInterval — как часто Watch проверяет файлы по умолчанию.
+const DefaultPollInterval = 10 * time.Second
+
+// Reloader — сертификат из пары файлов, пригодный для tls.Config.GetCertificate.
+type Reloader struct {
+	certFile, keyFile string
+	log               *slog.Logger
+
+	cert atomic.Pointer[tls.Certificate]
+
+	mu    sync.Mutex // сериализует загрузку
+	stamp stamp      // файлы, из которых загружен текущий сертификат
+	tried stamp      // последняя попытка, в том числе неудачная
+}
+
+// stamp — по чему видно, что файлы поменялись.
+type stamp struct {
+	certMod, keyMod   time.Time
+	certSize, keySize int64
+}
+
+// Option — опция Reloader для New.
+type Option func(*Reloader)
+
+// WithLogger задаёт логгер (по умолчанию slog.Default()).
+func WithLogger(l *slog.Logger) Option {
+	return func(r *Reloader) {
+		r.log = l
+	}
+}
+
+// New загружает сертификат из certFile и keyFile. Ошибка — файлы не
+// читаются или не образуют пару.
+func New(certFile, keyFile string, opts ...Option) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, log: slog.Default()}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate — для tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Reload перечитывает файлы. При ошибке остаётся прежний сертификат.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st, err := r.stat()
+	if err != nil {
+		return err
+	}
+	return r.loadLocked(st)
+}
+
+func (r *Reloader) loadLocked(st stamp) error {
+	r.tried = st
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("certfile: %w", err)
+	}
+	r.cert.Store(&cert)
+	r.stamp = st
+	r.log.Info("TLS certificate loaded", "event", "cert_loaded", "cert", r.certFile, "expires", cert.Leaf.NotAfter)
+	return nil
+}
+
+// Watch проверяет файлы раз в interval и перечитывает их, если они
+// изменились; возвращается, когда ctx завершён. Пока сертификат и ключ
+// обновлены не оба (пара не сходится), работает прежний сертификат —
+// повторная попытка будет при следующем изменении файлов.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			r.poll()
+		}
+	}
+}
+
+func (r *Reloader) poll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st, err := r.stat()
+	if err != nil {
+		if st != r.tried {
+			r.log.Warn("TLS certificate reload failed", "event", "cert_reload_failed", "err", err)
+		}
+		r.tried = st
+		return
+	}
+	if st == r.stamp || st == r.tried {
+		return
+	}
+	if err := r.loadLocked(st); err != nil {
+		r.log.Warn("TLS certificate reload failed, keeping the old one", "event", "cert_reload_failed", "err", err)
+	}
+}
+
+func (r *Reloader) stat() (stamp, error) {
+	var st stamp
+	ci, err := os.Stat(r.certFile)
+	if err != nil {
+		return st, fmt.Errorf("certfile: %w", err)
+	}
+	st.certMod, st.certSize = ci.ModTime(), ci.Size()
+	ki, err := os.Stat(r.keyFile)
+	if err != nil {
+		return st, fmt.Errorf("certfile: %w", err)
+	}
+	st.keyMod, st.keySize = ki.ModTime(), ki.Size()
+	return st, nil
+}
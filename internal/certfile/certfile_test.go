@@ -0,0 +1,92 @@
+package certfile
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"teletalkie/internal/tlsgen"
+)
+
+// writePair пишет новый самоподписанный сертификат в certFile/keyFile
+// с временем изменения mod и возвращает его серийный номер.
+func writePair(t *testing.T, certFile, keyFile string, mod time.Time) string {
+	t.Helper()
+	cert, err := tlsgen.SelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), mod)
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), mod)
+	return cert.Leaf.SerialNumber.String()
+}
+
+func writeFile(t *testing.T, path string, data []byte, mod time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serial(t *testing.T, r *Reloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.SerialNumber.String()
+}
+
+func TestReloadOnChange(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	first := writePair(t, certFile, keyFile, now)
+
+	r, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serial(t, r); got != first {
+		t.Fatalf("expected initial certificate %s, got %s", first, got)
+	}
+
+	// Сертификат обновлён, ключ ещё нет — пара не сходится, остаётся прежний.
+	second := writePair(t, certFile, filepath.Join(dir, "next-key.pem"), now.Add(time.Minute))
+	r.poll()
+	if got := serial(t, r); got != first {
+		t.Fatalf("expected old certificate while key is stale, got %s", got)
+	}
+
+	key, err := os.ReadFile(filepath.Join(dir, "next-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, keyFile, key, now.Add(time.Minute))
+	r.poll()
+	if got := serial(t, r); got != second {
+		t.Fatalf("expected reloaded certificate %s, got %s", second, got)
+	}
+}
+
+func TestNewFailsOnMismatchedPair(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePair(t, certFile, keyFile, time.Now())
+	writePair(t, filepath.Join(dir, "other.pem"), keyFile, time.Now())
+
+	if _, err := New(certFile, keyFile); err == nil {
+		t.Fatal("expected error for certificate and key that do not match")
+	}
+}
@@ -0,0 +1,126 @@
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Entry — сервер, найденный Browse.
+type Entry struct {
+	Instance string   // имя экземпляра, например "TeleTalkie on nas"
+	Host     string   // имя хоста из SRV, например "teletalkie.local"
+	Addrs    []net.IP // IPv4-адреса хоста
+	Port     int
+	TXT      []string // записи key=value
+}
+
+// Get возвращает значение TXT-записи key или "", если её нет.
+func (e Entry) Get(key string) string {
+	for _, kv := range e.TXT {
+		if k, v, _ := strings.Cut(kv, "="); strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// queryInterval — пауза между повторами запроса: пакеты multicast
+// теряются чаще обычных.
+const queryInterval = time.Second
+
+// Browse ищет серверы службы Service в локальной сети, пока не завершён
+// ctx, и возвращает найденные — отсортированными по имени экземпляра.
+// Запрос уходит с произвольного порта, поэтому отвечающие шлют ответ
+// прямо на него (RFC 6762 §6.7), и порт 5353 не нужен.
+func Browse(ctx context.Context) ([]Entry, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("mdns: %w", err)
+	}
+	defer conn.Close()
+
+	q, err := (&message{questions: []question{{name: Service + ".local", qtype: typePTR, qclass: classIN}}}).pack()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		t := time.NewTicker(queryInterval)
+		defer t.Stop()
+		for {
+			conn.WriteToUDP(q, group)
+			select {
+			case <-ctx.Done():
+				conn.SetReadDeadline(time.Now()) // разблокирует ReadFromUDP
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	var msgs []*message
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return entries(msgs), nil
+			}
+			return nil, fmt.Errorf("mdns: %w", err)
+		}
+		if m, err := parse(buf[:n]); err == nil && m.isResponse() {
+			msgs = append(msgs, m)
+		}
+	}
+}
+
+// entries собирает Entry из записей всех ответов: PTR службы даёт
+// экземпляр, SRV и TXT экземпляра — хост, порт и TXT, A хоста — адреса.
+func entries(msgs []*message) []Entry {
+	var all []record
+	for _, m := range msgs {
+		all = append(all, m.answers...)
+		all = append(all, m.additional...)
+	}
+	find := func(name string, rtype uint16) []record {
+		var out []record
+		for _, rr := range all {
+			if rr.rtype == rtype && strings.EqualFold(rr.name, name) {
+				out = append(out, rr)
+			}
+		}
+		return out
+	}
+
+	var out []Entry
+	seen := make(map[string]bool)
+	for _, ptr := range find(Service+".local", typePTR) {
+		if ptr.ttl == 0 || seen[strings.ToLower(ptr.target)] {
+			continue
+		}
+		seen[strings.ToLower(ptr.target)] = true
+		srv := find(ptr.target, typeSRV)
+		if len(srv) == 0 {
+			continue
+		}
+		e := Entry{
+			Instance: strings.TrimSuffix(ptr.target, "."+Service+".local"),
+			Host:     srv[0].target,
+			Port:     int(srv[0].port),
+		}
+		if txt := find(ptr.target, typeTXT); len(txt) > 0 {
+			e.TXT = txt[0].txt
+		}
+		for _, a := range find(e.Host, typeA) {
+			if !slices.ContainsFunc(e.Addrs, a.ip.Equal) {
+				e.Addrs = append(e.Addrs, a.ip)
+			}
+		}
+		out = append(out, e)
+	}
+	slices.SortFunc(out, func(a, b Entry) int { return strings.Compare(a.Instance, b.Instance) })
+	return out
+}
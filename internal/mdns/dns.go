@@ -0,0 +1,277 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Типы и классы записей DNS, которые нужны DNS-SD.
+const (
+	typeA   uint16 = 1
+	typePTR uint16 = 12
+	typeTXT uint16 = 16
+	typeSRV uint16 = 33
+	typeANY uint16 = 255
+
+	classIN uint16 = 1
+	// cacheFlush в классе ответа — запись уникальна, старые копии
+	// в кэшах заменяются (RFC 6762 §10.2). В классе вопроса тот же бит —
+	// просьба ответить unicast'ом.
+	cacheFlush uint16 = 0x8000
+
+	flagResponse uint16 = 0x8400 // QR и AA
+)
+
+var errMalformed = errors.New("mdns: malformed message")
+
+type question struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+// record — ресурсная запись. Из rdata заполнены поля своего типа.
+type record struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+
+	ip     net.IP   // A
+	target string   // PTR, SRV
+	port   uint16   // SRV
+	txt    []string // TXT
+}
+
+type message struct {
+	id         uint16
+	flags      uint16
+	questions  []question
+	answers    []record
+	authority  []record // в запросах-пробах — записи, на которые претендуют
+	additional []record
+}
+
+func (m *message) isResponse() bool { return m.flags&0x8000 != 0 }
+
+// pack кодирует сообщение без сжатия имён: ответы маленькие.
+func (m *message) pack() ([]byte, error) {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.id)
+	binary.BigEndian.PutUint16(b[2:], m.flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.answers)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(m.authority)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.additional)))
+	var err error
+	for _, q := range m.questions {
+		if b, err = appendName(b, q.name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, q.qtype)
+		b = binary.BigEndian.AppendUint16(b, q.qclass)
+	}
+	for _, list := range [][]record{m.answers, m.authority, m.additional} {
+		for _, rr := range list {
+			if b, err = appendRecord(b, rr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+func appendRecord(b []byte, rr record) ([]byte, error) {
+	b, err := appendName(b, rr.name)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, rr.rtype)
+	b = binary.BigEndian.AppendUint16(b, rr.class)
+	b = binary.BigEndian.AppendUint32(b, rr.ttl)
+	lenAt := len(b)
+	b, err = appendRData(append(b, 0, 0), rr)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(b[lenAt:], uint16(len(b)-lenAt-2))
+	return b, nil
+}
+
+func appendRData(b []byte, rr record) ([]byte, error) {
+	var err error
+	switch rr.rtype {
+	case typeA:
+		ip4 := rr.ip.To4()
+		if ip4 == nil {
+			return nil, fmt.Errorf("mdns: %v is not IPv4", rr.ip)
+		}
+		b = append(b, ip4...)
+	case typePTR:
+		if b, err = appendName(b, rr.target); err != nil {
+			return nil, err
+		}
+	case typeSRV:
+		b = append(b, 0, 0, 0, 0) // priority, weight
+		b = binary.BigEndian.AppendUint16(b, rr.port)
+		if b, err = appendName(b, rr.target); err != nil {
+			return nil, err
+		}
+	case typeTXT:
+		if len(rr.txt) == 0 {
+			b = append(b, 0) // пустой TXT — одна пустая строка
+		}
+		for _, s := range rr.txt {
+			if len(s) > 255 {
+				return nil, fmt.Errorf("mdns: TXT string longer than 255 bytes")
+			}
+			b = append(b, byte(len(s)))
+			b = append(b, s...)
+		}
+	default:
+		return nil, fmt.Errorf("mdns: cannot encode record type %d", rr.rtype)
+	}
+	return b, nil
+}
+
+// appendName кодирует имя вида "a.b.local" метками. Точек внутри меток
+// нет: имя экземпляра службы очищается от них заранее.
+func appendName(b []byte, name string) ([]byte, error) {
+	for label := range strings.SplitSeq(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("mdns: bad label in %q", name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+func parse(b []byte) (*message, error) {
+	if len(b) < 12 {
+		return nil, errMalformed
+	}
+	m := &message{
+		id:    binary.BigEndian.Uint16(b[0:]),
+		flags: binary.BigEndian.Uint16(b[2:]),
+	}
+	qd := int(binary.BigEndian.Uint16(b[4:]))
+	an := int(binary.BigEndian.Uint16(b[6:]))
+	ns := int(binary.BigEndian.Uint16(b[8:]))
+	ar := int(binary.BigEndian.Uint16(b[10:]))
+	off := 12
+	for range qd {
+		name, next, err := readName(b, off)
+		if err != nil || next+4 > len(b) {
+			return nil, errMalformed
+		}
+		m.questions = append(m.questions, question{
+			name:   name,
+			qtype:  binary.BigEndian.Uint16(b[next:]),
+			qclass: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		off = next + 4
+	}
+	for i := range an + ns + ar {
+		rr, next, err := readRecord(b, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		switch {
+		case i < an:
+			m.answers = append(m.answers, rr)
+		case i < an+ns:
+			m.authority = append(m.authority, rr)
+		default:
+			m.additional = append(m.additional, rr)
+		}
+	}
+	return m, nil
+}
+
+func readRecord(b []byte, off int) (record, int, error) {
+	name, off, err := readName(b, off)
+	if err != nil || off+10 > len(b) {
+		return record{}, 0, errMalformed
+	}
+	rr := record{
+		name:  name,
+		rtype: binary.BigEndian.Uint16(b[off:]),
+		class: binary.BigEndian.Uint16(b[off+2:]),
+		ttl:   binary.BigEndian.Uint32(b[off+4:]),
+	}
+	n := int(binary.BigEndian.Uint16(b[off+8:]))
+	start, end := off+10, off+10+n
+	if end > len(b) {
+		return record{}, 0, errMalformed
+	}
+	rdata := b[start:end]
+	switch rr.rtype {
+	case typeA:
+		if n != 4 {
+			return record{}, 0, errMalformed
+		}
+		rr.ip = net.IP(append([]byte(nil), rdata...))
+	case typePTR:
+		if rr.target, _, err = readName(b, start); err != nil {
+			return record{}, 0, err
+		}
+	case typeSRV:
+		if n < 7 {
+			return record{}, 0, errMalformed
+		}
+		rr.port = binary.BigEndian.Uint16(rdata[4:])
+		if rr.target, _, err = readName(b, start+6); err != nil {
+			return record{}, 0, err
+		}
+	case typeTXT:
+		for i := 0; i < n; {
+			l := int(rdata[i])
+			if i+1+l > n {
+				return record{}, 0, errMalformed
+			}
+			if l > 0 {
+				rr.txt = append(rr.txt, string(rdata[i+1:i+1+l]))
+			}
+			i += 1 + l
+		}
+	}
+	return rr, end, nil
+}
+
+// readName читает имя со сжатием (RFC 1035 §4.1.4) и возвращает его
+// с точками между метками и смещение за ним.
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, errMalformed
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xC0 == 0xC0:
+			if jumps++; off+1 >= len(b) || jumps > 16 {
+				return "", 0, errMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+		case l > 63 || off+1+l > len(b):
+			return "", 0, errMalformed
+		default:
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package mdns
+
+import "net"
+
+// enableLoopback — на этих системах серверы на одной машине друг друга
+// не слышат; от серверов на других машинах пробы защищают и так.
+func enableLoopback(*net.UDPConn) {}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package mdns
+
+import (
+	"net"
+	"syscall"
+)
+
+// enableLoopback возвращает свои multicast-пакеты на этот же хост —
+// ListenMulticastUDP их отключает. Без них два сервера на одной машине
+// не слышат проб друг друга.
+func enableLoopback(conn *net.UDPConn) {
+	if rc, err := conn.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 1)
+		})
+	}
+}
@@ -0,0 +1,526 @@
+// Package mdns объявляет сервер в локальной сети по mDNS (RFC 6762) и
+// DNS-SD (RFC 6763) без внешних зависимостей: имя teletalkie.local и
+// служба _teletalkie._tcp с портом и TXT-записями — например, списком
+// комнат. Перед объявлением имена проверяются пробами; если их уже
+// занял другой сервер, берутся следующие: teletalkie-2.local и так
+// далее. Browse находит такие серверы. Responder слушает только IPv4
+// на интерфейсе, который выбирает система, — обычно этого хватает
+// домашней или офисной сети.
+package mdns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultHost — имя хоста, под которым объявляется сервер, если оно
+	// свободно.
+	DefaultHost = "teletalkie.local"
+	// Service — тип службы DNS-SD.
+	Service = "_teletalkie._tcp"
+
+	serviceName  = Service + ".local"
+	servicesName = "_services._dns-sd._udp.local"
+
+	hostTTL    = 120  // A и SRV (RFC 6762 §10)
+	serviceTTL = 4500 // PTR и TXT
+	legacyTTL  = 10   // ответы на unicast-запросы с произвольного порта (§6.7)
+
+	probeInterval   = 250 * time.Millisecond // между пробами (§8.1)
+	probeCount      = 3
+	conflictBackoff = 5 * time.Second // после maxQuickConflicts конфликтов подряд (§8.1)
+	refreshInterval = 5 * time.Second // как часто Run сверяет TXT и адреса
+
+	maxQuickConflicts = 15
+)
+
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Responder отвечает на mDNS-запросы о сервере и объявляет его сам:
+// при старте (после проб), при смене TXT или адресов и прощальным
+// пакетом при остановке.
+type Responder struct {
+	baseHost     string // метка хоста без .local
+	baseInstance string
+	port         uint16
+	txt          func() []string
+	log          *slog.Logger
+
+	state    atomic.Pointer[state]
+	probing  atomic.Bool   // имена ещё не наши: на запросы не отвечаем
+	conflict chan struct{} // serve сообщает Run о чужих записях с нашими именами
+	ready    chan struct{}
+	renames  int // только в Run
+}
+
+// state — имена и то, что сейчас объявлено.
+type state struct {
+	host     string // с .local
+	instance string
+	txt      []string
+	addrs    []net.IP
+}
+
+func (s *state) instanceName() string { return s.instance + "." + serviceName }
+
+// Option — опция Responder для New.
+type Option func(*Responder)
+
+// WithHost задаёт имя хоста (по умолчанию DefaultHost). Суффикс .local
+// добавляется, если его нет.
+func WithHost(host string) Option {
+	return func(r *Responder) {
+		r.baseHost = host
+	}
+}
+
+// WithInstance задаёт имя экземпляра службы — его видят в списке
+// найденных серверов (по умолчанию "TeleTalkie").
+func WithInstance(name string) Option {
+	return func(r *Responder) {
+		r.baseInstance = name
+	}
+}
+
+// WithTXT задаёт источник TXT-записей вида key=value. Run вызывает его
+// раз в несколько секунд и объявляет изменения.
+func WithTXT(fn func() []string) Option {
+	return func(r *Responder) {
+		r.txt = fn
+	}
+}
+
+// WithLogger задаёт логгер (по умолчанию slog.Default()).
+func WithLogger(l *slog.Logger) Option {
+	return func(r *Responder) {
+		r.log = l
+	}
+}
+
+// New готовит Responder для сервера на port. Сеть открывает Run.
+func New(port int, opts ...Option) *Responder {
+	r := &Responder{
+		baseHost:     DefaultHost,
+		baseInstance: "TeleTalkie",
+		port:         uint16(port),
+		txt:          func() []string { return nil },
+		log:          slog.Default(),
+		conflict:     make(chan struct{}, 1),
+		ready:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.baseHost = strings.TrimSuffix(strings.TrimSuffix(r.baseHost, "."), ".local")
+	// Точка в метке не кодируется: appendName режет имя по точкам.
+	r.baseInstance = strings.ReplaceAll(r.baseInstance, ".", "-")
+	r.probing.Store(true)
+	r.state.Store(&state{
+		host:     r.hostName(),
+		instance: r.instanceLabel(),
+		txt:      r.txt(),
+		addrs:    interfaceAddrs(),
+	})
+	return r
+}
+
+// Ready закрывается, когда имена прошли пробы и объявлены.
+func (r *Responder) Ready() <-chan struct{} { return r.ready }
+
+// Host — имя хоста, под которым сервер объявлен (или пробуется),
+// например "teletalkie-2.local", если teletalkie.local занят.
+func (r *Responder) Host() string { return r.state.Load().host }
+
+// Run пробует имена, объявляет их и отвечает на запросы, пока не
+// завершён ctx, затем рассылает прощальный пакет. Если имя занимает
+// другой сервер — и до объявления, и после, — Responder берёт следующее
+// и пробует заново. Ошибка — только если не удалось открыть сокет.
+func (r *Responder) Run(ctx context.Context) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return fmt.Errorf("mdns: %w", err)
+	}
+	enableLoopback(conn)
+	var wg sync.WaitGroup
+	wg.Go(func() { r.serve(conn) })
+	defer func() {
+		conn.Close()
+		wg.Wait()
+	}()
+
+	for {
+		if !r.probe(ctx, conn) {
+			return nil
+		}
+		r.log.Info("advertising via mDNS", "event", "mdns_started", "host", r.Host(), "service", Service)
+		select {
+		case <-r.ready:
+		default:
+			close(r.ready)
+		}
+		if !r.advertise(ctx, conn) {
+			r.announce(conn, 0, 0)
+			return nil
+		}
+		r.rename()
+		r.log.Warn("mDNS name taken by another device, trying the next one", "event", "mdns_conflict", "host", r.Host())
+	}
+}
+
+// probe проверяет, свободны ли имена (RFC 6762 §8.1), и при конфликте
+// перебирает следующие. false — завершён ctx.
+func (r *Responder) probe(ctx context.Context, conn *net.UDPConn) bool {
+	r.probing.Store(true)
+	for conflicts := 0; ; {
+		select {
+		case <-r.conflict:
+		default:
+		}
+		// Случайная задержка перед первой пробой — чтобы серверы,
+		// включённые одновременно, не пробовали в такт.
+		wait := rand.N(probeInterval)
+		if conflicts >= maxQuickConflicts {
+			wait = conflictBackoff
+		}
+		t := time.NewTimer(wait)
+		sent, lost := 0, false
+		for !lost && sent <= probeCount {
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return false
+			case <-r.conflict:
+				lost = true
+			case <-t.C:
+				if sent == probeCount {
+					r.probing.Store(false)
+					return true
+				}
+				r.send(conn, r.probeMessage(), group)
+				sent++
+				t.Reset(probeInterval)
+			}
+		}
+		t.Stop()
+		conflicts++
+		r.rename()
+		r.log.Info("mDNS name is taken, probing the next one", "event", "mdns_conflict", "host", r.Host())
+	}
+}
+
+// advertise объявляет имена и поддерживает объявление в актуальном
+// состоянии. false — завершён ctx, true — имя занял кто-то другой.
+func (r *Responder) advertise(ctx context.Context, conn *net.UDPConn) bool {
+	r.announce(conn, hostTTL, serviceTTL)
+	second := time.NewTimer(time.Second) // §8.3: не меньше двух объявлений
+	defer second.Stop()
+	tick := time.NewTicker(refreshInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-r.conflict:
+			r.announce(conn, 0, 0)
+			return true
+		case <-second.C:
+			r.announce(conn, hostTTL, serviceTTL)
+		case <-tick.C:
+			if r.refresh() {
+				r.announce(conn, hostTTL, serviceTTL)
+			}
+		}
+	}
+}
+
+// rename переходит к следующим именам: teletalkie-2.local и
+// "TeleTalkie on nas (2)", затем -3 и (3) и так далее.
+func (r *Responder) rename() {
+	r.renames++
+	cur := *r.state.Load()
+	cur.host, cur.instance = r.hostName(), r.instanceLabel()
+	r.state.Store(&cur)
+}
+
+func (r *Responder) hostName() string {
+	if r.renames == 0 {
+		return r.baseHost + ".local"
+	}
+	return r.baseHost + "-" + strconv.Itoa(r.renames+1) + ".local"
+}
+
+func (r *Responder) instanceLabel() string {
+	name := r.baseInstance
+	suffix := ""
+	if r.renames > 0 {
+		suffix = " (" + strconv.Itoa(r.renames+1) + ")"
+	}
+	if len(name)+len(suffix) > 63 {
+		name = name[:63-len(suffix)]
+	}
+	return name + suffix
+}
+
+// refresh перечитывает TXT и адреса и сообщает, изменились ли они.
+func (r *Responder) refresh() bool {
+	cur := r.state.Load()
+	next := &state{host: cur.host, instance: cur.instance, txt: r.txt(), addrs: interfaceAddrs()}
+	if slices.Equal(cur.txt, next.txt) && slices.EqualFunc(cur.addrs, next.addrs, net.IP.Equal) {
+		return false
+	}
+	r.state.Store(next)
+	return true
+}
+
+func (r *Responder) serve(conn *net.UDPConn) {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		m, err := parse(buf[:n])
+		if err != nil {
+			continue
+		}
+		if r.conflicts(m) {
+			select {
+			case r.conflict <- struct{}{}:
+			default:
+			}
+			continue
+		}
+		if m.isResponse() || r.probing.Load() {
+			continue
+		}
+		resp := r.answer(m, src.Port != group.Port)
+		if resp == nil {
+			continue
+		}
+		dst := group
+		if src.Port != group.Port {
+			dst = src
+		}
+		r.send(conn, resp, dst)
+	}
+}
+
+// conflicts сообщает, претендует ли кто-то другой на наши имена: в ответе
+// есть A нашего хоста с чужим адресом или SRV нашего экземпляра с другим
+// портом или хостом (§9), либо, пока мы пробуем, чужая проба тех же имён
+// выигрывает сравнение записей (§8.2). Свои пакеты, вернувшиеся по
+// multicast loopback, конфликтом не считаются — записи в них те же.
+func (r *Responder) conflicts(m *message) bool {
+	s := r.state.Load()
+	if m.isResponse() {
+		for _, rr := range slices.Concat(m.answers, m.additional) {
+			switch {
+			case rr.ttl == 0:
+			case rr.rtype == typeA && strings.EqualFold(rr.name, s.host):
+				if !slices.ContainsFunc(s.addrs, rr.ip.Equal) {
+					return true
+				}
+			case rr.rtype == typeSRV && strings.EqualFold(rr.name, s.instanceName()):
+				if rr.port != r.port || !strings.EqualFold(rr.target, s.host) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if !r.probing.Load() || len(m.authority) == 0 {
+		return false
+	}
+	ours := r.probeMessage().authority
+	for _, name := range []string{s.host, s.instanceName()} {
+		theirs := recordsNamed(m.authority, name)
+		if len(theirs) > 0 && compareRecords(recordsNamed(ours, name), theirs) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func recordsNamed(rrs []record, name string) []record {
+	var out []record
+	for _, rr := range rrs {
+		if strings.EqualFold(rr.name, name) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// compareRecords — одновременные пробы (§8.2): записи каждой стороны
+// сортируются и сравниваются по классу, типу и rdata; у кого
+// лексикографически больше, тот и занимает имя.
+func compareRecords(a, b []record) int {
+	keys := func(rrs []record) [][]byte {
+		out := make([][]byte, 0, len(rrs))
+		for _, rr := range rrs {
+			k := binary.BigEndian.AppendUint16(nil, rr.class&^cacheFlush)
+			k = binary.BigEndian.AppendUint16(k, rr.rtype)
+			if k, err := appendRData(k, rr); err == nil {
+				out = append(out, k)
+			}
+		}
+		slices.SortFunc(out, bytes.Compare)
+		return out
+	}
+	ka, kb := keys(a), keys(b)
+	for i := range min(len(ka), len(kb)) {
+		if c := bytes.Compare(ka[i], kb[i]); c != 0 {
+			return c
+		}
+	}
+	return len(ka) - len(kb)
+}
+
+// probeMessage — проба: вопросы ANY о наших именах с просьбой ответить
+// unicast'ом и записи, на которые мы претендуем, в authority.
+func (r *Responder) probeMessage() *message {
+	s := r.state.Load()
+	m := &message{questions: []question{
+		{name: s.host, qtype: typeANY, qclass: classIN | cacheFlush},
+		{name: s.instanceName(), qtype: typeANY, qclass: classIN | cacheFlush},
+	}}
+	m.authority = append(r.aRecords(s, hostTTL), r.srv(s, hostTTL), r.txtRecord(s, serviceTTL))
+	return m
+}
+
+func (r *Responder) announce(conn *net.UDPConn, hostTTL, serviceTTL uint32) {
+	s := r.state.Load()
+	m := &message{flags: flagResponse}
+	m.answers = append(m.answers,
+		r.servicesPTR(serviceTTL),
+		r.ptr(s, serviceTTL),
+		r.srv(s, hostTTL),
+		r.txtRecord(s, serviceTTL),
+	)
+	m.answers = append(m.answers, r.aRecords(s, hostTTL)...)
+	r.send(conn, m, group)
+}
+
+func (r *Responder) send(conn *net.UDPConn, m *message, dst *net.UDPAddr) {
+	b, err := m.pack()
+	if err == nil {
+		_, err = conn.WriteToUDP(b, dst)
+	}
+	if err != nil {
+		r.log.Debug("mDNS send failed", "event", "mdns_send_failed", "err", err)
+	}
+}
+
+// answer строит ответ на запрос q или nil, если спрашивали не о нас.
+// legacy — запрос пришёл не с порта 5353 (RFC 6762 §6.7): ответ уходит
+// unicast'ом, повторяет ID и вопросы, а TTL ограничен.
+func (r *Responder) answer(q *message, legacy bool) *message {
+	s := r.state.Load()
+	m := &message{flags: flagResponse}
+	have := make(map[string]bool)
+	add := func(list *[]record, rrs ...record) {
+		for _, rr := range rrs {
+			key := fmt.Sprint(strings.ToLower(rr.name), rr.rtype)
+			if have[key] && rr.rtype != typeA {
+				continue
+			}
+			have[key] = true
+			*list = append(*list, rr)
+		}
+	}
+	host := func(list *[]record) {
+		if !have[fmt.Sprint(strings.ToLower(s.host), typeA)] {
+			add(list, r.aRecords(s, hostTTL)...)
+		}
+	}
+
+	for _, qq := range q.questions {
+		is := func(t uint16) bool { return qq.qtype == t || qq.qtype == typeANY }
+		switch name := strings.TrimSuffix(qq.name, "."); {
+		case strings.EqualFold(name, servicesName) && is(typePTR):
+			add(&m.answers, r.servicesPTR(serviceTTL))
+		case strings.EqualFold(name, serviceName) && is(typePTR):
+			add(&m.answers, r.ptr(s, serviceTTL))
+		case strings.EqualFold(name, s.instanceName()):
+			if is(typeSRV) {
+				add(&m.answers, r.srv(s, hostTTL))
+			}
+			if is(typeTXT) {
+				add(&m.answers, r.txtRecord(s, serviceTTL))
+			}
+		case strings.EqualFold(name, s.host) && is(typeA):
+			host(&m.answers)
+		}
+	}
+	if len(m.answers) == 0 {
+		return nil
+	}
+	// Дополнительные записи избавляют клиента от второго запроса.
+	if have[fmt.Sprint(strings.ToLower(serviceName), typePTR)] {
+		add(&m.additional, r.srv(s, hostTTL), r.txtRecord(s, serviceTTL))
+	}
+	if have[fmt.Sprint(strings.ToLower(s.instanceName()), typeSRV)] {
+		host(&m.additional)
+	}
+
+	if legacy {
+		m.id = q.id
+		m.questions = q.questions
+		for _, list := range [][]record{m.answers, m.additional} {
+			for i := range list {
+				list[i].class &^= cacheFlush
+				list[i].ttl = min(list[i].ttl, legacyTTL)
+			}
+		}
+	}
+	return m
+}
+
+func (r *Responder) servicesPTR(ttl uint32) record {
+	return record{name: servicesName, rtype: typePTR, class: classIN, ttl: ttl, target: serviceName}
+}
+
+func (r *Responder) ptr(s *state, ttl uint32) record {
+	return record{name: serviceName, rtype: typePTR, class: classIN, ttl: ttl, target: s.instanceName()}
+}
+
+func (r *Responder) srv(s *state, ttl uint32) record {
+	return record{name: s.instanceName(), rtype: typeSRV, class: classIN | cacheFlush, ttl: ttl, target: s.host, port: r.port}
+}
+
+func (r *Responder) txtRecord(s *state, ttl uint32) record {
+	return record{name: s.instanceName(), rtype: typeTXT, class: classIN | cacheFlush, ttl: ttl, txt: s.txt}
+}
+
+func (r *Responder) aRecords(s *state, ttl uint32) []record {
+	rrs := make([]record, 0, len(s.addrs))
+	for _, ip := range s.addrs {
+		rrs = append(rrs, record{name: s.host, rtype: typeA, class: classIN | cacheFlush, ttl: ttl, ip: ip})
+	}
+	return rrs
+}
+
+// interfaceAddrs — IPv4-адреса интерфейсов, кроме loopback.
+func interfaceAddrs() []net.IP {
+	var ips []net.IP
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+				ips = append(ips, ipNet.IP.To4())
+			}
+		}
+	}
+	return ips
+}
@@ -0,0 +1,197 @@
+package mdns
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testResponder() *Responder {
+	r := New(8443, WithInstance("TeleTalkie on nas.lan"), WithTXT(func() []string {
+		return []string{"v=1", "rooms=ops,lobby"}
+	}))
+	s := *r.state.Load()
+	s.addrs = []net.IP{net.IPv4(192, 168, 1, 10).To4()}
+	r.state.Store(&s)
+	return r
+}
+
+// roundTrip пропускает сообщение через pack и parse, как по сети.
+func roundTrip(t *testing.T, m *message) *message {
+	t.Helper()
+	b, err := m.pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestBrowseAnswer(t *testing.T) {
+	r := testResponder()
+	q := roundTrip(t, &message{id: 42, questions: []question{{name: Service + ".local", qtype: typePTR, qclass: classIN}}})
+
+	resp := r.answer(q, true)
+	if resp == nil {
+		t.Fatal("no answer")
+	}
+	got := roundTrip(t, resp)
+	if got.id != 42 || len(got.questions) != 1 {
+		t.Errorf("legacy answer must echo ID and question: id %d, %d questions", got.id, len(got.questions))
+	}
+	for _, rr := range append(got.answers, got.additional...) {
+		if rr.ttl > legacyTTL || rr.class&cacheFlush != 0 {
+			t.Errorf("%s type %d: ttl %d, class %#x in legacy answer", rr.name, rr.rtype, rr.ttl, rr.class)
+		}
+	}
+
+	es := entries([]*message{got})
+	if len(es) != 1 {
+		t.Fatalf("got %d entries, want 1", len(es))
+	}
+	e := es[0]
+	if e.Instance != "TeleTalkie on nas-lan" || e.Host != DefaultHost || e.Port != 8443 {
+		t.Errorf("got %q at %s:%d", e.Instance, e.Host, e.Port)
+	}
+	if len(e.Addrs) != 1 || !e.Addrs[0].Equal(net.IPv4(192, 168, 1, 10)) {
+		t.Errorf("addrs = %v", e.Addrs)
+	}
+	if e.Get("rooms") != "ops,lobby" || e.Get("missing") != "" {
+		t.Errorf("TXT = %q", e.TXT)
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	r := testResponder()
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+		want  []uint16 // типы записей в answers
+	}{
+		{"teletalkie.local", typeA, []uint16{typeA}},
+		{"TeleTalkie.Local.", typeANY, []uint16{typeA}},
+		{"TeleTalkie on nas-lan._teletalkie._tcp.local", typeANY, []uint16{typeSRV, typeTXT}},
+		{"TeleTalkie on nas-lan._teletalkie._tcp.local", typeTXT, []uint16{typeTXT}},
+		{servicesName, typePTR, []uint16{typePTR}},
+		{"other.local", typeA, nil},
+		{"teletalkie.local", typeSRV, nil},
+	} {
+		resp := r.answer(&message{questions: []question{{name: tc.name, qtype: tc.qtype, qclass: classIN}}}, false)
+		var types []uint16
+		if resp != nil {
+			for _, rr := range resp.answers {
+				types = append(types, rr.rtype)
+			}
+		}
+		if !slices.Equal(types, tc.want) {
+			t.Errorf("%s type %d: got %v, want %v", tc.name, tc.qtype, types, tc.want)
+		}
+		if resp != nil && resp.id != 0 {
+			t.Errorf("%s: multicast answer has ID %d", tc.name, resp.id)
+		}
+	}
+}
+
+func TestReadName_Compression(t *testing.T) {
+	// «local» по смещению 12, затем «teletalkie» и указатель на него.
+	b := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5, 'l', 'o', 'c', 'a', 'l', 0,
+		10, 't', 'e', 'l', 'e', 't', 'a', 'l', 'k', 'i', 'e', 0xC0, 12}
+	name, next, err := readName(b, 19)
+	if err != nil || name != "teletalkie.local" || next != len(b) {
+		t.Fatalf("got %q, %d, %v", name, next, err)
+	}
+
+	loop := append(b[:12:12], 0xC0, 12)
+	if _, _, err := readName(loop, 12); err == nil {
+		t.Error("pointer loop must fail")
+	}
+}
+
+func TestEntries_SkipsGoodbye(t *testing.T) {
+	r := testResponder()
+	s := r.state.Load()
+	m := roundTrip(t, &message{flags: flagResponse, answers: []record{r.ptr(s, 0), r.srv(s, 0)}})
+	if es := entries([]*message{m}); len(es) != 0 {
+		t.Errorf("got %v, want none", es)
+	}
+}
+
+func TestRename(t *testing.T) {
+	r := New(8443, WithInstance("TeleTalkie on nas"))
+	if r.Host() != DefaultHost {
+		t.Fatalf("host = %q, want %q", r.Host(), DefaultHost)
+	}
+	r.rename()
+	r.rename()
+	if s := r.state.Load(); s.host != "teletalkie-3.local" || s.instance != "TeleTalkie on nas (3)" {
+		t.Errorf("after two renames: %q, %q", s.host, s.instance)
+	}
+
+	long := New(8443, WithInstance(strings.Repeat("x", 70)))
+	long.rename()
+	if s := long.state.Load(); len(s.instance) != 63 || !strings.HasSuffix(s.instance, " (2)") {
+		t.Errorf("instance = %q", s.instance)
+	}
+}
+
+func TestConflicts_Response(t *testing.T) {
+	r := testResponder()
+	r.probing.Store(false)
+	s := r.state.Load()
+	ours := r.aRecords(s, hostTTL)[0]
+	foreign := ours
+	foreign.ip = net.IPv4(192, 168, 1, 20).To4()
+	goodbye := foreign
+	goodbye.ttl = 0
+	otherPort := r.srv(s, hostTTL)
+	otherPort.port = 9443
+
+	for _, tc := range []struct {
+		name string
+		rr   record
+		want bool
+	}{
+		{"own A", ours, false},
+		{"own SRV", r.srv(s, hostTTL), false},
+		{"foreign A", foreign, true},
+		{"goodbye", goodbye, false},
+		{"SRV with another port", otherPort, true},
+	} {
+		m := roundTrip(t, &message{flags: flagResponse, answers: []record{tc.rr}})
+		if got := r.conflicts(m); got != tc.want {
+			t.Errorf("%s: conflicts = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConflicts_SimultaneousProbe(t *testing.T) {
+	r := testResponder()
+	probe := func(ip net.IP) *message {
+		m := r.probeMessage()
+		for i := range m.authority {
+			if m.authority[i].rtype == typeA {
+				m.authority[i].ip = ip
+			}
+		}
+		return roundTrip(t, m)
+	}
+
+	if r.conflicts(roundTrip(t, r.probeMessage())) {
+		t.Error("own probe looped back must not conflict")
+	}
+	if !r.conflicts(probe(net.IPv4(192, 168, 1, 20).To4())) {
+		t.Error("probe with a greater address must win")
+	}
+	if r.conflicts(probe(net.IPv4(192, 168, 1, 5).To4())) {
+		t.Error("probe with a lesser address must lose")
+	}
+
+	r.probing.Store(false)
+	if r.conflicts(probe(net.IPv4(192, 168, 1, 20).To4())) {
+		t.Error("probes after the name is claimed are answered, not conflicts")
+	}
+}
@@ -0,0 +1,131 @@
+// Package media разбирает поток чанков MediaRecorder и находит в нём
+// границы, важные для relay: конец init-сегмента и начала фрагментов,
+// которые открываются ключевым кадром.
+//
+// Поддерживаются WebM (EBML header + Tracks, кластеры) и фрагментированный
+// MP4 (ftyp + moov, moof + mdat). Чанки могут резаться MediaRecorder'ом
+// где угодно, поэтому разбор потоковый: состояние переживает границы чанков.
+package media
+
+// Format — формат контейнера.
+type Format int
+
+const (
+	FormatUnknown Format = iota
+	FormatWebM
+	FormatMP4
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatWebM:
+		return "webm"
+	case FormatMP4:
+		return "mp4"
+	default:
+		return "unknown"
+	}
+}
+
+// MarkKind — тип отметки в потоке.
+type MarkKind int
+
+const (
+	// MarkInitEnd — init-сегмент закончился, с Pos начинаются медиа-данные.
+	MarkInitEnd MarkKind = iota + 1
+	// MarkKeyframe — с Pos начинается фрагмент (кластер WebM / moof MP4),
+	// первый видеокадр которого ключевой. С него декодер может стартовать.
+	MarkKeyframe
+)
+
+// Mark — отметка в потоке. Pos — смещение в байтах от начала передачи.
+type Mark struct {
+	Kind MarkKind
+	Pos  int64
+}
+
+// sniffLen — сколько байт нужно, чтобы определить формат.
+const sniffLen = 8
+
+// parser — потоковый разборщик конкретного контейнера.
+type parser interface {
+	feed(data []byte, emit func(Mark))
+}
+
+// Scanner последовательно разбирает одну передачу (от первого чанка
+// MediaRecorder'а до PTT_OFF). Для новой передачи нужен новый Scanner.
+type Scanner struct {
+	pos    int64
+	sniff  []byte
+	format Format
+	parser parser
+	failed bool // формат не распознан — отметок не будет
+}
+
+// NewScanner создаёт Scanner для новой передачи.
+func NewScanner() *Scanner {
+	return &Scanner{}
+}
+
+// Format возвращает формат потока (FormatUnknown, пока он не определён).
+func (s *Scanner) Format() Format {
+	return s.format
+}
+
+// Pos возвращает количество уже разобранных байт потока.
+func (s *Scanner) Pos() int64 {
+	return s.pos
+}
+
+// Feed разбирает очередной чанк и возвращает найденные в нём отметки.
+// Отметка может указывать на позицию в одном из предыдущих чанков: например,
+// является ли кластер WebM ключевым, становится ясно только по первому
+// видеоблоку, который может прийти следующим чанком.
+func (s *Scanner) Feed(chunk []byte) []Mark {
+	var marks []Mark
+	emit := func(m Mark) { marks = append(marks, m) }
+
+	s.pos += int64(len(chunk))
+
+	if s.failed {
+		return nil
+	}
+	if s.parser != nil {
+		s.parser.feed(chunk, emit)
+		return marks
+	}
+
+	// Формат ещё не известен — копим первые байты.
+	s.sniff = append(s.sniff, chunk...)
+	if len(s.sniff) < sniffLen {
+		return nil
+	}
+
+	s.format = Detect(s.sniff)
+	switch s.format {
+	case FormatWebM:
+		s.parser = newWebMParser()
+	case FormatMP4:
+		s.parser = newMP4Parser()
+	default:
+		s.failed = true
+		s.sniff = nil
+		return nil
+	}
+
+	data := s.sniff
+	s.sniff = nil
+	s.parser.feed(data, emit)
+	return marks
+}
+
+// Detect определяет формат по первым байтам потока.
+func Detect(b []byte) Format {
+	if len(b) >= 4 && b[0] == 0x1A && b[1] == 0x45 && b[2] == 0xDF && b[3] == 0xA3 {
+		return FormatWebM
+	}
+	if len(b) >= 8 && string(b[4:8]) == "ftyp" {
+		return FormatMP4
+	}
+	return FormatUnknown
+}
@@ -0,0 +1,91 @@
+package media
+
+import (
+	"slices"
+	"testing"
+
+	"teletalkie/internal/media/mediatest"
+)
+
+// feedAll скармливает поток Scanner'у кусками по step байт.
+func feedAll(stream []byte, step int) (*Scanner, []Mark) {
+	s := NewScanner()
+	var marks []Mark
+	for len(stream) > 0 {
+		n := min(step, len(stream))
+		marks = append(marks, s.Feed(stream[:n])...)
+		stream = stream[n:]
+	}
+	return s, marks
+}
+
+func TestDetect(t *testing.T) {
+	if got := Detect(mediatest.WebMInit()); got != FormatWebM {
+		t.Fatalf("webm: got %v", got)
+	}
+	if got := Detect(mediatest.MP4Init()); got != FormatMP4 {
+		t.Fatalf("mp4: got %v", got)
+	}
+	if got := Detect([]byte("garbage!")); got != FormatUnknown {
+		t.Fatalf("garbage: got %v", got)
+	}
+}
+
+func TestScanner_WebM(t *testing.T) {
+	init := mediatest.WebMInit()
+	c1 := mediatest.WebMCluster(true, 0x11)
+	c2 := mediatest.WebMCluster(false, 0x22)
+	c3 := mediatest.WebMCluster(true, 0x33)
+	stream := slices.Concat(init, c1, c2, c3)
+
+	want := []Mark{
+		{Kind: MarkInitEnd, Pos: int64(len(init))},
+		{Kind: MarkKeyframe, Pos: int64(len(init))},
+		{Kind: MarkKeyframe, Pos: int64(len(init) + len(c1) + len(c2))},
+	}
+
+	// Границы чанков не должны влиять на результат.
+	for _, step := range []int{len(stream), 1000, 7, 1} {
+		s, marks := feedAll(stream, step)
+		if s.Format() != FormatWebM {
+			t.Fatalf("step %d: format %v", step, s.Format())
+		}
+		if !slices.Equal(marks, want) {
+			t.Fatalf("step %d: marks %v, want %v", step, marks, want)
+		}
+	}
+}
+
+func TestScanner_MP4(t *testing.T) {
+	init := mediatest.MP4Init()
+	f1 := mediatest.MP4Fragment(true, 0x11)
+	f2 := mediatest.MP4Fragment(false, 0x22)
+	f3 := mediatest.MP4Fragment(true, 0x33)
+	stream := slices.Concat(init, f1, f2, f3)
+
+	want := []Mark{
+		{Kind: MarkInitEnd, Pos: int64(len(init))},
+		{Kind: MarkKeyframe, Pos: int64(len(init))},
+		{Kind: MarkKeyframe, Pos: int64(len(init) + len(f1) + len(f2))},
+	}
+
+	for _, step := range []int{len(stream), 100, 3, 1} {
+		s, marks := feedAll(stream, step)
+		if s.Format() != FormatMP4 {
+			t.Fatalf("step %d: format %v", step, s.Format())
+		}
+		if !slices.Equal(marks, want) {
+			t.Fatalf("step %d: marks %v, want %v", step, marks, want)
+		}
+	}
+}
+
+func TestScanner_Unknown(t *testing.T) {
+	s, marks := feedAll([]byte("definitely not a media container"), 4)
+	if s.Format() != FormatUnknown || len(marks) != 0 {
+		t.Fatalf("format %v, marks %v", s.Format(), marks)
+	}
+	if s.Pos() != 32 {
+		t.Fatalf("pos %d, want 32", s.Pos())
+	}
+}
@@ -0,0 +1,142 @@
+// Package mediatest собирает минимальные WebM и fMP4 потоки для тестов:
+// ровно те элементы, по которым media.Scanner ищет границы.
+package mediatest
+
+import "encoding/binary"
+
+// Номера дорожек в WebM-потоке.
+const (
+	VideoTrack = 1
+	AudioTrack = 2
+)
+
+// Element кодирует EBML-элемент известного размера.
+func Element(id uint32, data ...[]byte) []byte {
+	var payload []byte
+	for _, d := range data {
+		payload = append(payload, d...)
+	}
+	out := ebmlID(id)
+	out = append(out, 0x01) // size: 8-байтовый vint
+	var size [7]byte
+	n := uint64(len(payload))
+	for i := 6; i >= 0; i-- {
+		size[i] = byte(n)
+		n >>= 8
+	}
+	out = append(out, size[:]...)
+	return append(out, payload...)
+}
+
+// unknownSized кодирует заголовок элемента с неизвестным размером (live-запись).
+func unknownSized(id uint32) []byte {
+	return append(ebmlID(id), 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+}
+
+func ebmlID(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+// WebMInit возвращает EBML header, начало Segment неизвестного размера и
+// Tracks с видео- и аудиодорожкой — то, с чего начинается запись MediaRecorder.
+func WebMInit() []byte {
+	track := func(number, typ byte) []byte {
+		return Element(0xAE,
+			Element(0xD7, []byte{number}),
+			Element(0x83, []byte{typ}),
+		)
+	}
+	out := Element(0x1A45DFA3, Element(0x4282, []byte("webm")))
+	out = append(out, unknownSized(0x18538067)...)
+	out = append(out, Element(0x1549A966, Element(0x2AD7B1, []byte{0x0F, 0x42, 0x40}))...)
+	out = append(out, Element(0x1654AE6B, track(VideoTrack, 1), track(AudioTrack, 2))...)
+	return out
+}
+
+// WebMCluster возвращает кластер неизвестного размера: аудиоблок, затем
+// видеоблок, ключевой если key. Payload блоков заполнен fill.
+func WebMCluster(key bool, fill byte) []byte {
+	block := func(track byte, flags byte) []byte {
+		data := []byte{0x80 | track, 0x00, 0x00, flags}
+		for i := 0; i < 32; i++ {
+			data = append(data, fill)
+		}
+		return Element(0xA3, data)
+	}
+	var videoFlags byte
+	if key {
+		videoFlags = 0x80
+	}
+	out := unknownSized(0x1F43B675)
+	out = append(out, Element(0xE7, []byte{0x00})...)
+	out = append(out, block(AudioTrack, 0x80)...)
+	out = append(out, block(VideoTrack, videoFlags)...)
+	return out
+}
+
+// Box кодирует MP4 box.
+func Box(typ string, data ...[]byte) []byte {
+	var payload []byte
+	for _, d := range data {
+		payload = append(payload, d...)
+	}
+	out := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(out, uint32(8+len(payload)))
+	copy(out[4:], typ)
+	return append(out, payload...)
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+// MP4Init возвращает ftyp и moov с видеодорожкой 1 и аудиодорожкой 2.
+func MP4Init() []byte {
+	trak := func(id uint32, handler string) []byte {
+		tkhd := append(u32(0), u32(0)...) // version/flags, creation_time
+		tkhd = append(tkhd, u32(0)...)    // modification_time
+		tkhd = append(tkhd, u32(id)...)   // track_ID
+		hdlr := append(u32(0), u32(0)...) // version/flags, pre_defined
+		hdlr = append(hdlr, handler...)
+		return Box("trak", Box("tkhd", tkhd), Box("mdia", Box("hdlr", hdlr)))
+	}
+	trex := func(id uint32) []byte {
+		b := append(u32(0), u32(id)...)
+		b = append(b, u32(1)...)
+		b = append(b, u32(0)...)
+		b = append(b, u32(0)...)
+		return Box("trex", append(b, u32(0x00010000)...)) // по умолчанию non-sync
+	}
+	out := Box("ftyp", []byte("isom"), u32(0x200))
+	return append(out, Box("moov", trak(1, "vide"), trak(2, "soun"), Box("mvex", trex(1), trex(2)))...)
+}
+
+// MP4Fragment возвращает moof + mdat; первый видеосэмпл — sync если key.
+func MP4Fragment(key bool, fill byte) []byte {
+	first := uint32(0x00010000)
+	if key {
+		first = 0x02000000
+	}
+	traf := func(id uint32, trun []byte) []byte {
+		return Box("traf", Box("tfhd", u32(0), u32(id)), Box("trun", trun))
+	}
+	videoTrun := append(u32(0x04), u32(1)...) // first-sample-flags-present
+	videoTrun = append(videoTrun, u32(first)...)
+	audioTrun := append(u32(0), u32(1)...)
+
+	mdat := make([]byte, 64)
+	for i := range mdat {
+		mdat[i] = fill
+	}
+	out := Box("moof", Box("mfhd", u32(0), u32(1)), traf(2, audioTrun), traf(1, videoTrun))
+	return append(out, Box("mdat", mdat)...)
+}
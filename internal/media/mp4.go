@@ -0,0 +1,330 @@
+package media
+
+import "encoding/binary"
+
+const (
+	// maxMoovSize / maxMoofSize — предел буферизации служебных box'ов.
+	maxMoovSize = 1 << 20
+	maxMoofSize = 1 << 20
+
+	// sampleNonSync — бит sample_is_non_sync_sample в sample_flags.
+	sampleNonSync = 0x00010000
+)
+
+// mp4Parser — потоковый разбор фрагментированного MP4 на верхнем уровне:
+// moov и moof буферизуются целиком (они маленькие), mdat пропускается.
+type mp4Parser struct {
+	pos int64
+
+	hdr      []byte
+	hdrStart int64
+
+	skip int64
+
+	collecting bool
+	buf        []byte
+	need       int
+	bufType    string
+	bufStart   int64
+
+	initDone   bool
+	videoTrack uint32            // 0 — видеодорожка не найдена
+	defaults   map[uint32]uint32 // trex default_sample_flags по track_ID
+
+	broken bool
+}
+
+func newMP4Parser() *mp4Parser {
+	return &mp4Parser{defaults: make(map[uint32]uint32)}
+}
+
+func (p *mp4Parser) feed(data []byte, emit func(Mark)) {
+	for len(data) > 0 && !p.broken {
+		switch {
+		case p.skip > 0:
+			n := int64(len(data))
+			if p.skip < n {
+				n = p.skip
+			}
+			p.skip -= n
+			p.pos += n
+			data = data[n:]
+
+		case p.collecting:
+			n := p.need - len(p.buf)
+			if n > len(data) {
+				n = len(data)
+			}
+			p.buf = append(p.buf, data[:n]...)
+			p.pos += int64(n)
+			data = data[n:]
+			if len(p.buf) == p.need {
+				p.collecting = false
+				p.collected(emit)
+			}
+
+		default:
+			if len(p.hdr) == 0 {
+				p.hdrStart = p.pos
+			}
+			p.hdr = append(p.hdr, data[0])
+			p.pos++
+			data = data[1:]
+
+			if typ, size, ok := p.header(); ok {
+				p.hdr = p.hdr[:0]
+				p.box(typ, size, emit)
+			}
+		}
+	}
+}
+
+// header разбирает заголовок box'а. size — размер payload, -1 — до конца потока.
+func (p *mp4Parser) header() (typ string, size int64, ok bool) {
+	if len(p.hdr) < 8 {
+		return "", 0, false
+	}
+	size32 := binary.BigEndian.Uint32(p.hdr)
+	typ = string(p.hdr[4:8])
+
+	switch size32 {
+	case 0:
+		return typ, -1, true
+	case 1:
+		if len(p.hdr) < 16 {
+			return "", 0, false
+		}
+		large := binary.BigEndian.Uint64(p.hdr[8:])
+		if large < 16 {
+			p.broken = true
+			return "", 0, false
+		}
+		return typ, int64(large - 16), true
+	default:
+		if size32 < 8 {
+			p.broken = true
+			return "", 0, false
+		}
+		return typ, int64(size32 - 8), true
+	}
+}
+
+func (p *mp4Parser) box(typ string, size int64, emit func(Mark)) {
+	if typ == "moof" && !p.initDone {
+		p.initDone = true
+		emit(Mark{Kind: MarkInitEnd, Pos: p.hdrStart})
+	}
+
+	if size < 0 {
+		// Box до конца потока — дальше разбирать нечего.
+		p.broken = true
+		return
+	}
+
+	switch {
+	case typ == "moov" && size <= maxMoovSize, typ == "moof" && size <= maxMoofSize:
+		if size == 0 {
+			return
+		}
+		p.collecting = true
+		p.buf = p.buf[:0]
+		p.need = int(size)
+		p.bufType = typ
+		p.bufStart = p.hdrStart
+	default:
+		p.skip = size
+	}
+}
+
+func (p *mp4Parser) collected(emit func(Mark)) {
+	switch p.bufType {
+	case "moov":
+		p.parseMoov(p.buf)
+	case "moof":
+		if p.moofKey(p.buf) {
+			emit(Mark{Kind: MarkKeyframe, Pos: p.bufStart})
+		}
+	}
+}
+
+func (p *mp4Parser) parseMoov(b []byte) {
+	for len(b) > 0 {
+		typ, data, rest, ok := mp4Box(b)
+		if !ok {
+			return
+		}
+		b = rest
+		switch typ {
+		case "trak":
+			if id, video := mp4Trak(data); video && p.videoTrack == 0 {
+				p.videoTrack = id
+			}
+		case "mvex":
+			for len(data) > 0 {
+				ctyp, cdata, crest, ok := mp4Box(data)
+				if !ok {
+					break
+				}
+				data = crest
+				// trex: version/flags, track_ID, sample_description_index,
+				// default_sample_duration, default_sample_size, default_sample_flags.
+				if ctyp == "trex" && len(cdata) >= 24 {
+					id := binary.BigEndian.Uint32(cdata[4:])
+					p.defaults[id] = binary.BigEndian.Uint32(cdata[20:])
+				}
+			}
+		}
+	}
+}
+
+// mp4Trak возвращает track_ID дорожки и является ли она видео.
+func mp4Trak(b []byte) (id uint32, video bool) {
+	for len(b) > 0 {
+		typ, data, rest, ok := mp4Box(b)
+		if !ok {
+			break
+		}
+		b = rest
+		switch typ {
+		case "tkhd":
+			// version 1 — 64-битные creation/modification time.
+			if len(data) >= 4 && data[0] == 1 && len(data) >= 24 {
+				id = binary.BigEndian.Uint32(data[20:])
+			} else if len(data) >= 16 {
+				id = binary.BigEndian.Uint32(data[12:])
+			}
+		case "mdia":
+			for len(data) > 0 {
+				ctyp, cdata, crest, ok := mp4Box(data)
+				if !ok {
+					break
+				}
+				data = crest
+				if ctyp == "hdlr" && len(cdata) >= 12 && string(cdata[8:12]) == "vide" {
+					video = true
+				}
+			}
+		}
+	}
+	return id, video
+}
+
+// moofKey сообщает, начинается ли фрагмент с sync-sample видеодорожки.
+// Если флагов в потоке нет совсем — считаем фрагмент ключевым.
+func (p *mp4Parser) moofKey(b []byte) bool {
+	for len(b) > 0 {
+		typ, data, rest, ok := mp4Box(b)
+		if !ok {
+			return false
+		}
+		b = rest
+		if typ != "traf" {
+			continue
+		}
+
+		flags, track, ok := trafFirstSampleFlags(data, p.defaults)
+		if p.videoTrack != 0 && track != p.videoTrack {
+			continue
+		}
+		if !ok {
+			return true
+		}
+		return flags&sampleNonSync == 0
+	}
+	return false
+}
+
+// trafFirstSampleFlags возвращает sample_flags первого сэмпла фрагмента дорожки.
+func trafFirstSampleFlags(b []byte, defaults map[uint32]uint32) (flags, track uint32, ok bool) {
+	var (
+		tfhdFlags   uint32
+		hasDefaults bool
+	)
+
+	for len(b) > 0 {
+		typ, data, rest, boxOK := mp4Box(b)
+		if !boxOK {
+			break
+		}
+		b = rest
+
+		switch typ {
+		case "tfhd":
+			if len(data) < 8 {
+				continue
+			}
+			tfhdFlags = binary.BigEndian.Uint32(data) & 0xFFFFFF
+			track = binary.BigEndian.Uint32(data[4:])
+			if f, found := defaults[track]; found {
+				flags, hasDefaults = f, true
+			}
+			off := 8
+			for _, bit := range []struct {
+				mask uint32
+				size int
+			}{{0x01, 8}, {0x02, 4}, {0x08, 4}, {0x10, 4}} {
+				if tfhdFlags&bit.mask != 0 {
+					off += bit.size
+				}
+			}
+			if tfhdFlags&0x20 != 0 && len(data) >= off+4 {
+				flags, hasDefaults = binary.BigEndian.Uint32(data[off:]), true
+			}
+
+		case "trun":
+			if len(data) < 8 {
+				continue
+			}
+			trunFlags := binary.BigEndian.Uint32(data) & 0xFFFFFF
+			count := binary.BigEndian.Uint32(data[4:])
+			off := 8
+			if trunFlags&0x01 != 0 {
+				off += 4
+			}
+			if trunFlags&0x04 != 0 {
+				if len(data) < off+4 {
+					return 0, track, false
+				}
+				return binary.BigEndian.Uint32(data[off:]), track, true
+			}
+			if trunFlags&0x400 != 0 && count > 0 {
+				if trunFlags&0x100 != 0 {
+					off += 4
+				}
+				if trunFlags&0x200 != 0 {
+					off += 4
+				}
+				if len(data) < off+4 {
+					return 0, track, false
+				}
+				return binary.BigEndian.Uint32(data[off:]), track, true
+			}
+			return flags, track, hasDefaults
+		}
+	}
+	return flags, track, hasDefaults
+}
+
+// mp4Box читает box из буфера.
+func mp4Box(b []byte) (typ string, data, rest []byte, ok bool) {
+	if len(b) < 8 {
+		return "", nil, nil, false
+	}
+	size := uint64(binary.BigEndian.Uint32(b))
+	typ = string(b[4:8])
+	hdr := 8
+	switch size {
+	case 0:
+		size = uint64(len(b))
+	case 1:
+		if len(b) < 16 {
+			return "", nil, nil, false
+		}
+		size = binary.BigEndian.Uint64(b[8:])
+		hdr = 16
+	}
+	if size < uint64(hdr) || size > uint64(len(b)) {
+		return "", nil, nil, false
+	}
+	return typ, b[hdr:size], b[size:], true
+}
@@ -0,0 +1,320 @@
+package media
+
+// EBML ID элементов WebM (с маркером длины, как в спецификации).
+const (
+	idEBML        = 0x1A45DFA3
+	idSegment     = 0x18538067
+	idSeekHead    = 0x114D9B74
+	idInfo        = 0x1549A966
+	idTracks      = 0x1654AE6B
+	idCluster     = 0x1F43B675
+	idCues        = 0x1C53BB6B
+	idTags        = 0x1254C367
+	idChapters    = 0x1043A770
+	idAttachments = 0x1941A469
+	idSimpleBlock = 0xA3
+	idTrackEntry  = 0xAE
+	idTrackNumber = 0xD7
+	idTrackType   = 0x83
+)
+
+const (
+	trackTypeVideo = 1
+
+	// maxTracksSize — больше Tracks у MediaRecorder не бывает; крупнее не буферизуем.
+	maxTracksSize = 64 * 1024
+	// blockHeadLen — track number (до 8 байт) + timecode (2) + flags (1).
+	blockHeadLen = 11
+)
+
+// webmParser — потоковый разбор EBML. Внутрь Segment и Cluster заходит,
+// остальные элементы пропускает, буферизуя только Tracks и заголовки SimpleBlock.
+type webmParser struct {
+	pos int64 // позиция следующего байта потока
+
+	hdr      []byte // накопленные байты заголовка элемента
+	hdrStart int64
+
+	skip int64 // сколько байт осталось пропустить
+
+	collecting bool
+	buf        []byte // буфер собираемого payload
+	need       int
+	bufID      uint32
+	bufRest    int64 // сколько пропустить после сбора
+
+	initDone     bool
+	videoTrack   uint64 // 0 — видеодорожки нет или Tracks не разобран
+	inCluster    bool
+	clusterStart int64
+	clusterEnd   int64 // -1 — размер неизвестен (live-запись)
+	decided      bool  // ключевой ли текущий кластер, уже известно
+
+	broken bool // поток не похож на EBML — дальше не разбираем
+}
+
+func newWebMParser() *webmParser {
+	return &webmParser{}
+}
+
+func (p *webmParser) advance(n int64) {
+	p.pos += n
+	if p.inCluster && p.clusterEnd >= 0 && p.pos >= p.clusterEnd {
+		p.inCluster = false
+	}
+}
+
+func (p *webmParser) feed(data []byte, emit func(Mark)) {
+	for len(data) > 0 && !p.broken {
+		switch {
+		case p.skip > 0:
+			n := int64(len(data))
+			if p.skip < n {
+				n = p.skip
+			}
+			p.skip -= n
+			p.advance(n)
+			data = data[n:]
+
+		case p.collecting:
+			n := p.need - len(p.buf)
+			if n > len(data) {
+				n = len(data)
+			}
+			p.buf = append(p.buf, data[:n]...)
+			p.advance(int64(n))
+			data = data[n:]
+			if len(p.buf) == p.need {
+				p.collecting = false
+				p.collected(emit)
+				p.skip = p.bufRest
+			}
+
+		default:
+			if len(p.hdr) == 0 {
+				p.hdrStart = p.pos
+			}
+			p.hdr = append(p.hdr, data[0])
+			p.advance(1)
+			data = data[1:]
+
+			id, size, unknown, ok := p.header()
+			if ok {
+				p.hdr = p.hdr[:0]
+				p.element(id, size, unknown, emit)
+			}
+		}
+	}
+}
+
+// header пытается разобрать накопленный заголовок. ok=false — байт пока мало.
+func (p *webmParser) header() (id uint32, size int64, unknown bool, ok bool) {
+	idLen := vintLen(p.hdr[0])
+	if idLen == 0 || idLen > 4 {
+		p.broken = true
+		return 0, 0, false, false
+	}
+	if len(p.hdr) <= idLen {
+		return 0, 0, false, false
+	}
+	sizeLen := vintLen(p.hdr[idLen])
+	if sizeLen == 0 {
+		p.broken = true
+		return 0, 0, false, false
+	}
+	if len(p.hdr) < idLen+sizeLen {
+		return 0, 0, false, false
+	}
+
+	for _, b := range p.hdr[:idLen] {
+		id = id<<8 | uint32(b)
+	}
+	v, _ := vint(p.hdr[idLen:])
+	unknown = v == 1<<(7*sizeLen)-1
+	return id, int64(v), unknown, true
+}
+
+func (p *webmParser) element(id uint32, size int64, unknown bool, emit func(Mark)) {
+	if isLevel1(id) {
+		// Элемент верхнего уровня закрывает кластер неизвестного размера.
+		p.inCluster = false
+	}
+
+	switch id {
+	case idSegment:
+		// Контейнер — заходим внутрь.
+
+	case idCluster:
+		if !p.initDone {
+			p.initDone = true
+			emit(Mark{Kind: MarkInitEnd, Pos: p.hdrStart})
+		}
+		p.inCluster = true
+		p.clusterStart = p.hdrStart
+		p.decided = false
+		p.clusterEnd = -1
+		if !unknown {
+			p.clusterEnd = p.pos + size
+		}
+
+	case idTracks:
+		if !unknown && size <= maxTracksSize {
+			p.startCollect(id, int(size), 0)
+		} else if !unknown {
+			p.skip = size
+		}
+
+	case idSimpleBlock:
+		if unknown {
+			p.broken = true
+			return
+		}
+		if p.inCluster && !p.decided {
+			n := int64(blockHeadLen)
+			if size < n {
+				n = size
+			}
+			p.startCollect(id, int(n), size-n)
+		} else {
+			p.skip = size
+		}
+
+	default:
+		// Неизвестный размер у прочих элементов — считаем контейнером.
+		if !unknown {
+			p.skip = size
+		}
+	}
+}
+
+func (p *webmParser) startCollect(id uint32, n int, rest int64) {
+	if n == 0 {
+		p.bufID = id
+		p.buf = p.buf[:0]
+		p.collected(nil)
+		p.skip = rest
+		return
+	}
+	p.collecting = true
+	p.buf = p.buf[:0]
+	p.need = n
+	p.bufID = id
+	p.bufRest = rest
+}
+
+func (p *webmParser) collected(emit func(Mark)) {
+	switch p.bufID {
+	case idTracks:
+		p.videoTrack = webmVideoTrack(p.buf)
+
+	case idSimpleBlock:
+		track, n := vint(p.buf)
+		if n == 0 || len(p.buf) < n+3 {
+			return
+		}
+		if p.videoTrack != 0 && track != p.videoTrack {
+			// Аудиоблок — ключевой ли кластер, решит первый видеоблок.
+			return
+		}
+		p.decided = true
+		if p.buf[n+2]&0x80 != 0 && emit != nil {
+			emit(Mark{Kind: MarkKeyframe, Pos: p.clusterStart})
+		}
+	}
+}
+
+// webmVideoTrack ищет номер видеодорожки в payload элемента Tracks.
+func webmVideoTrack(b []byte) uint64 {
+	for len(b) > 0 {
+		id, data, rest, ok := ebmlElement(b)
+		if !ok {
+			return 0
+		}
+		b = rest
+		if id != idTrackEntry {
+			continue
+		}
+
+		var number, typ uint64
+		for len(data) > 0 {
+			cid, cdata, crest, ok := ebmlElement(data)
+			if !ok {
+				break
+			}
+			data = crest
+			switch cid {
+			case idTrackNumber:
+				number = ebmlUint(cdata)
+			case idTrackType:
+				typ = ebmlUint(cdata)
+			}
+		}
+		if typ == trackTypeVideo {
+			return number
+		}
+	}
+	return 0
+}
+
+// ebmlElement читает элемент известного размера из буфера.
+func ebmlElement(b []byte) (id uint32, data, rest []byte, ok bool) {
+	idLen := vintLen(b[0])
+	if idLen == 0 || idLen > 4 || len(b) <= idLen {
+		return 0, nil, nil, false
+	}
+	for _, c := range b[:idLen] {
+		id = id<<8 | uint32(c)
+	}
+	size, n := vint(b[idLen:])
+	if n == 0 {
+		return 0, nil, nil, false
+	}
+	start := idLen + n
+	if uint64(len(b)-start) < size {
+		return 0, nil, nil, false
+	}
+	end := start + int(size)
+	return id, b[start:end], b[end:], true
+}
+
+func ebmlUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// vintLen возвращает длину EBML varint по первому байту (0 — невалидный байт).
+func vintLen(b byte) int {
+	for i := 0; i < 8; i++ {
+		if b&(0x80>>i) != 0 {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// vint читает EBML varint без маркера длины. n=0 — байт не хватает.
+func vint(b []byte) (v uint64, n int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n = vintLen(b[0])
+	if n == 0 || len(b) < n {
+		return 0, 0
+	}
+	v = uint64(b[0] & (0xFF >> n))
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n
+}
+
+func isLevel1(id uint32) bool {
+	switch id {
+	case idSeekHead, idInfo, idTracks, idCluster, idCues, idTags, idChapters, idAttachments:
+		return true
+	}
+	return false
+}
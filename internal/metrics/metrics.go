@@ -0,0 +1,150 @@
+// Package metrics — минимальная реализация метрик в текстовом формате
+// Prometheus (exposition format 0.0.4) без внешних зависимостей:
+// счётчики и gauge'и, значения которых считаются в момент опроса.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter — монотонно растущий счётчик. Безопасен для конкурентного использования.
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc увеличивает счётчик на 1.
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add увеличивает счётчик на n.
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+// Value возвращает текущее значение.
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// metric — одно семейство метрик в выводе.
+type metric struct {
+	name, help, typ string
+	write           func(w *bufio.Writer, name string)
+}
+
+// Registry хранит зарегистрированные метрики и отдаёт их по HTTP.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// NewRegistry создаёт пустой Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// NewCounter регистрирует счётчик.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(metric{name: name, help: help, typ: "counter", write: func(w *bufio.Writer, name string) {
+		fmt.Fprintf(w, "%s %d\n", name, c.Value())
+	}})
+	return c
+}
+
+// CounterFunc регистрирует счётчик, значение которого хранится в другом
+// месте (например, в атомарном поле) и читается при каждом опросе.
+func (r *Registry) CounterFunc(name, help string, fn func() uint64) {
+	r.register(metric{name: name, help: help, typ: "counter", write: func(w *bufio.Writer, name string) {
+		fmt.Fprintf(w, "%s %d\n", name, fn())
+	}})
+}
+
+// GaugeFunc регистрирует gauge, который вычисляется при каждом опросе.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(metric{name: name, help: help, typ: "gauge", write: func(w *bufio.Writer, name string) {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(fn()))
+	}})
+}
+
+// GaugeVecFunc регистрирует gauge с одной меткой label: fn возвращает
+// значения по значению метки. Строки выводятся в порядке меток.
+func (r *Registry) GaugeVecFunc(name, help, label string, fn func() map[string]float64) {
+	r.register(metric{name: name, help: help, typ: "gauge", write: func(w *bufio.Writer, name string) {
+		values := fn()
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", name, label, escapeLabel(k), formatFloat(values[k]))
+		}
+	}})
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, old := range r.metrics {
+		if old.name == m.name {
+			panic("metrics: duplicate metric " + m.name)
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo пишет все метрики в текстовом формате Prometheus.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	list := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range list {
+		fmt.Fprintf(bw, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", m.name, m.typ)
+		m.write(bw, m.name)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP отдаёт метрики — Registry можно монтировать как /metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryExposition(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.NewCounter("test_events_total", "Events seen.")
+	c.Add(2)
+	c.Inc()
+	reg.GaugeFunc("test_temperature", "Current temperature.", func() float64 { return 21.5 })
+	reg.GaugeVecFunc("test_room_peers", "Peers per room.", "room", func() map[string]float64 {
+		return map[string]float64{"b": 1, `a"\`: 2}
+	})
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	want := `# HELP test_events_total Events seen.
+# TYPE test_events_total counter
+test_events_total 3
+# HELP test_temperature Current temperature.
+# TYPE test_temperature gauge
+test_temperature 21.5
+# HELP test_room_peers Peers per room.
+# TYPE test_room_peers gauge
+test_room_peers{room="a\"\\"} 2
+test_room_peers{room="b"} 1
+`
+	if got := rec.Body.String(); got != want {
+		t.Fatalf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRegistryDuplicatePanics(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("dup", "")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on duplicate metric")
+		}
+	}()
+	reg.NewCounter("dup", "")
+}
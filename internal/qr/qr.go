@@ -0,0 +1,517 @@
+// Package qr кодирует данные в QR-код (ISO/IEC 18004, байтовый режим)
+// без внешних зависимостей: ссылку на сервер показывают в терминале
+// или картинкой PNG, а телефон её сканирует.
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+// Level — уровень коррекции ошибок.
+type Level int
+
+const (
+	L Level = iota // ~7% повреждённых модулей
+	M              // ~15%
+	Q              // ~25%
+	H              // ~30%
+)
+
+// ErrTooLong — данные не помещаются даже в QR версии 40.
+var ErrTooLong = errors.New("qr: data too long")
+
+// Code — готовый QR-код: квадрат Size×Size модулей без поля вокруг.
+type Code struct {
+	Size    int
+	modules []bool // true — тёмный модуль
+	isFunc  []bool // служебные модули: шаблоны поиска, синхронизации, формат
+}
+
+// Black сообщает, тёмный ли модуль (x, y). За пределами кода — светлый.
+func (c *Code) Black(x, y int) bool {
+	return x >= 0 && y >= 0 && x < c.Size && y < c.Size && c.modules[y*c.Size+x]
+}
+
+// Encode кодирует data в QR-код наименьшей подходящей версии.
+func Encode(data []byte, level Level) (*Code, error) {
+	ver := 1
+	for ; ver <= 40; ver++ {
+		if 4+charCountBits(ver)+8*len(data) <= numDataCodewords(ver, level)*8 {
+			break
+		}
+	}
+	if ver > 40 {
+		return nil, ErrTooLong
+	}
+
+	// Режим «байты», длина, данные, терминатор и добивка до ёмкости.
+	var bb bitBuffer
+	bb.append(0b0100, 4)
+	bb.append(len(data), charCountBits(ver))
+	for _, b := range data {
+		bb.append(int(b), 8)
+	}
+	capacity := numDataCodewords(ver, level) * 8
+	bb.append(0, min(4, capacity-len(bb)))
+	bb.append(0, (8-len(bb)%8)%8)
+	for pad := 0xEC; len(bb) < capacity; pad ^= 0xEC ^ 0x11 {
+		bb.append(pad, 8)
+	}
+	codewords := make([]byte, len(bb)/8)
+	for i, bit := range bb {
+		if bit {
+			codewords[i>>3] |= 1 << (7 - i&7)
+		}
+	}
+
+	size := ver*4 + 17
+	c := &Code{Size: size, modules: make([]bool, size*size), isFunc: make([]bool, size*size)}
+	c.drawFunctionPatterns(ver, level)
+	c.drawCodewords(addECCAndInterleave(codewords, ver, level))
+
+	best, bestPenalty := 0, -1
+	for mask := range 8 {
+		c.applyMask(mask)
+		c.drawFormatBits(level, mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // маска — XOR, повторное наложение её снимает
+	}
+	c.applyMask(best)
+	c.drawFormatBits(level, best)
+	c.isFunc = nil
+	return c, nil
+}
+
+// String рисует код Unicode-полублоками для терминала с тёмным фоном:
+// символ — две строки модулей, светлые модули — закрашены. Вокруг —
+// поле в два модуля.
+func (c *Code) String() string {
+	const quiet = 2
+	var sb strings.Builder
+	for y := -quiet; y < c.Size+quiet; y += 2 {
+		for x := -quiet; x < c.Size+quiet; x++ {
+			top, bottom := !c.Black(x, y), !c.Black(x, y+1)
+			if y+1 >= c.Size+quiet {
+				bottom = false
+			}
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteByte(' ')
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// PNG рисует код чёрно-белой картинкой: модуль — квадрат scale×scale
+// пикселей, вокруг — поле в четыре модуля, как требует стандарт.
+func (c *Code) PNG(scale int) ([]byte, error) {
+	const quiet = 4
+	n := (c.Size + 2*quiet) * scale
+	img := image.NewPaletted(image.Rect(0, 0, n, n), color.Palette{color.White, color.Black})
+	for y := range n {
+		for x := range n {
+			if c.Black(x/scale-quiet, y/scale-quiet) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Code) set(x, y int, dark bool) {
+	c.modules[y*c.Size+x] = dark
+}
+
+func (c *Code) setFunc(x, y int, dark bool) {
+	c.set(x, y, dark)
+	c.isFunc[y*c.Size+x] = true
+}
+
+func (c *Code) drawFunctionPatterns(ver int, level Level) {
+	for i := range c.Size {
+		c.setFunc(6, i, i%2 == 0)
+		c.setFunc(i, 6, i%2 == 0)
+	}
+	c.drawFinder(3, 3)
+	c.drawFinder(c.Size-4, 3)
+	c.drawFinder(3, c.Size-4)
+
+	pos := alignmentPositions(ver)
+	last := len(pos) - 1
+	for i, x := range pos {
+		for j, y := range pos {
+			// Углы заняты шаблонами поиска.
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+
+	// Место под формат резервируем сейчас, настоящие биты — после выбора маски.
+	c.drawFormatBits(level, 0)
+	if ver >= 7 {
+		c.drawVersion(ver)
+	}
+}
+
+// drawFinder рисует шаблон поиска 7×7 с разделителем вокруг, центр — (cx, cy).
+func (c *Code) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			c.setFunc(x, y, d != 2 && d != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignment(cx, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunc(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// formatLevelBits — код уровня в битах формата.
+var formatLevelBits = [...]int{L: 1, M: 0, Q: 3, H: 2}
+
+// formatBits — 15 бит формата: уровень, маска и их BCH-код.
+func formatBits(level Level, mask int) int {
+	data := formatLevelBits[level]<<3 | mask
+	rem := data
+	for range 10 {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (c *Code) drawFormatBits(level Level, mask int) {
+	bits := formatBits(level, mask)
+
+	// Первая копия — вокруг левого верхнего шаблона поиска.
+	for i := 0; i <= 5; i++ {
+		c.setFunc(8, i, bit(bits, i))
+	}
+	c.setFunc(8, 7, bit(bits, 6))
+	c.setFunc(8, 8, bit(bits, 7))
+	c.setFunc(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		c.setFunc(14-i, 8, bit(bits, i))
+	}
+	// Вторая — у правого верхнего и левого нижнего.
+	for i := range 8 {
+		c.setFunc(c.Size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunc(8, c.Size-15+i, bit(bits, i))
+	}
+	c.setFunc(8, c.Size-8, true) // всегда тёмный модуль
+}
+
+func (c *Code) drawVersion(ver int) {
+	rem := ver
+	for range 12 {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := ver<<12 | rem
+	for i := range 18 {
+		a, b := c.Size-11+i%3, i/3
+		c.setFunc(a, b, bit(bits, i))
+		c.setFunc(b, a, bit(bits, i))
+	}
+}
+
+// drawCodewords раскладывает биты зигзагом колонками по два модуля
+// снизу вверх и обратно, обходя служебные модули.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // колонка шаблона синхронизации
+		}
+		for vert := range c.Size {
+			for j := range 2 {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if !c.isFunc[y*c.Size+x] && i < len(data)*8 {
+					c.set(x, y, bit(int(data[i>>3]), 7-i&7))
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (c *Code) applyMask(mask int) {
+	for y := range c.Size {
+		for x := range c.Size {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			i := y*c.Size + x
+			if invert && !c.isFunc[i] {
+				c.modules[i] = !c.modules[i]
+			}
+		}
+	}
+}
+
+// penalty — штраф маски по правилам стандарта: длинные ряды одного цвета,
+// блоки 2×2, похожие на шаблон поиска участки и перекос тёмных модулей.
+func (c *Code) penalty() int {
+	n := c.Size
+	p := 0
+	for _, transpose := range []bool{false, true} {
+		at := func(a, b int) bool {
+			if transpose {
+				return c.Black(b, a)
+			}
+			return c.Black(a, b)
+		}
+		for b := range n {
+			run := 0
+			for a := range n {
+				if a > 0 && at(a, b) == at(a-1, b) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					p += 3
+				} else if run > 5 {
+					p++
+				}
+			}
+			// 1:1:3:1:1 и четыре светлых модуля с одной из сторон;
+			// за краем кода — светлое поле.
+			for a := -4; a < n; a++ {
+				if matches(at, a, b, finderLeft) || matches(at, a, b, finderRight) {
+					p += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := range n {
+		for x := range n {
+			if c.Black(x, y) {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				v := c.Black(x, y)
+				if v == c.Black(x+1, y) && v == c.Black(x, y+1) && v == c.Black(x+1, y+1) {
+					p += 3
+				}
+			}
+		}
+	}
+	total := n * n
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return p + k*10
+}
+
+var (
+	finderLeft  = []bool{false, false, false, false, true, false, true, true, true, false, true}
+	finderRight = []bool{true, false, true, true, true, false, true, false, false, false, false}
+)
+
+func matches(at func(a, b int) bool, a, b int, pattern []bool) bool {
+	for i, want := range pattern {
+		if at(a+i, b) != want {
+			return false
+		}
+	}
+	return true
+}
+
+func alignmentPositions(ver int) []int {
+	if ver == 1 {
+		return nil
+	}
+	num := ver/7 + 2
+	step := (ver*8 + num*3 + 5) / (num*4 - 4) * 2
+	pos := make([]int, num)
+	pos[0] = 6
+	for i, p := num-1, ver*4+17-7; i >= 1; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+// addECCAndInterleave делит данные на блоки, добавляет к каждому коды
+// Рида — Соломона и перемежает блоки.
+func addECCAndInterleave(data []byte, ver int, level Level) []byte {
+	numBlocks := numECCBlocks[level][ver]
+	eccLen := eccCodewordsPerBlock[level][ver]
+	raw := numRawDataModules(ver) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+	divisor := rsDivisor(eccLen)
+
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := range blocks {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		dat := data[k : k+n]
+		k += n
+		block := make([]byte, 0, shortLen+1)
+		block = append(block, dat...)
+		if i < numShort {
+			block = append(block, 0) // выравнивание с длинными блоками, в выход не попадает
+		}
+		blocks[i] = append(block, rsRemainder(dat, divisor)...)
+	}
+
+	out := make([]byte, 0, raw)
+	for i := range shortLen + 1 {
+		for j, block := range blocks {
+			if i != shortLen-eccLen || j >= numShort {
+				out = append(out, block[i])
+			}
+		}
+	}
+	return out
+}
+
+// rsDivisor — порождающий многочлен Рида — Соломона степени degree над GF(2^8).
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for range degree {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+	return result
+}
+
+// gfMul — умножение в GF(2^8) по модулю x^8+x^4+x^3+x^2+1.
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+func charCountBits(ver int) int {
+	if ver <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// numRawDataModules — модулей под данные и коррекцию в версии ver.
+func numRawDataModules(ver int) int {
+	n := (16*ver+128)*ver + 64
+	if ver >= 2 {
+		align := ver/7 + 2
+		n -= (25*align-10)*align - 55
+		if ver >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+func numDataCodewords(ver int, level Level) int {
+	return numRawDataModules(ver)/8 - eccCodewordsPerBlock[level][ver]*numECCBlocks[level][ver]
+}
+
+// Таблицы стандарта по версиям 1–40 (индекс 0 не используется).
+var eccCodewordsPerBlock = [4][41]int{
+	L: {-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	M: {-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	Q: {-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	H: {-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+var numECCBlocks = [4][41]int{
+	L: {-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	M: {-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	Q: {-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	H: {-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+type bitBuffer []bool
+
+func (bb *bitBuffer) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*bb = append(*bb, v>>i&1 != 0)
+	}
+}
+
+func bit(x, i int) bool { return x>>i&1 != 0 }
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
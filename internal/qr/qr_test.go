@@ -0,0 +1,251 @@
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestRSRemainder(t *testing.T) {
+	// Пример из стандарта: 1-M, «HELLO WORLD».
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestFormatBits(t *testing.T) {
+	for _, tc := range []struct {
+		level Level
+		mask  int
+		want  int
+	}{
+		{L, 0, 0b111011111000100},
+		{L, 4, 0b110011000101111},
+		{M, 0, 0b101010000010010},
+		{Q, 0, 0b011010101011111},
+		{H, 0, 0b001011010001001},
+	} {
+		if got := formatBits(tc.level, tc.mask); got != tc.want {
+			t.Errorf("level %d mask %d: got %015b, want %015b", tc.level, tc.mask, got, tc.want)
+		}
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	// Ёмкость байтового режима из таблиц стандарта.
+	for _, tc := range []struct {
+		ver   int
+		level Level
+		bytes int
+	}{
+		{1, L, 17}, {1, M, 14}, {1, Q, 11}, {1, H, 7},
+		{10, M, 213}, {25, Q, 715}, {40, L, 2953}, {40, H, 1273},
+	} {
+		if got := (numDataCodewords(tc.ver, tc.level)*8 - 4 - charCountBits(tc.ver)) / 8; got != tc.bytes {
+			t.Errorf("version %d level %d: capacity %d, want %d", tc.ver, tc.level, got, tc.bytes)
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		data  string
+		level Level
+	}{
+		{"https://192.168.1.10:8080/ca.crt", M},
+		{"hi", H},
+		{strings.Repeat("teletalkie ", 30), Q}, // версия ≥ 7: с блоком версии
+		{strings.Repeat("x", 2953), L},
+	} {
+		c, err := Encode([]byte(tc.data), tc.level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decode(c)
+		if err != nil {
+			t.Fatalf("%d bytes at level %d: %v", len(tc.data), tc.level, err)
+		}
+		if got != tc.data {
+			t.Fatalf("decoded %q, want %q", got, tc.data)
+		}
+	}
+	if _, err := Encode(make([]byte, 2954), L); err != ErrTooLong {
+		t.Fatalf("expected ErrTooLong, got %v", err)
+	}
+}
+
+func TestPNG(t *testing.T) {
+	c, err := Encode([]byte("https://192.168.1.10:8080/?room=ops"), M)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const scale, quiet = 3, 4
+	data, err := c.PNG(scale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := (c.Size + 2*quiet) * scale; img.Bounds().Dx() != n || img.Bounds().Dy() != n {
+		t.Fatalf("image is %v, want %d×%d", img.Bounds(), n, n)
+	}
+	for y := range img.Bounds().Dy() {
+		for x := range img.Bounds().Dx() {
+			r, _, _, _ := img.At(x, y).RGBA()
+			if dark, want := r == 0, c.Black(x/scale-quiet, y/scale-quiet); dark != want {
+				t.Fatalf("pixel (%d, %d): dark %v, want %v", x, y, dark, want)
+			}
+		}
+	}
+}
+
+// decode — упрощённый считыватель для проверки кодировщика: своя разметка
+// служебных зон, формат из первой копии, проверка синдромов Рида — Соломона
+// по каждому блоку и разбор байтового режима.
+func decode(c *Code) (string, error) {
+	n := c.Size
+	ver := (n - 17) / 4
+
+	var format int
+	for i := 0; i <= 5; i++ {
+		format |= b2i(c.Black(8, i)) << i
+	}
+	format |= b2i(c.Black(8, 7))<<6 | b2i(c.Black(8, 8))<<7 | b2i(c.Black(7, 8))<<8
+	for i := 9; i < 15; i++ {
+		format |= b2i(c.Black(14-i, 8)) << i
+	}
+	format ^= 0x5412
+	mask := format >> 10 & 7
+	level := Level(-1)
+	for l, bits := range formatLevelBits {
+		if bits == format>>13 {
+			level = Level(l)
+		}
+	}
+
+	reserved := func(x, y int) bool {
+		switch {
+		case x == 6 || y == 6:
+			return true
+		case x < 9 && y < 9, x >= n-8 && y < 9, x < 9 && y >= n-8:
+			return true
+		case ver >= 7 && (x >= n-11 && y < 6 || y >= n-11 && x < 6):
+			return true
+		}
+		pos := alignmentPositions(ver)
+		for i, ax := range pos {
+			for j, ay := range pos {
+				corner := i == 0 && j == 0 || i == 0 && j == len(pos)-1 || i == len(pos)-1 && j == 0
+				if !corner && abs(x-ax) <= 2 && abs(y-ay) <= 2 {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	masks := []func(x, y int) bool{
+		func(x, y int) bool { return (x+y)%2 == 0 },
+		func(x, y int) bool { return y%2 == 0 },
+		func(x, y int) bool { return x%3 == 0 },
+		func(x, y int) bool { return (x+y)%3 == 0 },
+		func(x, y int) bool { return (x/3+y/2)%2 == 0 },
+		func(x, y int) bool { return x*y%2+x*y%3 == 0 },
+		func(x, y int) bool { return (x*y%2+x*y%3)%2 == 0 },
+		func(x, y int) bool { return ((x+y)%2+x*y%3)%2 == 0 },
+	}
+
+	var bits []bool
+	upward := true
+	for right := n - 1; right > 0; right -= 2 {
+		if right == 6 {
+			right--
+		}
+		for k := range n {
+			y := k
+			if upward {
+				y = n - 1 - k
+			}
+			for _, x := range []int{right, right - 1} {
+				if !reserved(x, y) {
+					bits = append(bits, c.Black(x, y) != masks[mask](x, y))
+				}
+			}
+		}
+		upward = !upward
+	}
+	raw := make([]byte, numRawDataModules(ver)/8)
+	for i := range raw {
+		for j := range 8 {
+			raw[i] = raw[i]<<1 | byte(b2i(bits[i*8+j]))
+		}
+	}
+
+	numBlocks := numECCBlocks[level][ver]
+	eccLen := eccCodewordsPerBlock[level][ver]
+	shortLen := len(raw) / numBlocks
+	numShort := numBlocks - len(raw)%numBlocks
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := range shortLen + 1 {
+		for j := range blocks {
+			if i == shortLen-eccLen && j < numShort {
+				continue
+			}
+			blocks[j] = append(blocks[j], raw[k])
+			k++
+		}
+	}
+	var data []byte
+	for j, block := range blocks {
+		for i := range eccLen {
+			// Синдром: значение многочлена блока в корне α^i.
+			var s byte
+			root := byte(1)
+			for range i {
+				root = gfMul(root, 2)
+			}
+			for _, b := range block {
+				s = gfMul(s, root) ^ b
+			}
+			if s != 0 {
+				return "", fmt.Errorf("block %d: syndrome %d is %d", j, i, s)
+			}
+		}
+		data = append(data, block[:len(block)-eccLen]...)
+	}
+
+	if data[0]>>4 != 0b0100 {
+		return "", fmt.Errorf("mode %04b, want byte mode", data[0]>>4)
+	}
+	var br bitBuffer
+	for _, b := range data {
+		br.append(int(b), 8)
+	}
+	read := func(off, n int) int {
+		v := 0
+		for _, bit := range br[off : off+n] {
+			v = v<<1 | b2i(bit)
+		}
+		return v
+	}
+	cc := charCountBits(ver)
+	length := read(4, cc)
+	out := make([]byte, length)
+	for i := range out {
+		out[i] = byte(read(4+cc+8*i, 8))
+	}
+	return string(out), nil
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,418 @@
+// Package recorder пишет каждую PTT-передачу в отдельный файл на диске.
+//
+// Раскладка каталога:
+//
+//	<dir>/<room>/<id>.webm   — медиа-поток talker'а как есть (или .mp4)
+//	<dir>/<room>/<id>.json   — сайдкар с метаданными (Meta)
+//
+// id = <время начала UTC>_<talker>_<случайный суффикс>. Сайдкар пишется при
+// первом чанке (ended_at пустой — передача идёт) и переписывается при Stop.
+package recorder
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"teletalkie/internal/media"
+)
+
+// Meta — содержимое JSON-сайдкара передачи.
+type Meta struct {
+	ID        string         `json:"id"`
+	Room      string         `json:"room"`
+	Talker    string         `json:"talker"`              // имя talker'а
+	TalkerID  string         `json:"talker_id,omitempty"` // ID участника (имена могут совпадать)
+	File      string         `json:"file"`                // имя медиафайла в каталоге комнаты
+	Format    string         `json:"format"`              // webm / mp4 — по содержимому потока
+	StartedAt time.Time      `json:"started_at"`
+	EndedAt   *time.Time     `json:"ended_at,omitempty"`   // nil — передача ещё идёт
+	EndReason string         `json:"end_reason,omitempty"` // пусто — talker отпустил эфир сам
+	Bytes     int64          `json:"bytes"`
+	Chunks    int            `json:"chunks"`
+	Reactions map[string]int `json:"reactions,omitempty"` // эмодзи → сколько раз прислали
+	Private   bool           `json:"private,omitempty"`   // комната была с паролем
+}
+
+// recording — активная передача в комнате.
+type recording struct {
+	mu     sync.Mutex
+	dir    string
+	log    *slog.Logger
+	meta   Meta
+	file   *os.File // nil до первого чанка
+	failed bool     // ошибка записи — дальше не пишем
+}
+
+// Recorder пишет передачи всех комнат. Методы потокобезопасны.
+type Recorder struct {
+	dir string
+	log *slog.Logger
+
+	mu     sync.Mutex
+	active map[string]*recording // по ID комнаты: в комнате один talker
+	closed bool
+}
+
+// Option — опция Recorder для New.
+type Option func(*Recorder)
+
+// WithLogger задаёт логгер (по умолчанию slog.Default()).
+func WithLogger(l *slog.Logger) Option {
+	return func(r *Recorder) {
+		r.log = l
+	}
+}
+
+// New создаёт Recorder, пишущий в dir (каталог создаётся при необходимости).
+func New(dir string, opts ...Option) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("recorder: %w", err)
+	}
+	r := &Recorder{
+		dir:    dir,
+		log:    slog.Default(),
+		active: make(map[string]*recording),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r, nil
+}
+
+// Dir возвращает корневой каталог записей.
+func (r *Recorder) Dir() string {
+	return r.dir
+}
+
+// Start начинает запись новой передачи в комнате. Файл создаётся
+// при первом чанке, поэтому PTT без медиа на диске не остаётся.
+// private — комната с паролем: это запоминается в Meta.
+func (r *Recorder) Start(roomID, talker, talkerID string, private bool) {
+	now := time.Now().UTC()
+	id := newID(now, talker)
+	rec := &recording{
+		dir: filepath.Join(r.dir, Sanitize(roomID)),
+		log: r.log.With("room", roomID, "peer_id", talkerID, "recording", id),
+		meta: Meta{
+			ID:        id,
+			Room:      roomID,
+			Talker:    talker,
+			TalkerID:  talkerID,
+			StartedAt: now,
+			Private:   private,
+		},
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	prev := r.active[roomID]
+	r.active[roomID] = rec
+	r.mu.Unlock()
+
+	if prev != nil {
+		prev.finish("")
+	}
+}
+
+// Write дописывает чанк talker'а talkerID в текущую передачу комнаты.
+// Чанк другого talker'а отбрасывается: запоздавший чанк прежнего
+// talker'а, у которого эфир уже забрали, не попадёт в чужой файл.
+func (r *Recorder) Write(roomID, talkerID string, chunk []byte) {
+	r.mu.Lock()
+	rec := r.active[roomID]
+	r.mu.Unlock()
+
+	if rec != nil && rec.meta.TalkerID == talkerID {
+		rec.write(chunk)
+	}
+}
+
+// Stop завершает передачу talker'а talkerID в комнате.
+func (r *Recorder) Stop(roomID, talkerID string) {
+	r.StopWithReason(roomID, talkerID, "")
+}
+
+// StopWithReason завершает передачу talker'а talkerID в комнате, записывая
+// в сайдкар, почему она прервана (эфир отобран, перехвачен и т. п.).
+// Передачу другого talker'а не трогает: события комнаты обрабатываются
+// вне её блокировки, и Start следующего talker'а может опередить Stop
+// предыдущего.
+func (r *Recorder) StopWithReason(roomID, talkerID, reason string) {
+	r.mu.Lock()
+	rec := r.active[roomID]
+	if rec == nil || rec.meta.TalkerID != talkerID {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.active, roomID)
+	r.mu.Unlock()
+
+	rec.finish(reason)
+}
+
+// Close завершает все идущие передачи с причиной reason (например, при
+// остановке сервера); новые после Close не начинаются.
+func (r *Recorder) Close(reason string) {
+	r.mu.Lock()
+	active := r.active
+	r.active = make(map[string]*recording)
+	r.closed = true
+	r.mu.Unlock()
+
+	for _, rec := range active {
+		rec.finish(reason)
+	}
+}
+
+// SetReactions запоминает итоговые счётчики реакций на текущую передачу
+// комнаты; они попадут в сайдкар при её завершении. Счётчики для чужой
+// передачи (talker уже сменился) игнорируются.
+func (r *Recorder) SetReactions(roomID, talkerID string, counts map[string]int) {
+	r.mu.Lock()
+	rec := r.active[roomID]
+	r.mu.Unlock()
+
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	if rec.meta.TalkerID == talkerID {
+		rec.meta.Reactions = counts
+	}
+	rec.mu.Unlock()
+}
+
+func (rec *recording) write(chunk []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.failed || len(chunk) == 0 {
+		return
+	}
+
+	if rec.file == nil {
+		if err := rec.create(chunk); err != nil {
+			rec.log.Error("recording failed", "event", "recording_failed", "err", err)
+			rec.failed = true
+			return
+		}
+	}
+
+	n, err := rec.file.Write(chunk)
+	rec.meta.Bytes += int64(n)
+	rec.meta.Chunks++
+	if err != nil {
+		rec.log.Error("recording write failed", "event", "recording_failed", "file", rec.file.Name(), "err", err)
+		rec.failed = true
+	}
+}
+
+// create открывает медиафайл; расширение выбирается по первому чанку.
+func (rec *recording) create(first []byte) error {
+	if err := os.MkdirAll(rec.dir, 0o755); err != nil {
+		return err
+	}
+
+	format := media.Detect(first)
+	ext := ".webm"
+	if format == media.FormatMP4 {
+		ext = ".mp4"
+	}
+	rec.meta.Format = strings.TrimPrefix(ext, ".")
+	rec.meta.File = rec.meta.ID + ext
+
+	f, err := os.OpenFile(filepath.Join(rec.dir, rec.meta.File), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	rec.file = f
+
+	if err := rec.writeMeta(); err != nil {
+		rec.log.Error("sidecar write failed", "err", err)
+	}
+	rec.log.Info("recording started", "event", "recording_started", "peer", rec.meta.Talker, "file", f.Name())
+	return nil
+}
+
+func (rec *recording) finish(reason string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.file == nil {
+		return
+	}
+	rec.meta.EndReason = reason
+
+	if err := rec.file.Close(); err != nil {
+		rec.log.Error("recording close failed", "file", rec.file.Name(), "err", err)
+	}
+	ended := time.Now().UTC()
+	rec.meta.EndedAt = &ended
+
+	if err := rec.writeMeta(); err != nil {
+		rec.log.Error("sidecar write failed", "err", err)
+	}
+	rec.log.Info("recording saved", "event", "recording_saved", "file", rec.meta.File,
+		"bytes", rec.meta.Bytes, "duration", ended.Sub(rec.meta.StartedAt).Round(time.Millisecond), "end_reason", reason)
+	rec.file = nil
+}
+
+// writeMeta атомарно (через rename) записывает сайдкар.
+func (rec *recording) writeMeta() error {
+	data, err := json.MarshalIndent(rec.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(rec.dir, rec.meta.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func newID(t time.Time, talker string) string {
+	var suffix [3]byte
+	rand.Read(suffix[:])
+	return t.Format("20060102T150405.000Z") + "_" + Sanitize(talker) + "_" + hex.EncodeToString(suffix[:])
+}
+
+// Sanitize превращает имя комнаты или участника в безопасное имя файла:
+// буквы и цифры (в том числе кириллица), '-' и '_'; остальное — '_'.
+func Sanitize(s string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range s {
+		if n == 64 {
+			break
+		}
+		if unicode.IsLetter(c) || unicode.IsDigit(c) || c == '-' || c == '_' {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('_')
+		}
+		n++
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// ErrNotFound — запись с таким ID не найдена.
+var ErrNotFound = errors.New("recorder: recording not found")
+
+// Filter — условия выборки записей комнаты. Нулевые поля не ограничивают.
+type Filter struct {
+	Talker string
+	From   time.Time // started_at >= From
+	To     time.Time // started_at < To
+}
+
+func (f Filter) match(m Meta) bool {
+	if f.Talker != "" && m.Talker != f.Talker {
+		return false
+	}
+	if !f.From.IsZero() && m.StartedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !m.StartedAt.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+// List возвращает записи комнаты, подходящие под фильтр, от новых к старым.
+func (r *Recorder) List(roomID string, f Filter) ([]Meta, error) {
+	paths, err := filepath.Glob(filepath.Join(r.dir, Sanitize(roomID), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Meta, 0, len(paths))
+	for _, path := range paths {
+		m, err := readMeta(path)
+		if err != nil {
+			r.log.Warn("skipping unreadable sidecar", "path", path, "err", err)
+			continue
+		}
+		// Разные имена комнат могут дать один каталог после Sanitize.
+		if m.Room != roomID || !f.match(m) {
+			continue
+		}
+		out = append(out, m)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].StartedAt.After(out[j].StartedAt)
+	})
+	return out, nil
+}
+
+// Open открывает медиафайл записи по ID. Файл закрывает вызывающий.
+func (r *Recorder) Open(id string) (*os.File, Meta, error) {
+	if !validID(id) {
+		return nil, Meta{}, ErrNotFound
+	}
+
+	paths, err := filepath.Glob(filepath.Join(r.dir, "*", id+".json"))
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	if len(paths) == 0 {
+		return nil, Meta{}, ErrNotFound
+	}
+
+	m, err := readMeta(paths[0])
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	f, err := os.Open(filepath.Join(filepath.Dir(paths[0]), m.File))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, Meta{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	return f, m, nil
+}
+
+func readMeta(path string) (Meta, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Meta{}, err
+	}
+	var m Meta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Meta{}, err
+	}
+	return m, nil
+}
+
+// validID проверяет, что ID похож на созданный newID и не выводит за пределы каталога.
+func validID(id string) bool {
+	if id == "" || strings.HasPrefix(id, ".") || strings.Contains(id, "..") {
+		return false
+	}
+	for _, c := range id {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+package recorder
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"teletalkie/internal/media/mediatest"
+)
+
+func mustMeta(t *testing.T, path string) Meta {
+	t.Helper()
+	m, err := readMeta(path)
+	if err != nil {
+		t.Fatalf("read sidecar: %v", err)
+	}
+	return m
+}
+
+func TestRecordTransmission(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	init := mediatest.WebMInit()
+	cluster := mediatest.WebMCluster(true, 0x11)
+
+	rec.Start("room1", "alice", "", false)
+	rec.Write("room1", "", init)
+	rec.Write("room1", "", cluster)
+
+	// Пока передача идёт, сайдкар уже есть, но без ended_at.
+	sidecars, _ := filepath.Glob(filepath.Join(dir, "room1", "*.json"))
+	if len(sidecars) != 1 {
+		t.Fatalf("expected 1 sidecar during transmission, got %v", sidecars)
+	}
+	if m := mustMeta(t, sidecars[0]); m.EndedAt != nil {
+		t.Fatal("expected ended_at to be empty while recording")
+	}
+
+	rec.Stop("room1", "")
+
+	m := mustMeta(t, sidecars[0])
+	if m.Room != "room1" || m.Talker != "alice" || m.Format != "webm" {
+		t.Fatalf("unexpected meta: %+v", m)
+	}
+	if m.EndedAt == nil || m.EndedAt.Before(m.StartedAt) {
+		t.Fatalf("bad ended_at: %+v", m)
+	}
+	if m.Chunks != 2 || m.Bytes != int64(len(init)+len(cluster)) {
+		t.Fatalf("chunks=%d bytes=%d", m.Chunks, m.Bytes)
+	}
+	if !strings.HasSuffix(m.File, ".webm") || !strings.Contains(m.File, "_alice_") {
+		t.Fatalf("unexpected file name %q", m.File)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "room1", m.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(init)+string(cluster) {
+		t.Fatal("recorded file differs from transmitted stream")
+	}
+}
+
+func TestStartWithoutMediaLeavesNoFiles(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec.Start("room1", "alice", "", false)
+	rec.Stop("room1", "")
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if len(files) != 0 {
+		t.Fatalf("expected no files, got %v", files)
+	}
+}
+
+func TestMP4Extension(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec.Start("room1", "bob", "", false)
+	rec.Write("room1", "", mediatest.MP4Init())
+	rec.Stop("room1", "")
+
+	files, _ := filepath.Glob(filepath.Join(dir, "room1", "*.mp4"))
+	if len(files) != 1 {
+		t.Fatalf("expected one .mp4 recording, got %v", files)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	for in, want := range map[string]string{
+		"alice":       "alice",
+		"Вася Пупкин": "Вася_Пупкин",
+		"../etc":      "___etc",
+		"":            "_",
+		"a/b\\c":      "a_b_c",
+	} {
+		if got := Sanitize(in); got != want {
+			t.Errorf("Sanitize(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCloseFinishesActiveRecordings(t *testing.T) {
+	dir := t.TempDir()
+	r, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Start("room1", "alice", "a1", false)
+	r.Write("room1", "a1", mediatest.WebMInit())
+	r.Close("server shutdown")
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "room1", "*.json"))
+	if len(paths) != 1 {
+		t.Fatalf("expected 1 sidecar, got %d", len(paths))
+	}
+	m := mustMeta(t, paths[0])
+	if m.EndedAt == nil || m.EndReason != "server shutdown" {
+		t.Fatalf("expected finished recording with end reason, got %+v", m)
+	}
+
+	// После Close новые передачи не пишутся.
+	r.Start("room2", "bob", "b1", false)
+	r.Write("room2", "b1", mediatest.WebMInit())
+	if _, err := os.Stat(filepath.Join(dir, "room2")); !os.IsNotExist(err) {
+		t.Fatalf("expected no recording after Close, stat err: %v", err)
+	}
+}
+
+func TestWriteIgnoresOtherTalker(t *testing.T) {
+	dir := t.TempDir()
+	r, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Эфир перехватил bob, а чанк alice пришёл уже после Start.
+	r.Start("room1", "bob", "b1", false)
+	r.Write("room1", "a1", mediatest.WebMCluster(true, 0x11))
+	init := mediatest.WebMInit()
+	r.Write("room1", "b1", init)
+	r.Stop("room1", "b1")
+
+	files, _ := filepath.Glob(filepath.Join(dir, "room1", "*.webm"))
+	if len(files) != 1 {
+		t.Fatalf("expected one recording, got %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, init) {
+		t.Fatalf("recording must hold only bob's stream, got %d bytes", len(data))
+	}
+}
+
+func TestStopIgnoresOtherTalker(t *testing.T) {
+	dir := t.TempDir()
+	r, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// alice отпустила эфир, bob получил его из очереди, и Start bob'а
+	// обогнал Stop alice: её Stop не должен закрыть передачу bob'а.
+	r.Start("room1", "alice", "a1", false)
+	r.Write("room1", "a1", mediatest.WebMInit())
+	r.Start("room1", "bob", "b1", false)
+	r.StopWithReason("room1", "a1", "")
+	init, cluster := mediatest.WebMInit(), mediatest.WebMCluster(true, 0x11)
+	r.Write("room1", "b1", init)
+	r.Write("room1", "b1", cluster)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "room1", "*_bob_*.json"))
+	if len(files) != 1 {
+		t.Fatalf("expected bob's recording, got %v", files)
+	}
+	if m := mustMeta(t, files[0]); m.EndedAt != nil {
+		t.Fatal("bob's recording was finished by alice's Stop")
+	}
+	r.Stop("room1", "b1")
+
+	m := mustMeta(t, files[0])
+	if m.EndedAt == nil || m.Chunks != 2 || m.Bytes != int64(len(init)+len(cluster)) {
+		t.Fatalf("bob's recording lost chunks: %+v", m)
+	}
+}
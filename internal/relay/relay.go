@@ -0,0 +1,110 @@
+// Package relay — буферы для пересылки медиа без копирования. Чанк
+// talker'а читается из соединения прямо в буфер из пула, один и тот же
+// буфер уходит в очереди всех слушателей и в кэш комнаты, а в пул
+// возвращается, когда его отпустил последний держатель.
+//
+// Правило владения: кто получил буфер (Get, ReadFrom, Wrap, Retain),
+// тот обязан ровно один раз вызвать Release. Не отпущенный буфер просто
+// соберёт GC; отпущенный лишний раз — ошибка, Release паникует.
+package relay
+
+import (
+	"io"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	minClass = 10 // 1 KiB — меньшие буферы берутся этого размера
+	maxClass = 22 // 4 MiB — большие не кэшируются в пуле
+)
+
+// pools — по пулу на каждый класс размера: 1<<minClass … 1<<maxClass.
+var pools [maxClass - minClass + 1]sync.Pool
+
+// Buffer — байты сообщения со счётчиком ссылок.
+type Buffer struct {
+	b     []byte
+	refs  atomic.Int32
+	class int // 0 — не из пула
+}
+
+// Get возвращает буфер длины n из пула; содержимое не обнулено.
+func Get(n int) *Buffer {
+	c := minClass
+	if n > 1<<minClass {
+		c = bits.Len(uint(n - 1))
+	}
+	if c > maxClass {
+		return Wrap(make([]byte, n))
+	}
+	buf, _ := pools[c-minClass].Get().(*Buffer)
+	if buf == nil {
+		buf = &Buffer{b: make([]byte, 1<<c), class: c}
+	}
+	buf.b = buf.b[:n]
+	buf.refs.Store(1)
+	return buf
+}
+
+// Wrap оборачивает b в буфер вне пула — для сообщений, собранных
+// не из прочитанных данных (повтор кэша, тесты).
+func Wrap(b []byte) *Buffer {
+	buf := &Buffer{b: b}
+	buf.refs.Store(1)
+	return buf
+}
+
+// ReadFrom читает r до EOF в буфер из пула. hint — ожидаемый размер
+// (например, размер прошлого сообщения того же соединения): с ним
+// буфер обычно не приходится растить.
+func ReadFrom(r io.Reader, hint int) (*Buffer, error) {
+	buf := Get(hint)
+	buf.b = buf.b[:cap(buf.b)]
+	n := 0
+	for {
+		m, err := r.Read(buf.b[n:])
+		n += m
+		if err == io.EOF {
+			buf.b = buf.b[:n]
+			return buf, nil
+		}
+		if err != nil {
+			buf.Release()
+			return nil, err
+		}
+		if n == len(buf.b) {
+			bigger := Get(2 * n)
+			bigger.b = bigger.b[:cap(bigger.b)]
+			copy(bigger.b, buf.b[:n])
+			buf.Release()
+			buf = bigger
+		}
+	}
+}
+
+// Bytes — содержимое буфера. Действительно, пока вызывающий держит ссылку;
+// менять его можно, только пока буфер никому не передан.
+func (b *Buffer) Bytes() []byte { return b.b }
+
+// Len — длина содержимого.
+func (b *Buffer) Len() int { return len(b.b) }
+
+// Retain добавляет ссылку и возвращает тот же буфер.
+func (b *Buffer) Retain() *Buffer {
+	b.refs.Add(1)
+	return b
+}
+
+// Release отпускает ссылку; последняя возвращает буфер в пул.
+func (b *Buffer) Release() {
+	switch n := b.refs.Add(-1); {
+	case n > 0:
+	case n < 0:
+		panic("relay: buffer released too many times")
+	case b.class != 0:
+		b.b = b.b[:0]
+		pools[b.class-minClass].Put(b)
+	}
+}
@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadFrom(t *testing.T) {
+	data := bytes.Repeat([]byte("teletalkie"), 1000)
+	for _, hint := range []int{0, 100, len(data), 1 << 20} {
+		// OneByteReader — чтение кусками, как у WebSocket-фреймов.
+		buf, err := ReadFrom(iotest.OneByteReader(bytes.NewReader(data)), hint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("hint %d: got %d bytes, want %d", hint, buf.Len(), len(data))
+		}
+		buf.Release()
+	}
+
+	wantErr := errors.New("boom")
+	if _, err := ReadFrom(io.MultiReader(bytes.NewReader(data), iotest.ErrReader(wantErr)), 0); !errors.Is(err, wantErr) {
+		t.Fatalf("expected read error, got %v", err)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	buf := Get(3000)
+	if buf.Len() != 3000 || cap(buf.Bytes()) != 4096 {
+		t.Fatalf("expected len 3000 in a 4 KiB buffer, got len %d cap %d", buf.Len(), cap(buf.Bytes()))
+	}
+	buf.Retain()
+	buf.Release()
+	if buf.Len() != 3000 {
+		t.Fatal("buffer recycled while still referenced")
+	}
+	buf.Release()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on extra Release")
+		}
+	}()
+	buf.Release()
+}
@@ -0,0 +1,115 @@
+package room
+
+import (
+	"errors"
+	"time"
+
+	"teletalkie/internal/relay"
+)
+
+const (
+	// controlBuffer — ёмкость Peer.Control.
+	controlBuffer = 64
+	// mediaBuffer — ёмкость Peer.Media.
+	mediaBuffer = 48
+	// DefaultSlowConsumerTimeout — сколько по умолчанию слушатель может
+	// не успевать за потоком, прежде чем его отключат.
+	DefaultSlowConsumerTimeout = 10 * time.Second
+)
+
+// ErrSlowConsumer — сессия закрыта: клиент не успевал забирать сообщения.
+var ErrSlowConsumer = errors.New("room: slow consumer")
+
+// sendMediaLocked — медиа-чанк одному слушателю. Если его очередь Media
+// заполнена, чанк не выбрасывается посреди кластера: слушатель
+// пропускает всё до следующего ключевого фрагмента и продолжает ровно
+// с его начала — MSE не видит обрывков. Не успевающего дольше
+// Hub.slowTimeout отключаем. key — смещение ключевого фрагмента в
+// payload чанка (-1 — нет), hadInit — init-сегмент целиком был в
+// предыдущих чанках, а не в этом. В очередь уходит ссылка на сам msg,
+// без копирования.
+func (r *Room) sendMediaLocked(p *Peer, msg *relay.Buffer, key int, hadInit bool, now time.Time) {
+	if p.mediaSkip && key < 0 {
+		r.mediaDroppedLocked(p, now)
+		return
+	}
+
+	if len(p.Media) == cap(p.Media) {
+		if !p.mediaSkip {
+			p.mediaSkip = true
+			p.mediaSkipInit = !hadInit
+			p.saturatedSince = now
+			r.log.Warn("peer is too slow, skipping media until next keyframe", "event", "media_skipped", "peer_id", p.ID, "peer", p.Name)
+		}
+		r.mediaDroppedLocked(p, now)
+		return
+	}
+
+	if !p.mediaSkip {
+		p.Media <- msg.Retain()
+		return
+	}
+	if out := r.resumeMediaLocked(p, msg, key); out != nil {
+		p.Media <- out
+		p.mediaSkip = false
+		r.log.Info("peer caught up, media resumed", "event", "media_resumed", "peer_id", p.ID, "peer", p.Name,
+			"skipped", now.Sub(p.saturatedSince).Round(time.Millisecond))
+		return
+	}
+	r.mediaDroppedLocked(p, now)
+}
+
+// resumeMediaLocked собирает сообщение, с которого слушатель продолжает
+// после пропуска: хвост чанка с ключевого фрагмента, а если слушатель
+// пропустил и часть init-сегмента — init-сегмент и этот хвост. nil —
+// продолжить не с чего. Возвращённая ссылка принадлежит очереди.
+func (r *Room) resumeMediaLocked(p *Peer, msg *relay.Buffer, key int) *relay.Buffer {
+	if p.mediaSkipInit {
+		// Кэш только что обрезан до этого ключевого фрагмента.
+		return r.cache.replay()
+	}
+	if key == 0 {
+		return msg.Retain()
+	}
+	src := msg.Bytes()
+	out := relay.Get(len(src) - key)
+	out.Bytes()[0] = src[0]
+	copy(out.Bytes()[1:], src[1+key:])
+	return out
+}
+
+func (r *Room) mediaDroppedLocked(p *Peer, now time.Time) {
+	if r.hub != nil {
+		r.hub.dropped.Add(1)
+	}
+	if timeout := r.slowTimeout(); timeout > 0 && now.Sub(p.saturatedSince) > timeout {
+		r.kickLocked(p, "media backlog")
+	}
+}
+
+// kickLocked закрывает сессию участника с ErrSlowConsumer: сервер рвёт
+// соединение, клиент переподключается и получает состояние заново.
+func (r *Room) kickLocked(p *Peer, why string) {
+	if !p.session.end(ErrSlowConsumer) {
+		return
+	}
+	r.log.Warn("disconnecting slow consumer", "event", "slow_consumer", "peer_id", p.ID, "peer", p.Name, "reason", why)
+	if r.hub != nil {
+		r.hub.kicked.Add(1)
+	}
+}
+
+// resetMediaSkipLocked — поток начинается заново (с init-сегмента),
+// пропуски старого потока больше не важны.
+func (r *Room) resetMediaSkipLocked() {
+	for p := range r.peers {
+		p.mediaSkip = false
+	}
+}
+
+func (r *Room) slowTimeout() time.Duration {
+	if r.hub == nil {
+		return DefaultSlowConsumerTimeout
+	}
+	return r.hub.slowTimeout
+}
@@ -0,0 +1,84 @@
+package room
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// ChatHistorySize — сколько последних сообщений чата комната хранит для новичков.
+	ChatHistorySize = 100
+	// MaxChatText — максимальная длина сообщения в символах.
+	MaxChatText = 1000
+
+	// chatBurst — сколько сообщений подряд можно отправить.
+	chatBurst = 10
+	// chatRate — сколько сообщений в секунду восстанавливается. Каждое
+	// уходит всем участникам, и спам переполнил бы их очереди.
+	chatRate = 1.0
+)
+
+var (
+	ErrChatEmpty   = errors.New("room: empty chat message")
+	ErrChatTooLong = errors.New("room: chat message too long")
+	ErrChatLimited = errors.New("room: too many chat messages")
+)
+
+// ChatMessage — сообщение текстового чата комнаты.
+type ChatMessage struct {
+	ID       string
+	SenderID string
+	Sender   string // имя отправителя на момент отправки
+	Text     string
+	Time     time.Time
+	ReplyTo  string // ID сообщения, на которое это ответ; пусто — не ответ
+}
+
+// PostChat добавляет сообщение p в историю чата и возвращает его с ID и
+// временем. Рассылку делает вызывающий. replyTo, которого нет в истории,
+// отбрасывается. Частота сообщений каждого участника ограничена
+// (ErrChatLimited).
+func (r *Room) PostChat(p *Peer, text, replyTo string) (ChatMessage, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return ChatMessage{}, ErrChatEmpty
+	}
+	if utf8.RuneCountInString(text) > MaxChatText {
+		return ChatMessage{}, ErrChatTooLong
+	}
+
+	m := ChatMessage{
+		ID:       randomID(),
+		SenderID: p.ID,
+		Sender:   p.Name,
+		Text:     text,
+		Time:     time.Now().UTC(),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !p.chatLimit.take(m.Time, chatBurst, chatRate) {
+		return ChatMessage{}, ErrChatLimited
+	}
+	for _, h := range r.chat {
+		if h.ID == replyTo {
+			m.ReplyTo = replyTo
+			break
+		}
+	}
+	if len(r.chat) == ChatHistorySize {
+		r.chat = append(r.chat[:0], r.chat[1:]...)
+	}
+	r.chat = append(r.chat, m)
+	return m, nil
+}
+
+// ChatHistory возвращает историю чата от старых сообщений к новым.
+func (r *Room) ChatHistory() []ChatMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ChatMessage(nil), r.chat...)
+}
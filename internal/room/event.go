@@ -0,0 +1,59 @@
+package room
+
+// EventType — что произошло в комнате: с участниками или с эфиром.
+type EventType int
+
+const (
+	// EventDisconnected — соединение участника оборвалось, он ждёт
+	// переподключения (Peer.Reconnecting).
+	EventDisconnected EventType = iota + 1
+	// EventLeft — участник покинул комнату.
+	EventLeft
+	// EventFloorReleased — эфир освободился: Release, уход talker'а
+	// или истёкший grace-период.
+	EventFloorReleased
+	// EventFloorGranted — Peer получил эфир: сразу по запросу или
+	// из очереди, когда эфир освободился.
+	EventFloorGranted
+	// EventQueueChanged — изменилась очередь на эфир (Room.Queue).
+	EventQueueChanged
+	// EventFloorRevoked — сервер отобрал эфир у Peer (Event.Reason);
+	// следом идёт EventFloorReleased.
+	EventFloorRevoked
+	// EventFloorPreempted — эфир у Peer перехватил участник с большим
+	// приоритетом (Event.By); следом идут EventFloorReleased и EventFloorGranted.
+	EventFloorPreempted
+)
+
+// Event — событие комнаты для обработчика, заданного SetEventHandler.
+type Event struct {
+	Type   EventType
+	Room   *Room
+	Peer   *Peer
+	Reason RevokeReason // для EventFloorRevoked
+	By     *Peer        // для EventFloorPreempted
+}
+
+// SetEventHandler задаёт обработчик событий комнат. Он вызывается
+// синхронно, без блокировок hub'а и комнаты — из него можно звать любые
+// их методы.
+func (h *Hub) SetEventHandler(fn func(Event)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onEvent = fn
+}
+
+func (h *Hub) emit(ev Event) {
+	h.mu.Lock()
+	fn := h.onEvent
+	h.mu.Unlock()
+	if fn != nil {
+		fn(ev)
+	}
+}
+
+func (r *Room) emit(ev Event) {
+	if r.hub != nil {
+		r.hub.emit(ev)
+	}
+}
@@ -0,0 +1,247 @@
+package room
+
+import (
+	"slices"
+	"time"
+)
+
+// TalkLimits — ограничения одной передачи. Нулевое поле — без ограничения.
+type TalkLimits struct {
+	// MaxTalk — сколько talker может держать эфир за одну передачу.
+	MaxTalk time.Duration
+	// MediaIdle — сколько talker может держать эфир, не присылая медиа.
+	// Пока talker переподключается, не отсчитывается.
+	MediaIdle time.Duration
+}
+
+// RevokeReason — почему сервер отобрал эфир.
+type RevokeReason byte
+
+const (
+	RevokeMaxTalk   RevokeReason = 0x01 // передача длится дольше TalkLimits.MaxTalk
+	RevokeMediaIdle RevokeReason = 0x02 // нет медиа дольше TalkLimits.MediaIdle
+)
+
+func (r RevokeReason) String() string {
+	switch r {
+	case RevokeMaxTalk:
+		return "max talk time exceeded"
+	case RevokeMediaIdle:
+		return "no media"
+	}
+	return "unknown"
+}
+
+// TryAcquire пытается захватить эфир для peer'а, не вставая в очередь.
+// Занятый эфир перехватывается, если приоритет peer'а выше, чем у talker'а.
+// Возвращает true если эфир захвачен, false если занят или роль не может говорить.
+func (r *Room) TryAcquire(p *Peer) bool {
+	granted, _ := r.requestFloor(p, false)
+	return granted
+}
+
+// RequestFloor — запрос эфира (PTT_ON). Свободный эфир захватывается сразу,
+// занятый talker'ом с меньшим приоритетом — перехватывается. Иначе в режиме
+// очереди peer встаёт в очередь — за всеми с тем же или большим приоритетом
+// (повторный запрос места не меняет) — и получает позицию, начиная с 1;
+// без очереди — pos == 0, запрос отклонён.
+func (r *Room) RequestFloor(p *Peer) (granted bool, pos int) {
+	return r.requestFloor(p, r.queueMode)
+}
+
+func (r *Room) requestFloor(p *Peer, enqueue bool) (granted bool, pos int) {
+	r.mu.Lock()
+	var evs []Event
+	switch {
+	case !p.Role.CanTalk() || r.Talker == p || p.detached:
+	case r.Talker == nil:
+		evs = append(evs, r.grantLocked(p))
+		granted = true
+	case p.Priority > r.Talker.Priority:
+		evs = r.preemptLocked(p)
+		granted = true
+	case enqueue:
+		pos, evs = r.enqueueLocked(p)
+	}
+	if granted && r.dequeueLocked(p) {
+		evs = append(evs, Event{Type: EventQueueChanged, Room: r, Peer: p})
+	}
+	r.mu.Unlock()
+
+	for _, ev := range evs {
+		r.emit(ev)
+	}
+	return granted, pos
+}
+
+// enqueueLocked ставит p в очередь перед первым участником с меньшим приоритетом.
+func (r *Room) enqueueLocked(p *Peer) (pos int, evs []Event) {
+	if i := r.queueIndexLocked(p); i >= 0 {
+		return i + 1, nil
+	}
+	i := len(r.queue)
+	for j, q := range r.queue {
+		if p.Priority > q.Priority {
+			i = j
+			break
+		}
+	}
+	r.queue = slices.Insert(r.queue, i, p)
+	r.log.Info("peer queued for floor", "event", "floor_queued", "peer_id", p.ID, "peer", p.Name, "position", i+1)
+	return i + 1, []Event{{Type: EventQueueChanged, Room: r, Peer: p}}
+}
+
+// preemptLocked отдаёт эфир p, снимая его с текущего talker'а.
+func (r *Room) preemptLocked(p *Peer) []Event {
+	prev := r.Talker
+	r.log.Info("floor pre-empted", "event", "floor_preempted", "peer_id", prev.ID, "peer", prev.Name, "by_peer_id", p.ID)
+	r.Talker = nil
+	r.resetCacheLocked(nil)
+	r.stopTalkTimersLocked()
+	return []Event{
+		{Type: EventFloorPreempted, Room: r, Peer: prev, By: p},
+		{Type: EventFloorReleased, Room: r, Peer: prev},
+		r.grantLocked(p),
+	}
+}
+
+// Release освобождает эфир; в режиме очереди эфир сразу переходит следующему.
+// Если peer не talker, а стоит в очереди — он из неё выходит.
+// Возвращает true если эфир действительно был освобождён.
+func (r *Room) Release(p *Peer) bool {
+	r.mu.Lock()
+	if r.Talker != p {
+		dequeued := r.dequeueLocked(p)
+		r.mu.Unlock()
+		if dequeued {
+			r.emit(Event{Type: EventQueueChanged, Room: r, Peer: p})
+		}
+		return false
+	}
+	r.log.Info("floor released", "event", "floor_released", "peer_id", p.ID, "peer", p.Name)
+	evs := r.handOffLocked(p)
+	r.mu.Unlock()
+
+	for _, ev := range evs {
+		r.emit(ev)
+	}
+	return true
+}
+
+// Queue возвращает очередь на эфир по порядку (потокобезопасно).
+func (r *Room) Queue() []*Peer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Peer(nil), r.queue...)
+}
+
+func (r *Room) grantLocked(p *Peer) Event {
+	r.Talker = p
+	r.resetCacheLocked(newMediaCache())
+	r.resetMediaSkipLocked()
+	r.reactions = nil
+	r.startTalkTimersLocked()
+	r.log.Info("floor granted", "event", "floor_granted", "peer_id", p.ID, "peer", p.Name)
+	return Event{Type: EventFloorGranted, Room: r, Peer: p}
+}
+
+// handOffLocked снимает эфир с prev и отдаёт его первому в очереди.
+// Возвращает события в порядке, в котором их нужно разослать.
+func (r *Room) handOffLocked(prev *Peer) []Event {
+	r.Talker = nil
+	r.resetCacheLocked(nil)
+	r.stopTalkTimersLocked()
+	evs := []Event{{Type: EventFloorReleased, Room: r, Peer: prev}}
+
+	if len(r.queue) == 0 {
+		return evs
+	}
+	next := r.queue[0]
+	r.queue = r.queue[1:]
+	return append(evs,
+		r.grantLocked(next),
+		Event{Type: EventQueueChanged, Room: r, Peer: next},
+	)
+}
+
+func (r *Room) queueIndexLocked(p *Peer) int {
+	for i, q := range r.queue {
+		if q == p {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *Room) dequeueLocked(p *Peer) bool {
+	i := r.queueIndexLocked(p)
+	if i < 0 {
+		return false
+	}
+	r.queue = append(r.queue[:i], r.queue[i+1:]...)
+	return true
+}
+
+func (r *Room) startTalkTimersLocked() {
+	r.talkGen++
+	gen := r.talkGen
+	r.lastMedia = time.Now()
+
+	if d := r.limits.MaxTalk; d > 0 {
+		r.maxTimer = time.AfterFunc(d, func() { r.revoke(gen, RevokeMaxTalk) })
+	}
+	if d := r.limits.MediaIdle; d > 0 {
+		r.idleTimer = time.AfterFunc(d, func() { r.revoke(gen, RevokeMediaIdle) })
+	}
+}
+
+func (r *Room) stopTalkTimersLocked() {
+	if r.maxTimer != nil {
+		r.maxTimer.Stop()
+		r.maxTimer = nil
+	}
+	if r.idleTimer != nil {
+		r.idleTimer.Stop()
+		r.idleTimer = nil
+	}
+}
+
+// resetIdleLocked перезапускает отсчёт MediaIdle — после переподключения talker'а.
+func (r *Room) resetIdleLocked() {
+	r.lastMedia = time.Now()
+	if r.idleTimer != nil {
+		r.idleTimer.Reset(r.limits.MediaIdle)
+	}
+}
+
+// revoke отбирает эфир у talker'а передачи gen, если она ещё идёт:
+// EventFloorRevoked, затем обычное освобождение эфира.
+func (r *Room) revoke(gen uint64, reason RevokeReason) {
+	r.mu.Lock()
+	p := r.Talker
+	if p == nil || gen != r.talkGen {
+		r.mu.Unlock()
+		return
+	}
+	if reason == RevokeMediaIdle {
+		if p.detached {
+			// Отсчёт возобновит reattach.
+			r.mu.Unlock()
+			return
+		}
+		// Таймер не перезапускается на каждый чанк — проверяем по времени.
+		if left := r.limits.MediaIdle - time.Since(r.lastMedia); left > 0 {
+			r.idleTimer.Reset(left)
+			r.mu.Unlock()
+			return
+		}
+	}
+
+	r.log.Warn("floor revoked", "event", "floor_revoked", "peer_id", p.ID, "peer", p.Name, "reason", reason.String())
+	evs := append([]Event{{Type: EventFloorRevoked, Room: r, Peer: p, Reason: reason}}, r.handOffLocked(p)...)
+	r.mu.Unlock()
+
+	for _, ev := range evs {
+		r.emit(ev)
+	}
+}
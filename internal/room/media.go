@@ -0,0 +1,147 @@
+package room
+
+import (
+	"teletalkie/internal/media"
+	"teletalkie/internal/relay"
+)
+
+// maxCacheSize — предел памяти на кэш одной передачи. Если ключевой
+// фрагмент не приходит так долго, опоздавшие ждут следующего.
+const maxCacheSize = 8 * 1024 * 1024
+
+// cachedChunk — сообщение talker'а и позиция его данных в потоке.
+type cachedChunk struct {
+	pos int64
+	msg *relay.Buffer // [0] — тип сообщения, [1:] — данные контейнера
+}
+
+// mediaCache хранит init-сегмент текущей передачи и чанки начиная
+// с последнего фрагмента с ключевым кадром — этого достаточно, чтобы
+// MSE у опоздавшего listener'а начал декодировать с середины эфира.
+// На чанки кэш держит ссылки; release их отпускает.
+type mediaCache struct {
+	scan *media.Scanner
+
+	init     []byte // данные потока с начала до конца init-сегмента
+	initDone bool
+
+	chunks []cachedChunk // от чанка с keyPos до последнего
+	keyPos int64         // -1 — ключевого фрагмента в кэше нет
+	size   int
+}
+
+func newMediaCache() *mediaCache {
+	return &mediaCache{
+		scan:   media.NewScanner(),
+		keyPos: -1,
+	}
+}
+
+// add разбирает очередное сообщение talker'а и обновляет кэш. Возвращает
+// смещение в payload, с которого начинается последний ключевой фрагмент
+// этого чанка, или -1, если его нет.
+func (c *mediaCache) add(msg *relay.Buffer) (key int) {
+	payload := msg.Bytes()[1:]
+	pos := c.scan.Pos()
+	marks := c.scan.Feed(payload)
+
+	if !c.initDone {
+		c.init = append(c.init, payload...)
+	}
+
+	c.chunks = append(c.chunks, cachedChunk{pos: pos, msg: msg.Retain()})
+	c.size += len(payload)
+
+	key = -1
+	for _, m := range marks {
+		switch m.Kind {
+		case media.MarkInitEnd:
+			c.initDone = true
+			c.init = c.init[:m.Pos]
+		case media.MarkKeyframe:
+			c.trimTo(m.Pos)
+			// Фрагмент мог начаться ещё в прошлом чанке.
+			if m.Pos >= pos {
+				key = int(m.Pos - pos)
+			}
+		}
+	}
+
+	if !c.initDone && len(c.init) > maxCacheSize {
+		// Init-сегмент такого размера — явно не то, что мы умеем разбирать.
+		c.init = nil
+		c.initDone = true
+	}
+
+	if c.size > maxCacheSize {
+		c.release()
+		c.keyPos = -1
+	}
+	return key
+}
+
+// resetCacheLocked заменяет кэш передачи, отпуская чанки прежнего.
+func (r *Room) resetCacheLocked(c *mediaCache) {
+	r.cache.release()
+	r.cache = c
+}
+
+// release отпускает закэшированные чанки. nil-безопасен.
+func (c *mediaCache) release() {
+	if c == nil {
+		return
+	}
+	for _, ch := range c.chunks {
+		ch.msg.Release()
+	}
+	c.chunks = nil
+	c.size = 0
+}
+
+// trimTo выбрасывает чанки до позиции pos; первый оставшийся чанк
+// обрезается так, чтобы начинаться ровно с pos.
+func (c *mediaCache) trimTo(pos int64) {
+	i := 0
+	for i < len(c.chunks) {
+		ch := c.chunks[i]
+		if ch.pos+int64(ch.msg.Len()-1) > pos {
+			break
+		}
+		c.size -= ch.msg.Len() - 1
+		ch.msg.Release()
+		i++
+	}
+	c.chunks = c.chunks[i:]
+
+	if len(c.chunks) > 0 && c.chunks[0].pos < pos {
+		ch := c.chunks[0]
+		off := 1 + int(pos-ch.pos)
+		src := ch.msg.Bytes()
+		trimmed := relay.Get(1 + len(src) - off)
+		trimmed.Bytes()[0] = src[0]
+		copy(trimmed.Bytes()[1:], src[off:])
+		ch.msg.Release()
+		c.size -= off - 1
+		c.chunks[0] = cachedChunk{pos: pos, msg: trimmed}
+	}
+	c.keyPos = pos
+}
+
+// replay собирает одно сообщение: init-сегмент и всё с последнего ключевого
+// фрагмента. MSE принимает данные, порезанные как угодно, поэтому склейка
+// безопасна и не зависит от размера буфера peer'а. nil — кэш не готов.
+// Буфер принадлежит вызывающему.
+func (c *mediaCache) replay() *relay.Buffer {
+	if !c.initDone || len(c.init) == 0 || c.keyPos < 0 || len(c.chunks) == 0 {
+		return nil
+	}
+
+	buf := relay.Get(1 + len(c.init) + c.size)
+	msg := buf.Bytes()[:1]
+	msg[0] = c.chunks[0].msg.Bytes()[0]
+	msg = append(msg, c.init...)
+	for _, ch := range c.chunks {
+		msg = append(msg, ch.msg.Bytes()[1:]...)
+	}
+	return buf
+}
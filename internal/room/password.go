@@ -0,0 +1,82 @@
+package room
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"sync"
+)
+
+// Пароль комнаты хэшируется PBKDF2-SHA256, а не bcrypt или argon2: они
+// есть только в golang.org/x/crypto, а сервер обходится стандартной
+// библиотекой (кроме WebSocket). crypto/pbkdf2 — в ней, и алгоритм
+// одобрен FIPS 140. Число итераций ниже рекомендации OWASP (600 000):
+// пароль живёт, пока в комнате кто-то есть, а вход не должен стоить
+// сотни миллисекунд CPU.
+const (
+	pbkdf2Iterations = 100_000
+	pbkdf2KeyLen     = 32
+	saltLen          = 16
+
+	// maxVerified — сколько подошедших паролей помнит passwordHash.
+	// Обычно это один пароль комнаты; предел — на всякий случай.
+	maxVerified = 8
+)
+
+// passwordHash — соль и производный ключ пароля комнаты. Сам пароль не хранится.
+type passwordHash struct {
+	salt []byte
+	key  []byte
+
+	// Подошедшие пароли — HMAC с ключом cacheKey: повторная проверка
+	// (каждый вход, каждый Range-запрос к записи) не считает PBKDF2 заново.
+	cacheKey []byte
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]struct{}
+}
+
+func newPasswordHash(password string) *passwordHash {
+	salt := make([]byte, saltLen)
+	rand.Read(salt)
+	cacheKey := make([]byte, 32)
+	rand.Read(cacheKey)
+	return &passwordHash{salt: salt, key: derive(password, salt), cacheKey: cacheKey}
+}
+
+// match сравнивает пароль с хэшем за постоянное время. Подошедший пароль
+// запоминается, и следующая его проверка обходится без PBKDF2.
+func (h *passwordHash) match(password string) bool {
+	mac := hmac.New(sha256.New, h.cacheKey)
+	mac.Write([]byte(password))
+	var tag [sha256.Size]byte
+	mac.Sum(tag[:0])
+
+	h.mu.Lock()
+	_, ok := h.verified[tag]
+	h.mu.Unlock()
+	if ok {
+		return true
+	}
+
+	if subtle.ConstantTimeCompare(derive(password, h.salt), h.key) != 1 {
+		return false
+	}
+	h.mu.Lock()
+	if h.verified == nil || len(h.verified) >= maxVerified {
+		h.verified = make(map[[sha256.Size]byte]struct{})
+	}
+	h.verified[tag] = struct{}{}
+	h.mu.Unlock()
+	return true
+}
+
+func derive(password string, salt []byte) []byte {
+	key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, pbkdf2KeyLen)
+	if err != nil {
+		// Возможно только при недопустимых параметрах (FIPS-режим) — это ошибка сборки.
+		panic("room: pbkdf2: " + err.Error())
+	}
+	return key
+}
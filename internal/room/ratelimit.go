@@ -0,0 +1,25 @@
+package room
+
+import "time"
+
+// tokenBucket ограничивает частоту действий участника: burst подряд,
+// дальше — rate в секунду. Вызывается под Room.mu.
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+func (b *tokenBucket) take(now time.Time, burst, rate float64) bool {
+	if b.at.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.at).Seconds()*rate)
+	}
+	b.at = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,79 @@
+package room
+
+import (
+	"errors"
+	"maps"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// reactionBurst — сколько реакций подряд можно отправить.
+	reactionBurst = 5
+	// reactionRate — сколько реакций в секунду восстанавливается.
+	reactionRate = 2.0
+	// maxReactionLen — эмодзи с модификаторами и ZWJ укладываются в 32 байта.
+	maxReactionLen = 32
+)
+
+var (
+	ErrNoTransmission = errors.New("room: nobody is talking")
+	ErrOwnReaction    = errors.New("room: talker cannot react to own transmission")
+	ErrBadReaction    = errors.New("room: reaction must be a short emoji")
+	ErrRateLimited    = errors.New("room: too many reactions")
+)
+
+// Reaction — реакция слушателя на текущую передачу.
+type Reaction struct {
+	Peer   *Peer
+	Emoji  string
+	Talker *Peer          // кому адресована
+	Counts map[string]int // итог по передаче, включая эту реакцию
+}
+
+// React учитывает реакцию p на текущую передачу. Реакции ограничены
+// по частоте для каждого участника и считаются по передаче: счётчики
+// сбрасываются, когда эфир получает новый talker.
+func (r *Room) React(p *Peer, emoji string) (Reaction, error) {
+	if !validReaction(emoji) {
+		return Reaction{}, ErrBadReaction
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case r.Talker == nil:
+		return Reaction{}, ErrNoTransmission
+	case r.Talker == p:
+		return Reaction{}, ErrOwnReaction
+	case !p.reactLimit.take(time.Now(), reactionBurst, reactionRate):
+		return Reaction{}, ErrRateLimited
+	}
+
+	if r.reactions == nil {
+		r.reactions = make(map[string]int)
+	}
+	r.reactions[emoji]++
+	return Reaction{
+		Peer:   p,
+		Emoji:  emoji,
+		Talker: r.Talker,
+		Counts: maps.Clone(r.reactions),
+	}, nil
+}
+
+// validReaction пропускает короткие строки из эмодзи: без букв, цифр,
+// ASCII и управляющих символов.
+func validReaction(s string) bool {
+	if s == "" || len(s) > maxReactionLen || !utf8.ValidString(s) {
+		return false
+	}
+	for _, c := range s {
+		if c < utf8.RuneSelf || unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.IsControl(c) || unicode.IsSpace(c) {
+			return false
+		}
+	}
+	return true
+}
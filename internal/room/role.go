@@ -0,0 +1,43 @@
+package room
+
+import "fmt"
+
+// Role — роль участника: может ли он говорить и кого может перебить.
+type Role string
+
+const (
+	RoleListener   Role = "listener"   // только слушает, эфир не получает
+	RoleMember     Role = "member"     // обычный участник (по умолчанию)
+	RoleDispatcher Role = "dispatcher" // перебивает member'ов
+	RoleAdmin      Role = "admin"      // перебивает всех, кроме других admin'ов
+)
+
+// ParseRole разбирает роль из токена или конфигурации; пустая строка — RoleMember.
+func ParseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case "":
+		return RoleMember, nil
+	case RoleListener, RoleMember, RoleDispatcher, RoleAdmin:
+		return r, nil
+	}
+	return "", fmt.Errorf("room: unknown role %q", s)
+}
+
+// Priority — приоритет роли в эфире: talker с меньшим приоритетом
+// уступает эфир по первому запросу.
+func (r Role) Priority() int {
+	switch r {
+	case RoleListener:
+		return 0
+	case RoleDispatcher:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 1
+}
+
+// CanTalk сообщает, может ли роль получать эфир.
+func (r Role) CanTalk() bool {
+	return r != RoleListener
+}
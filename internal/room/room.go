@@ -1,15 +1,57 @@
 package room
 
 import (
-	"log"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"teletalkie/internal/relay"
 )
 
+// ErrWrongPassword — пароль не подходит к комнате.
+var ErrWrongPassword = errors.New("room: wrong password")
+
+// ErrRoomFull — в комнате уже максимум участников (WithMaxPeers).
+var ErrRoomFull = errors.New("room: room is full")
+
+// minResumeTokenLen — короче токен легко угадать, такой не учитываем.
+const minResumeTokenLen = 16
+
 // Peer — участник комнаты.
 type Peer struct {
-	Name string
-	Room *Room
-	Send chan []byte // буфер исходящих сообщений, читается write-loop'ом в server
+	ID       string // выдаётся сервером; имена могут совпадать, ID — нет
+	Name     string
+	Role     Role
+	Priority int // приоритет в эфире, см. Role.Priority
+	Room     *Room
+	// Исходящие сообщения; обе очереди читает один write-loop в server,
+	// Control — в первую очередь.
+	Control chan []byte        // эфир, PEER_INFO, чат и прочее управляющее
+	Media   chan *relay.Buffer // медиа-чанки текущей передачи; прочитавший отпускает буфер
+
+	resumeToken string // секрет клиента, по которому он получает прежний ID
+
+	// Под Room.mu:
+	session    *Session    // текущее (или оборвавшееся) подключение
+	detached   bool        // соединение оборвалось, ждём переподключения
+	graceTimer *time.Timer // удалит участника, если он не вернётся
+	reactLimit tokenBucket // реакции
+	chatLimit  tokenBucket // сообщения чата
+
+	// Под Room.mu, см. sendMediaLocked:
+	mediaSkip      bool      // медиа пропускается до следующего ключевого фрагмента
+	mediaSkipInit  bool      // пропущена и часть init-сегмента
+	saturatedSince time.Time // с какого момента пропускается
+}
+
+// String — для логов: имя и ID.
+func (p *Peer) String() string {
+	return fmt.Sprintf("%q/%s", p.Name, p.ID)
 }
 
 // Room — комната с участниками и PTT-состоянием.
@@ -17,8 +59,35 @@ type Room struct {
 	ID     string
 	Talker *Peer // кто сейчас держит эфир (nil = свободен)
 
-	mu    sync.Mutex
-	peers map[*Peer]struct{}
+	mu       sync.Mutex
+	peers    map[*Peer]struct{}
+	cache    *mediaCache   // init-сегмент и последний ключевой фрагмент текущей передачи
+	password *passwordHash // nil — комната открытая; задаётся при создании и не меняется
+	maxPeers int           // 0 — без ограничения
+
+	hub       *Hub
+	log       *slog.Logger // с атрибутом room
+	queueMode bool         // занятый эфир ставит в очередь, а не отказывает
+	queue     []*Peer      // ждущие эфира, по порядку запроса
+
+	limits    TalkLimits
+	talkGen   uint64      // номер передачи: таймеры старых передач игнорируются
+	lastMedia time.Time   // когда от talker'а пришёл последний медиа-чанк
+	maxTimer  *time.Timer // TalkLimits.MaxTalk
+	idleTimer *time.Timer // TalkLimits.MediaIdle
+
+	chat      []ChatMessage  // последние ChatHistorySize сообщений
+	reactions map[string]int // реакции на текущую передачу
+
+	// resumeIDs — ID, выданные по resume-токенам (ключ — токен, имя и роль):
+	// клиент, вернувшийся с тем же токеном, получает прежний ID. Живёт,
+	// пока живёт комната.
+	resumeIDs map[string]string
+}
+
+// Private сообщает, защищена ли комната паролем.
+func (r *Room) Private() bool {
+	return r.password != nil
 }
 
 // Peers возвращает копию списка участников (потокобезопасно).
@@ -33,6 +102,13 @@ func (r *Room) Peers() []*Peer {
 	return out
 }
 
+// CurrentTalker возвращает текущего talker'а (потокобезопасно, nil = эфир свободен).
+func (r *Room) CurrentTalker() *Peer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Talker
+}
+
 // PeerCount возвращает количество участников.
 func (r *Room) PeerCount() int {
 	r.mu.Lock()
@@ -41,121 +117,478 @@ func (r *Room) PeerCount() int {
 }
 
 // Broadcast отправляет сообщение всем участникам комнаты, кроме sender.
-// Если канал peer'а полон — чанк дропается (неблокирующая отправка).
+// Отправка неблокирующая; участник, у которого буфер забит целиком,
+// отключается (см. sendLocked).
 func (r *Room) Broadcast(sender *Peer, msg []byte) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.broadcastLocked(sender, msg)
+}
 
+func (r *Room) broadcastLocked(sender *Peer, msg []byte) {
 	for p := range r.peers {
-		if p == sender {
+		if p == sender || p.detached {
 			continue
 		}
-		select {
-		case p.Send <- msg:
-		default:
-			log.Printf("room %s: dropping message for peer %q (buffer full)", r.ID, p.Name)
-		}
+		r.sendLocked(p, msg)
 	}
 }
 
-// TryAcquire пытается захватить эфир для peer'а.
-// Возвращает true если эфир свободен и успешно захвачен, false если занят.
-func (r *Room) TryAcquire(p *Peer) bool {
+// SendTo отправляет сообщение одному участнику. Если он уже покинул
+// комнату или переподключается — сообщение молча отбрасывается.
+func (r *Room) SendTo(p *Peer, msg []byte) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if _, ok := r.peers[p]; ok && !p.detached {
+		r.sendLocked(p, msg)
+	}
+}
 
-	if r.Talker != nil {
-		return false
+// sendLocked — управляющее сообщение. Их не теряем: если очередь Control
+// забита (а видео её не занимает), клиент безнадёжно отстал — отключаем
+// его, после переподключения он получит состояние заново.
+func (r *Room) sendLocked(p *Peer, msg []byte) {
+	select {
+	case p.Control <- msg:
+	default:
+		r.kickLocked(p, "control backlog")
 	}
-	r.Talker = p
-	log.Printf("room %s: %q acquired PTT", r.ID, p.Name)
-	return true
 }
 
-// Release освобождает эфир. Если peer не является текущим talker'ом — ничего не делает.
-func (r *Room) Release(p *Peer) {
+// BroadcastMedia рассылает медиа-сообщение talker'а всем, кроме него самого,
+// и запоминает init-сегмент и последний ключевой фрагмент для тех, кто
+// зайдёт посреди передачи. msg[0] — тип сообщения, msg[1:] — данные
+// контейнера. Сообщения не от текущего talker'а игнорируются — false;
+// проверка идёт под блокировкой комнаты, так что перехват эфира не
+// вклинится между ней и рассылкой.
+// Буфер не копируется: очереди слушателей и кэш берут на него свои
+// ссылки, ссылка вызывающего остаётся за ним.
+func (r *Room) BroadcastMedia(sender *Peer, msg *relay.Buffer) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if r.Talker != p {
-		return
+	if r.Talker != sender || msg.Len() < 2 {
+		return false
+	}
+	now := time.Now()
+	r.lastMedia = now
+	pos := r.cache.scan.Pos()
+	key := r.cache.add(msg)
+	// init-сегмент целиком лежит в предыдущих чанках — его получил всякий,
+	// кто не пропускал их.
+	hadInit := r.cache.initDone && int64(len(r.cache.init)) <= pos
+
+	for p := range r.peers {
+		if p == sender || p.detached {
+			continue
+		}
+		r.sendMediaLocked(p, msg, key, hadInit, now)
 	}
-	r.Talker = nil
-	log.Printf("room %s: %q released PTT", r.ID, p.Name)
+	return true
 }
 
-func (r *Room) addPeer(p *Peer) {
+// attach подключает клиента к комнате. Если в комнате уже есть участник
+// с тем же resume-токеном (переподключается или его старое соединение ещё
+// не закрылось), сессия подхватывает его — вместе с эфиром. Иначе создаётся
+// новый участник. nil — комната заполнена.
+func (r *Room) attach(o JoinOptions) *Session {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+
+	role := o.Role
+	if role == "" {
+		role = RoleMember
+	}
+	if p := r.peerByTokenLocked(o.ResumeToken, o.Name, role); p != nil {
+		return r.reattachLocked(p)
+	}
+	if r.maxPeers > 0 && len(r.peers) >= r.maxPeers {
+		return nil
+	}
+
+	p := &Peer{
+		ID:          r.assignIDLocked(o.ResumeToken, o.Name, role),
+		Name:        o.Name,
+		Role:        role,
+		Priority:    role.Priority(),
+		Room:        r,
+		Control:     make(chan []byte, controlBuffer),
+		Media:       make(chan *relay.Buffer, mediaBuffer),
+		resumeToken: o.ResumeToken,
+	}
+	p.session = newSession(p, false)
 	r.peers[p] = struct{}{}
+	r.replayLocked(p)
+	return p.session
+}
+
+// replayLocked — если идёт передача, новый слушатель первым сообщением
+// получает init-сегмент и последний ключевой фрагмент, а дальше live-чанки.
+func (r *Room) replayLocked(p *Peer) {
+	if r.cache == nil || r.Talker == p {
+		return
+	}
+	if msg := r.cache.replay(); msg != nil {
+		p.Media <- msg // канал пуст — не блокируется
+		r.log.Debug("replayed current transmission", "event", "media_replayed", "peer_id", p.ID, "peer", p.Name, "bytes", msg.Len()-1)
+	}
+}
+
+// assignIDLocked выдаёт ID: прежний для знакомого resume-токена с тем же
+// именем и ролью, иначе новый случайный.
+func (r *Room) assignIDLocked(token, name string, role Role) string {
+	if len(token) < minResumeTokenLen {
+		return randomID()
+	}
+	key := token + "\x00" + name + "\x00" + string(role)
+	if id, ok := r.resumeIDs[key]; ok {
+		return id
+	}
+	id := randomID()
+	r.resumeIDs[key] = id
+	return id
+}
+
+func randomID() string {
+	var b [6]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
 }
 
-func (r *Room) removePeer(p *Peer) (empty bool) {
+// removePeer убирает участника. Если s != nil — только если s всё ещё его
+// текущая сессия: участника могла подхватить новая. evs — события эфира
+// и очереди, которые нужно отправить после снятия блокировки.
+func (r *Room) removePeer(p *Peer, s *Session) (removed bool, evs []Event, empty bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if _, ok := r.peers[p]; !ok {
+		return false, nil, len(r.peers) == 0
+	}
+	if s != nil && p.session != s {
+		return false, nil, false
+	}
+	if p.graceTimer != nil {
+		p.graceTimer.Stop()
+		p.graceTimer = nil
+	}
 	delete(r.peers, p)
 	if r.Talker == p {
-		r.Talker = nil
+		evs = r.handOffLocked(p)
+	} else if r.dequeueLocked(p) {
+		evs = append(evs, Event{Type: EventQueueChanged, Room: r, Peer: p})
 	}
-	return len(r.peers) == 0
+	return true, evs, len(r.peers) == 0
 }
 
+// DefaultResumeGrace — сколько по умолчанию ждать переподключения участника.
+const DefaultResumeGrace = 15 * time.Second
+
 // Hub управляет всеми комнатами.
 type Hub struct {
-	mu    sync.Mutex
-	rooms map[string]*Room
+	mu          sync.Mutex
+	rooms       map[string]*Room
+	grace       time.Duration
+	floorQueue  bool
+	limits      TalkLimits
+	roomLimits  map[string]TalkLimits
+	maxPeers    int
+	roomPeers   map[string]int           // WithRoomMaxPeers
+	passwords   map[string]*passwordHash // WithRoomPassword
+	onEvent     func(Event)
+	log         *slog.Logger
+	slowTimeout time.Duration
+	dropped     atomic.Uint64 // медиа-чанки, пропущенные не успевающим слушателям
+	kicked      atomic.Uint64 // отключённые за отставание
+}
+
+// Option — опция Hub для NewHub.
+type Option func(*Hub)
+
+// WithResumeGrace задаёт, сколько участник с оборвавшимся соединением
+// остаётся в комнате (вместе с эфиром), ожидая переподключения.
+// 0 — участник уходит сразу.
+func WithResumeGrace(d time.Duration) Option {
+	return func(h *Hub) {
+		h.grace = d
+	}
+}
+
+// WithFloorQueue включает очередь на эфир: PTT_ON при занятом эфире ставит
+// участника в очередь, и эфир переходит к нему автоматически.
+func WithFloorQueue(enabled bool) Option {
+	return func(h *Hub) {
+		h.floorQueue = enabled
+	}
+}
+
+// WithTalkLimits задаёт ограничения передачи для всех комнат.
+func WithTalkLimits(l TalkLimits) Option {
+	return func(h *Hub) {
+		h.limits = l
+	}
+}
+
+// WithRoomTalkLimits задаёт ограничения передачи для одной комнаты
+// вместо общих WithTalkLimits.
+func WithRoomTalkLimits(roomID string, l TalkLimits) Option {
+	return func(h *Hub) {
+		h.roomLimits[roomID] = l
+	}
+}
+
+// WithMaxPeers ограничивает число участников в комнате (вместе с
+// ожидающими переподключения); сверх него Join возвращает ErrRoomFull.
+// 0 — без ограничения.
+func WithMaxPeers(n int) Option {
+	return func(h *Hub) {
+		h.maxPeers = n
+	}
+}
+
+// WithRoomMaxPeers задаёт ограничение числа участников для одной комнаты
+// вместо общего WithMaxPeers.
+func WithRoomMaxPeers(roomID string, n int) Option {
+	return func(h *Hub) {
+		h.roomPeers[roomID] = n
+	}
+}
+
+// WithRoomPassword делает комнату приватной с заданным паролем: пароль
+// проверяется у каждого входящего, в том числе у того, кто создаёт
+// комнату, а пароль из JoinOptions его не заменяет.
+func WithRoomPassword(roomID, password string) Option {
+	hash := newPasswordHash(password)
+	return func(h *Hub) {
+		h.passwords[roomID] = hash
+	}
+}
+
+// WithSlowConsumerTimeout задаёт, сколько слушатель может не успевать за
+// медиапотоком (получая его с пропусками), прежде чем его отключат.
+// 0 — отключать только при переполнении буфера управляющими сообщениями.
+func WithSlowConsumerTimeout(d time.Duration) Option {
+	return func(h *Hub) {
+		h.slowTimeout = d
+	}
+}
+
+// WithLogger задаёт логгер hub'а и его комнат (по умолчанию slog.Default()).
+func WithLogger(l *slog.Logger) Option {
+	return func(h *Hub) {
+		h.log = l
+	}
 }
 
 // NewHub создаёт новый Hub.
-func NewHub() *Hub {
-	return &Hub{
-		rooms: make(map[string]*Room),
+func NewHub(opts ...Option) *Hub {
+	h := &Hub{
+		rooms:       make(map[string]*Room),
+		grace:       DefaultResumeGrace,
+		slowTimeout: DefaultSlowConsumerTimeout,
+		log:         slog.Default(),
+		roomLimits:  make(map[string]TalkLimits),
+		roomPeers:   make(map[string]int),
+		passwords:   make(map[string]*passwordHash),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// JoinOptions — параметры входа в комнату.
+type JoinOptions struct {
+	Name string
+	// Role — роль участника; пустая — RoleMember.
+	Role Role
+	// ResumeToken — секрет, сгенерированный клиентом. С тем же токеном,
+	// именем и ролью клиент после переподключения возвращается к своему
+	// участнику (если тот ещё в комнате) или хотя бы получает прежний ID.
+	ResumeToken string
+	// Password — пароль комнаты. Если комната создаётся этим входом, пароль
+	// становится её паролем (пустой — комната открытая). Для существующей
+	// приватной комнаты пароль должен совпасть, а в открытую с паролем не
+	// пускают — иначе ErrWrongPassword.
+	Password string
+}
+
+func (h *Hub) talkLimits(roomID string) TalkLimits {
+	if l, ok := h.roomLimits[roomID]; ok {
+		return l
+	}
+	return h.limits
+}
+
+func (h *Hub) maxPeersFor(roomID string) int {
+	if n, ok := h.roomPeers[roomID]; ok {
+		return n
 	}
+	return h.maxPeers
 }
 
-// Join добавляет участника в комнату (создаёт комнату если не существует).
-func (h *Hub) Join(roomID, name string) *Peer {
+// Rooms возвращает снимок списка комнат.
+func (h *Hub) Rooms() []*Room {
 	h.mu.Lock()
-	r, ok := h.rooms[roomID]
-	if !ok {
-		r = &Room{
-			ID:    roomID,
-			peers: make(map[*Peer]struct{}),
-		}
-		h.rooms[roomID] = r
-		log.Printf("hub: created room %q", roomID)
+	defer h.mu.Unlock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, r := range h.rooms {
+		rooms = append(rooms, r)
 	}
-	h.mu.Unlock()
+	return rooms
+}
 
-	p := &Peer{
-		Name: name,
-		Room: r,
-		Send: make(chan []byte, 64),
+// Dropped возвращает, сколько медиа-чанков пропущено не успевающим
+// слушателям (с момента запуска, по всем комнатам).
+func (h *Hub) Dropped() uint64 {
+	return h.dropped.Load()
+}
+
+// SlowConsumerKicks возвращает, сколько сессий закрыто из-за отставания.
+func (h *Hub) SlowConsumerKicks() uint64 {
+	return h.kicked.Load()
+}
+
+// Join подключает клиента к комнате (создаёт комнату если не существует).
+func (h *Hub) Join(roomID string, o JoinOptions) (*Session, error) {
+	// Заданный пароль проверяем сразу: неудачная попытка не должна
+	// создавать комнату.
+	preset := h.passwords[roomID]
+	if preset != nil && !preset.match(o.Password) {
+		h.log.Warn("wrong room password", "event", "wrong_password", "room", roomID, "peer", o.Name)
+		return nil, ErrWrongPassword
 	}
 
-	r.addPeer(p)
-	log.Printf("hub: %q joined room %q (%d peers)", name, roomID, r.PeerCount())
+	// Хэширование дорогое — считаем его без блокировки hub'а и только
+	// когда вход создаёт комнату, а затем повторяем поиск: пока считали,
+	// комнату могли создать или удалить.
+	var hash *passwordHash
+	var verified *Room
+	for {
+		h.mu.Lock()
+		r, ok := h.rooms[roomID]
+		if !ok {
+			if preset == nil && o.Password != "" && hash == nil {
+				h.mu.Unlock()
+				hash = newPasswordHash(o.Password)
+				continue
+			}
+			if preset != nil {
+				hash = preset
+			}
+			r = &Room{
+				ID:        roomID,
+				peers:     make(map[*Peer]struct{}),
+				password:  hash,
+				hub:       h,
+				log:       h.log.With("room", roomID),
+				queueMode: h.floorQueue,
+				limits:    h.talkLimits(roomID),
+				maxPeers:  h.maxPeersFor(roomID),
+				resumeIDs: make(map[string]string),
+			}
+			h.rooms[roomID] = r
+			r.log.Info("room created", "event", "room_created", "private", r.Private())
+		}
+
+		switch {
+		case r.password == nil && o.Password != "":
+			// Клиент считает комнату приватной, а она открытая: молча
+			// пустить — значит дать ему говорить не там, где он думает.
+			h.mu.Unlock()
+			h.log.Warn("password for an open room", "event", "wrong_password", "room", roomID, "peer", o.Name)
+			return nil, ErrWrongPassword
+		case r.password == nil || r == verified || !ok || preset != nil:
+			sess, err := h.attach(r, o)
+			h.mu.Unlock()
+			return sess, err
+		}
+		h.mu.Unlock()
 
-	return p
+		// Проверяем пароль без блокировки hub'а и повторяем поиск:
+		// пока считали, комнату могли удалить и создать заново.
+		if !r.password.match(o.Password) {
+			h.log.Warn("wrong room password", "event", "wrong_password", "room", roomID, "peer", o.Name)
+			return nil, ErrWrongPassword
+		}
+		verified = r
+	}
+}
+
+// CheckPassword проверяет пароль комнаты вне входа — например, для
+// доступа к её записям. private — комната с паролем: заданным
+// WithRoomPassword или у открытой сейчас комнаты. Для остальных пароль
+// не проверяется.
+func (h *Hub) CheckPassword(roomID, password string) (private bool, err error) {
+	hash := h.passwords[roomID]
+	if hash == nil {
+		h.mu.Lock()
+		if r, ok := h.rooms[roomID]; ok {
+			hash = r.password
+		}
+		h.mu.Unlock()
+	}
+	if hash == nil {
+		return false, nil
+	}
+	if !hash.match(password) {
+		return true, ErrWrongPassword
+	}
+	return true, nil
+}
+
+// attach подключает клиента к комнате. Вызывается под h.mu, чтобы
+// Leave не удалил комнату между поиском и добавлением.
+func (h *Hub) attach(r *Room, o JoinOptions) (*Session, error) {
+	sess := r.attach(o)
+	if sess == nil {
+		r.log.Warn("room is full", "event", "room_full", "peer", o.Name, "peers", r.PeerCount())
+		return nil, ErrRoomFull
+	}
+	if sess.Resumed {
+		r.log.Info("peer resumed", "event", "peer_resumed", "peer_id", sess.Peer.ID, "peer", sess.Peer.Name)
+	} else {
+		r.log.Info("peer joined", "event", "peer_joined", "peer_id", sess.Peer.ID, "peer", sess.Peer.Name, "role", string(sess.Peer.Role), "peers", r.PeerCount())
+	}
+	return sess, nil
 }
 
 // Leave убирает участника из комнаты. Если комната пустая — удаляет её.
+// Если участник держал эфир, эфир освобождается (EventFloorReleased)
+// и в режиме очереди переходит следующему.
 func (h *Hub) Leave(p *Peer) {
+	h.leave(p, nil)
+}
+
+func (h *Hub) leave(p *Peer, s *Session) {
 	r := p.Room
 
-	empty := r.removePeer(p)
-	close(p.Send)
+	removed, evs, empty := r.removePeer(p, s)
+	if !removed {
+		return
+	}
+	close(p.Control)
+	close(p.Media)
+	// Что осталось в очереди, write-loop уже не прочитает (или прочитает
+	// не всё) — отпускаем, иначе буферы не вернутся в пул.
+	for msg := range p.Media {
+		msg.Release()
+	}
 
-	log.Printf("hub: %q left room %q (%d peers)", p.Name, r.ID, r.PeerCount())
+	r.log.Info("peer left", "event", "peer_left", "peer_id", p.ID, "peer", p.Name, "peers", r.PeerCount())
 
 	if empty {
 		h.mu.Lock()
 		// Повторная проверка — вдруг кто-то успел зайти
-		if r.PeerCount() == 0 {
+		if r.PeerCount() == 0 && h.rooms[r.ID] == r {
 			delete(h.rooms, r.ID)
-			log.Printf("hub: deleted empty room %q", r.ID)
+			r.log.Info("room deleted", "event", "room_deleted")
 		}
 		h.mu.Unlock()
 	}
+
+	for _, ev := range evs {
+		h.emit(ev)
+	}
+	h.emit(Event{Type: EventLeft, Room: r, Peer: p})
 }
@@ -1,10 +1,30 @@
 package room
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"teletalkie/internal/media/mediatest"
+	"teletalkie/internal/relay"
+)
+
+func join(t *testing.T, h *Hub, roomID, name string) *Peer {
+	t.Helper()
+	s, err := h.Join(roomID, JoinOptions{Name: name})
+	if err != nil {
+		t.Fatalf("join %s: %v", name, err)
+	}
+	return s.Peer
+}
 
 func TestTryAcquire_Success(t *testing.T) {
 	h := NewHub()
-	p := h.Join("test", "alice")
+	p := join(t, h, "test", "alice")
 	defer h.Leave(p)
 
 	if !p.Room.TryAcquire(p) {
@@ -17,8 +37,8 @@ func TestTryAcquire_Success(t *testing.T) {
 
 func TestTryAcquire_Denied(t *testing.T) {
 	h := NewHub()
-	p1 := h.Join("test", "alice")
-	p2 := h.Join("test", "bob")
+	p1 := join(t, h, "test", "alice")
+	p2 := join(t, h, "test", "bob")
 	defer h.Leave(p1)
 	defer h.Leave(p2)
 
@@ -35,8 +55,8 @@ func TestTryAcquire_Denied(t *testing.T) {
 
 func TestRelease(t *testing.T) {
 	h := NewHub()
-	p1 := h.Join("test", "alice")
-	p2 := h.Join("test", "bob")
+	p1 := join(t, h, "test", "alice")
+	p2 := join(t, h, "test", "bob")
 	defer h.Leave(p1)
 	defer h.Leave(p2)
 
@@ -58,8 +78,8 @@ func TestRelease(t *testing.T) {
 
 func TestRelease_WrongPeer(t *testing.T) {
 	h := NewHub()
-	p1 := h.Join("test", "alice")
-	p2 := h.Join("test", "bob")
+	p1 := join(t, h, "test", "alice")
+	p2 := join(t, h, "test", "bob")
 	defer h.Leave(p1)
 	defer h.Leave(p2)
 
@@ -73,8 +93,8 @@ func TestRelease_WrongPeer(t *testing.T) {
 
 func TestLeave_ReleasesPTT(t *testing.T) {
 	h := NewHub()
-	p1 := h.Join("test", "alice")
-	p2 := h.Join("test", "bob")
+	p1 := join(t, h, "test", "alice")
+	p2 := join(t, h, "test", "bob")
 
 	p1.Room.TryAcquire(p1)
 	r := p1.Room
@@ -93,9 +113,9 @@ func TestLeave_ReleasesPTT(t *testing.T) {
 
 func TestBroadcast_SkipsSender(t *testing.T) {
 	h := NewHub()
-	p1 := h.Join("test", "alice")
-	p2 := h.Join("test", "bob")
-	p3 := h.Join("test", "carol")
+	p1 := join(t, h, "test", "alice")
+	p2 := join(t, h, "test", "bob")
+	p3 := join(t, h, "test", "carol")
 	defer h.Leave(p1)
 	defer h.Leave(p2)
 	defer h.Leave(p3)
@@ -105,7 +125,7 @@ func TestBroadcast_SkipsSender(t *testing.T) {
 
 	// p2 and p3 should receive the message
 	select {
-	case got := <-p2.Send:
+	case got := <-p2.Control:
 		if string(got) != "hello" {
 			t.Fatalf("p2 got %q, want %q", got, "hello")
 		}
@@ -114,7 +134,7 @@ func TestBroadcast_SkipsSender(t *testing.T) {
 	}
 
 	select {
-	case got := <-p3.Send:
+	case got := <-p3.Control:
 		if string(got) != "hello" {
 			t.Fatalf("p3 got %q, want %q", got, "hello")
 		}
@@ -124,9 +144,845 @@ func TestBroadcast_SkipsSender(t *testing.T) {
 
 	// p1 (sender) should NOT receive
 	select {
-	case <-p1.Send:
+	case <-p1.Control:
 		t.Fatal("sender should not receive own broadcast")
 	default:
 		// ok
 	}
 }
+
+func TestBroadcastMedia_ReplaysToLateJoiner(t *testing.T) {
+	h := NewHub()
+	alice := join(t, h, "test", "alice")
+	defer h.Leave(alice)
+
+	init := mediatest.WebMInit()
+	c1 := mediatest.WebMCluster(true, 0x11)
+	c2 := mediatest.WebMCluster(false, 0x22)
+	c3 := mediatest.WebMCluster(true, 0x33)
+	c4 := mediatest.WebMCluster(false, 0x44)
+
+	// MediaRecorder режет поток где угодно — в том числе посреди кластера.
+	chunks := [][]byte{
+		slices.Concat(init, c1[:5]),
+		slices.Concat(c1[5:], c2, c3[:20]),
+		slices.Concat(c3[20:], c4),
+	}
+
+	alice.Room.TryAcquire(alice)
+	for _, c := range chunks {
+		alice.Room.BroadcastMedia(alice, relay.Wrap(append([]byte{0x13}, c...)))
+	}
+
+	bob := join(t, h, "test", "bob")
+	defer h.Leave(bob)
+
+	select {
+	case got := <-bob.Media:
+		want := slices.Concat([]byte{0x13}, init, c3, c4)
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("bob got %d bytes of replay, want init + last keyframe cluster (%d bytes)", got.Len(), len(want))
+		}
+	default:
+		t.Fatal("expected bob to receive replay of current transmission")
+	}
+
+	// После release кэш сброшен — новый участник ничего не получает.
+	alice.Room.Release(alice)
+	carol := join(t, h, "test", "carol")
+	defer h.Leave(carol)
+
+	select {
+	case got := <-carol.Media:
+		t.Fatalf("carol should not receive replay after release, got %d bytes", got.Len())
+	default:
+	}
+}
+
+func TestLeave_ReleasesQueuedMedia(t *testing.T) {
+	h := NewHub()
+	alice := join(t, h, "test", "alice")
+	bob := join(t, h, "test", "bob")
+	defer h.Leave(alice)
+
+	alice.Room.TryAcquire(alice)
+	buf := relay.Get(2)
+	buf.Bytes()[0], buf.Bytes()[1] = 0x13, 0x01
+	alice.Room.BroadcastMedia(alice, buf)
+	buf.Release()
+	alice.Room.Release(alice)
+
+	// bob уходит, не прочитав очередь: последняя ссылка — его, и буфер
+	// возвращается в пул (Release обнуляет длину).
+	h.Leave(bob)
+	if buf.Len() != 0 {
+		t.Fatal("media queued for a departed peer was not released")
+	}
+}
+
+func TestBroadcastMedia_IgnoresNonTalker(t *testing.T) {
+	h := NewHub()
+	p1 := join(t, h, "test", "alice")
+	p2 := join(t, h, "test", "bob")
+	defer h.Leave(p1)
+	defer h.Leave(p2)
+
+	p1.Room.TryAcquire(p1)
+	if p2.Room.BroadcastMedia(p2, relay.Wrap([]byte{0x13, 0x01})) {
+		t.Fatal("media from non-talker must not be accepted")
+	}
+
+	select {
+	case <-p1.Media:
+		t.Fatal("media from non-talker should not be relayed")
+	default:
+	}
+}
+
+func TestJoin_PrivateRoom(t *testing.T) {
+	h := NewHub()
+	sess, err := h.Join("secret", JoinOptions{Name: "alice", Password: "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := sess.Peer
+	if !alice.Room.Private() {
+		t.Fatal("expected room created with password to be private")
+	}
+
+	for _, pw := range []string{"", "wrong"} {
+		if _, err := h.Join("secret", JoinOptions{Name: "mallory", Password: pw}); !errors.Is(err, ErrWrongPassword) {
+			t.Fatalf("password %q: expected ErrWrongPassword, got %v", pw, err)
+		}
+	}
+	if n := alice.Room.PeerCount(); n != 1 {
+		t.Fatalf("rejected peers must not be added, got %d peers", n)
+	}
+
+	sess, err = h.Join("secret", JoinOptions{Name: "bob", Password: "hunter2"})
+	if err != nil {
+		t.Fatalf("expected bob to join with correct password: %v", err)
+	}
+	bob := sess.Peer
+	if bob.Room != alice.Room {
+		t.Fatal("expected bob in the same room")
+	}
+
+	// Комната удаляется вместе с последним участником — и пароль вместе с ней.
+	h.Leave(alice)
+	h.Leave(bob)
+	carol := join(t, h, "secret", "carol")
+	defer h.Leave(carol)
+	if carol.Room.Private() {
+		t.Fatal("expected re-created room to be open")
+	}
+}
+
+func TestJoin_PasswordForOpenRoom(t *testing.T) {
+	h := NewHub()
+	alice := join(t, h, "lobby", "alice")
+	defer h.Leave(alice)
+
+	// Клиент с паролем думает, что входит в приватную комнату, — в
+	// открытую его не пускают, пароль молча не выбрасывается.
+	if _, err := h.Join("lobby", JoinOptions{Name: "bob", Password: "hunter2"}); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("expected ErrWrongPassword, got %v", err)
+	}
+	if alice.Room.Private() || alice.Room.PeerCount() != 1 {
+		t.Fatalf("room must stay open with one peer: private=%v, peers=%d", alice.Room.Private(), alice.Room.PeerCount())
+	}
+}
+
+func TestJoin_PresetPassword(t *testing.T) {
+	h := NewHub(WithRoomPassword("ops", "hunter2"))
+
+	// Даже первый вход проверяется, а неудачный не создаёт комнату.
+	if _, err := h.Join("ops", JoinOptions{Name: "mallory", Password: "letmein"}); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("expected ErrWrongPassword, got %v", err)
+	}
+	if n := len(h.Rooms()); n != 0 {
+		t.Fatalf("failed join must not create the room, got %d rooms", n)
+	}
+
+	sess, err := h.Join("ops", JoinOptions{Name: "alice", Password: "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Leave(sess.Peer)
+	if !sess.Peer.Room.Private() {
+		t.Fatal("expected preset room to be private")
+	}
+	if _, err := h.Join("open", JoinOptions{Name: "bob"}); err != nil {
+		t.Fatalf("other rooms stay open: %v", err)
+	}
+}
+
+func TestJoin_MaxPeers(t *testing.T) {
+	h := NewHub(WithMaxPeers(2), WithRoomMaxPeers("big", 3))
+	alice, err := h.Join("test", JoinOptions{Name: "alice", ResumeToken: "alice-resume-token-0001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	join(t, h, "test", "bob")
+
+	if _, err := h.Join("test", JoinOptions{Name: "carol"}); !errors.Is(err, ErrRoomFull) {
+		t.Fatalf("expected ErrRoomFull, got %v", err)
+	}
+	// Переподключение занимает прежнее место.
+	if _, err := h.Join("test", JoinOptions{Name: "alice", ResumeToken: "alice-resume-token-0001"}); err != nil {
+		t.Fatalf("resume must not count against the limit: %v", err)
+	}
+	h.Leave(alice.Peer)
+	join(t, h, "test", "carol")
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		join(t, h, "big", name)
+	}
+}
+
+func TestJoin_AssignsUniqueIDs(t *testing.T) {
+	h := NewHub()
+	a1 := join(t, h, "room1", "alice")
+	a2 := join(t, h, "room1", "alice")
+
+	if a1.ID == "" || a1.ID == a2.ID {
+		t.Fatalf("expected distinct non-empty IDs for same-name peers, got %q and %q", a1.ID, a2.ID)
+	}
+}
+
+func TestJoin_ResumeTokenKeepsID(t *testing.T) {
+	h := NewHub()
+	alice := join(t, h, "room1", "alice")
+	defer h.Leave(alice)
+
+	const tok = "0123456789abcdef0123"
+	bob, err := h.Join("room1", JoinOptions{Name: "bob", ResumeToken: tok})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := bob.Peer.ID
+	h.Leave(bob.Peer)
+
+	// Участник ушёл, но комната жива — с тем же токеном выдаётся прежний ID.
+	again, err := h.Join("room1", JoinOptions{Name: "bob", ResumeToken: tok})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Leave(again.Peer)
+	if again.Resumed || again.Peer.ID != id {
+		t.Fatalf("expected new peer with ID %q, got %q (resumed %v)", id, again.Peer.ID, again.Resumed)
+	}
+}
+
+func TestJoin_ResumeTokenOfAnotherIdentity(t *testing.T) {
+	h := NewHub(WithResumeGrace(time.Minute))
+	const tok = "0123456789abcdef0123"
+	sess, err := h.Join("room1", JoinOptions{Name: "boss", Role: RoleDispatcher, ResumeToken: tok})
+	if err != nil {
+		t.Fatal(err)
+	}
+	boss := sess.Peer
+	defer h.Leave(boss)
+	boss.Room.TryAcquire(boss)
+	h.Disconnect(sess, true)
+
+	// Токен утёк: слушатель и другое имя с ним — новые участники, без
+	// чужой роли, ID и эфира.
+	for _, o := range []JoinOptions{
+		{Name: "boss", Role: RoleListener, ResumeToken: tok},
+		{Name: "mallory", Role: RoleDispatcher, ResumeToken: tok},
+	} {
+		s, err := h.Join("room1", o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Leave(s.Peer)
+		if s.Resumed || s.Peer == boss || s.Peer.ID == boss.ID || s.Peer.Role != o.Role {
+			t.Fatalf("%s/%s: resumed=%v id=%s role=%s, want a fresh peer", o.Name, o.Role, s.Resumed, s.Peer.ID, s.Peer.Role)
+		}
+	}
+	if !boss.Reconnecting() || boss.Room.CurrentTalker() != boss {
+		t.Fatal("the original peer must keep waiting with the floor")
+	}
+
+	back, err := h.Join("room1", JoinOptions{Name: "boss", Role: RoleDispatcher, ResumeToken: tok})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !back.Resumed || back.Peer != boss {
+		t.Fatal("the owner of the token must still resume")
+	}
+}
+
+// events собирает события hub'а в канал.
+func events(h *Hub) <-chan Event {
+	ch := make(chan Event, 16)
+	h.SetEventHandler(func(ev Event) { ch <- ev })
+	return ch
+}
+
+func expectEvent(t *testing.T, ch <-chan Event, want EventType) Event {
+	t.Helper()
+	select {
+	case ev := <-ch:
+		if ev.Type != want {
+			t.Fatalf("expected event %d, got %d", want, ev.Type)
+		}
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for event %d", want)
+		return Event{}
+	}
+}
+
+func TestDisconnect_ResumeKeepsFloor(t *testing.T) {
+	h := NewHub(WithResumeGrace(time.Minute))
+	evs := events(h)
+	alice := join(t, h, "room1", "alice")
+	defer h.Leave(alice)
+
+	const tok = "0123456789abcdef0123"
+	bob, _ := h.Join("room1", JoinOptions{Name: "bob", ResumeToken: tok})
+	bob.Peer.Room.TryAcquire(bob.Peer)
+	expectEvent(t, evs, EventFloorGranted)
+
+	h.Disconnect(bob, true)
+	expectEvent(t, evs, EventDisconnected)
+	if !bob.Peer.Reconnecting() || bob.Peer.Room.CurrentTalker() != bob.Peer {
+		t.Fatal("expected bob to keep the floor while reconnecting")
+	}
+
+	resumed, err := h.Join("room1", JoinOptions{Name: "bob", ResumeToken: tok})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed.Resumed || resumed.Peer != bob.Peer || resumed.Peer.Reconnecting() {
+		t.Fatal("expected the same peer to be resumed")
+	}
+	if alice.Room.CurrentTalker() != bob.Peer {
+		t.Fatal("expected floor to survive the reconnect")
+	}
+
+	// Сессия, которую подхватила новая, больше ни на что не влияет.
+	h.Disconnect(bob, false)
+	if alice.Room.PeerCount() != 2 {
+		t.Fatal("stale session must not remove the resumed peer")
+	}
+	h.Leave(resumed.Peer)
+}
+
+func TestDisconnect_TakeoverClosesOldSession(t *testing.T) {
+	h := NewHub()
+	const tok = "0123456789abcdef0123"
+	old, _ := h.Join("room1", JoinOptions{Name: "bob", ResumeToken: tok})
+
+	// Сервер ещё не заметил обрыв, а клиент уже переподключился.
+	cur, _ := h.Join("room1", JoinOptions{Name: "bob", ResumeToken: tok})
+	defer h.Leave(cur.Peer)
+	if cur.Peer != old.Peer {
+		t.Fatal("expected the same peer")
+	}
+	select {
+	case <-old.Done():
+	default:
+		t.Fatal("expected the old session to be closed")
+	}
+}
+
+func TestDisconnect_GraceExpiry(t *testing.T) {
+	h := NewHub(WithResumeGrace(10 * time.Millisecond))
+	evs := events(h)
+	alice := join(t, h, "room1", "alice")
+	defer h.Leave(alice)
+
+	bob, _ := h.Join("room1", JoinOptions{Name: "bob", ResumeToken: "0123456789abcdef0123"})
+	bob.Peer.Room.TryAcquire(bob.Peer)
+	expectEvent(t, evs, EventFloorGranted)
+	h.Disconnect(bob, true)
+
+	expectEvent(t, evs, EventDisconnected)
+	expectEvent(t, evs, EventFloorReleased)
+	expectEvent(t, evs, EventLeft)
+	if alice.Room.CurrentTalker() != nil || alice.Room.PeerCount() != 1 {
+		t.Fatal("expected bob removed and floor released after grace")
+	}
+}
+
+func TestRequestFloor_Queue(t *testing.T) {
+	h := NewHub(WithFloorQueue(true))
+	alice := join(t, h, "room1", "alice")
+	bob := join(t, h, "room1", "bob")
+	carol := join(t, h, "room1", "carol")
+	r := alice.Room
+
+	if granted, _ := r.RequestFloor(alice); !granted {
+		t.Fatal("expected alice to get the free floor")
+	}
+	if granted, pos := r.RequestFloor(bob); granted || pos != 1 {
+		t.Fatalf("bob: expected queue position 1, got granted=%v pos=%d", granted, pos)
+	}
+	if _, pos := r.RequestFloor(carol); pos != 2 {
+		t.Fatalf("carol: expected queue position 2, got %d", pos)
+	}
+	if _, pos := r.RequestFloor(bob); pos != 1 {
+		t.Fatalf("bob: repeated request must keep position 1, got %d", pos)
+	}
+
+	// Освобождение эфира отдаёт его первому в очереди.
+	r.Release(alice)
+	if r.CurrentTalker() != bob {
+		t.Fatal("expected floor handed off to bob")
+	}
+	if q := r.Queue(); len(q) != 1 || q[0] != carol {
+		t.Fatalf("expected carol alone in queue, got %v", q)
+	}
+
+	// Выход из очереди (PTT_OFF до получения эфира).
+	if r.Release(carol) {
+		t.Fatal("queued peer must not release the floor")
+	}
+	if len(r.Queue()) != 0 {
+		t.Fatal("expected carol removed from queue")
+	}
+
+	// Уход talker'а тоже передаёт эфир по очереди.
+	r.RequestFloor(carol)
+	h.Leave(bob)
+	if r.CurrentTalker() != carol {
+		t.Fatal("expected floor handed off to carol when bob left")
+	}
+}
+
+func TestRequestFloor_NoQueue(t *testing.T) {
+	h := NewHub()
+	alice := join(t, h, "room1", "alice")
+	bob := join(t, h, "room1", "bob")
+
+	alice.Room.RequestFloor(alice)
+	if granted, pos := alice.Room.RequestFloor(bob); granted || pos != 0 {
+		t.Fatalf("expected plain denial without queue mode, got granted=%v pos=%d", granted, pos)
+	}
+	if len(alice.Room.Queue()) != 0 {
+		t.Fatal("expected empty queue")
+	}
+}
+
+func TestTalkLimits_MaxTalk(t *testing.T) {
+	h := NewHub(WithTalkLimits(TalkLimits{MaxTalk: 20 * time.Millisecond}))
+	evs := events(h)
+	alice := join(t, h, "room1", "alice")
+	defer h.Leave(alice)
+
+	alice.Room.TryAcquire(alice)
+	expectEvent(t, evs, EventFloorGranted)
+
+	ev := expectEvent(t, evs, EventFloorRevoked)
+	if ev.Peer != alice || ev.Reason != RevokeMaxTalk {
+		t.Fatalf("expected alice revoked for max talk, got %v %v", ev.Peer, ev.Reason)
+	}
+	expectEvent(t, evs, EventFloorReleased)
+	if alice.Room.CurrentTalker() != nil {
+		t.Fatal("expected floor free after revoke")
+	}
+}
+
+func TestTalkLimits_MediaIdle(t *testing.T) {
+	h := NewHub(WithRoomTalkLimits("room1", TalkLimits{MediaIdle: 50 * time.Millisecond}))
+	evs := events(h)
+	alice := join(t, h, "room1", "alice")
+	defer h.Leave(alice)
+	r := alice.Room
+
+	r.TryAcquire(alice)
+	expectEvent(t, evs, EventFloorGranted)
+
+	// Пока медиа идёт, эфир не отбирается.
+	chunk := relay.Wrap(slices.Concat([]byte{0x13}, mediatest.WebMInit()))
+	for range 5 {
+		time.Sleep(20 * time.Millisecond)
+		r.BroadcastMedia(alice, chunk)
+	}
+	if r.CurrentTalker() != alice {
+		t.Fatal("floor must stay while media is flowing")
+	}
+
+	ev := expectEvent(t, evs, EventFloorRevoked)
+	if ev.Reason != RevokeMediaIdle {
+		t.Fatalf("expected media idle reason, got %v", ev.Reason)
+	}
+	expectEvent(t, evs, EventFloorReleased)
+}
+
+func TestTalkLimits_OtherRoomUnaffected(t *testing.T) {
+	h := NewHub(WithRoomTalkLimits("strict", TalkLimits{MaxTalk: time.Millisecond}))
+	alice := join(t, h, "lenient", "alice")
+	defer h.Leave(alice)
+
+	alice.Room.TryAcquire(alice)
+	time.Sleep(20 * time.Millisecond)
+	if alice.Room.CurrentTalker() != alice {
+		t.Fatal("limits of another room must not apply")
+	}
+}
+
+func TestRequestFloor_Preemption(t *testing.T) {
+	h := NewHub(WithFloorQueue(true))
+	evs := events(h)
+	member := join(t, h, "room1", "alice")
+	sess, _ := h.Join("room1", JoinOptions{Name: "dispatch", Role: RoleDispatcher})
+	disp := sess.Peer
+	r := member.Room
+
+	r.RequestFloor(member)
+	expectEvent(t, evs, EventFloorGranted)
+
+	if granted, _ := r.RequestFloor(disp); !granted {
+		t.Fatal("expected dispatcher to pre-empt member")
+	}
+	ev := expectEvent(t, evs, EventFloorPreempted)
+	if ev.Peer != member || ev.By != disp {
+		t.Fatalf("expected member pre-empted by dispatcher, got %v by %v", ev.Peer, ev.By)
+	}
+	expectEvent(t, evs, EventFloorReleased)
+	expectEvent(t, evs, EventFloorGranted)
+
+	// Member не перебивает dispatcher'а, а встаёт в очередь.
+	if granted, pos := r.RequestFloor(member); granted || pos != 1 {
+		t.Fatalf("expected member queued, got granted=%v pos=%d", granted, pos)
+	}
+}
+
+func TestRequestFloor_QueueByPriority(t *testing.T) {
+	h := NewHub(WithFloorQueue(true))
+	admin, _ := h.Join("room1", JoinOptions{Name: "root", Role: RoleAdmin})
+	alice := join(t, h, "room1", "alice")
+	sess, _ := h.Join("room1", JoinOptions{Name: "dispatch", Role: RoleDispatcher})
+	r := alice.Room
+
+	r.RequestFloor(admin.Peer)
+	r.RequestFloor(alice)
+	if _, pos := r.RequestFloor(sess.Peer); pos != 1 {
+		t.Fatalf("expected dispatcher ahead of member in queue, got position %d", pos)
+	}
+}
+
+func TestRequestFloor_ListenerCannotTalk(t *testing.T) {
+	h := NewHub()
+	sess, _ := h.Join("room1", JoinOptions{Name: "monitor", Role: RoleListener})
+	if granted, _ := sess.Peer.Room.RequestFloor(sess.Peer); granted {
+		t.Fatal("listener must not get the floor")
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	if r, err := ParseRole(""); err != nil || r != RoleMember {
+		t.Fatalf("empty role: got %q, %v", r, err)
+	}
+	if _, err := ParseRole("superuser"); err == nil {
+		t.Fatal("expected error for unknown role")
+	}
+}
+
+func TestChatHistoryBounded(t *testing.T) {
+	h := NewHub()
+	alice := join(t, h, "room1", "alice")
+	r := alice.Room
+
+	first, err := r.PostChat(alice, "first", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ChatHistorySize {
+		alice.chatLimit = tokenBucket{} // лимит частоты проверяет TestPostChat_RateLimited
+		if _, err := r.PostChat(alice, fmt.Sprint("msg ", i), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history := r.ChatHistory()
+	if len(history) != ChatHistorySize || history[0].Text != "msg 0" {
+		t.Fatalf("expected last %d messages starting at \"msg 0\", got %d starting at %q", ChatHistorySize, len(history), history[0].Text)
+	}
+
+	// Ответ на сообщение, вытесненное из истории, теряет reply_to.
+	if m, _ := r.PostChat(alice, "late reply", first.ID); m.ReplyTo != "" {
+		t.Fatalf("expected reply_to dropped, got %q", m.ReplyTo)
+	}
+	if _, err := r.PostChat(alice, strings.Repeat("я", MaxChatText+1), ""); !errors.Is(err, ErrChatTooLong) {
+		t.Fatalf("expected ErrChatTooLong, got %v", err)
+	}
+}
+
+func TestPostChat_RateLimited(t *testing.T) {
+	h := NewHub()
+	alice := join(t, h, "room1", "alice")
+	bob := join(t, h, "room1", "bob")
+	r := alice.Room
+
+	for i := range chatBurst {
+		if _, err := r.PostChat(alice, fmt.Sprint("spam ", i), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.PostChat(alice, "one more", ""); !errors.Is(err, ErrChatLimited) {
+		t.Fatalf("expected ErrChatLimited, got %v", err)
+	}
+	if n := len(r.ChatHistory()); n != chatBurst {
+		t.Fatalf("rejected message must not reach history: %d messages", n)
+	}
+	// Лимит у каждого участника свой.
+	if _, err := r.PostChat(bob, "hi", ""); err != nil {
+		t.Fatalf("bob: %v", err)
+	}
+
+	// Через секунду восстанавливается одно сообщение.
+	alice.chatLimit.at = alice.chatLimit.at.Add(-time.Second)
+	if _, err := r.PostChat(alice, "later", ""); err != nil {
+		t.Fatalf("expected a token after a second, got %v", err)
+	}
+}
+
+func TestReact(t *testing.T) {
+	h := NewHub()
+	alice := join(t, h, "room1", "alice")
+	bob := join(t, h, "room1", "bob")
+	r := alice.Room
+
+	if _, err := r.React(bob, "👍"); !errors.Is(err, ErrNoTransmission) {
+		t.Fatalf("expected ErrNoTransmission, got %v", err)
+	}
+	r.TryAcquire(alice)
+	if _, err := r.React(alice, "👍"); !errors.Is(err, ErrOwnReaction) {
+		t.Fatalf("expected ErrOwnReaction, got %v", err)
+	}
+	for _, bad := range []string{"", "ok", "👍 ", strings.Repeat("👍", 9)} {
+		if _, err := r.React(bob, bad); !errors.Is(err, ErrBadReaction) {
+			t.Fatalf("%q: expected ErrBadReaction, got %v", bad, err)
+		}
+	}
+
+	var last Reaction
+	for range reactionBurst {
+		var err error
+		if last, err = r.React(bob, "👍"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if last.Talker != alice || last.Counts["👍"] != reactionBurst {
+		t.Fatalf("unexpected reaction: %+v", last)
+	}
+	if _, err := r.React(bob, "👍"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+
+	// Новая передача — счётчики с нуля.
+	r.Release(alice)
+	r.TryAcquire(bob)
+	got, err := r.React(alice, "❤️")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Counts) != 1 || got.Counts["❤️"] != 1 {
+		t.Fatalf("expected counts reset for new transmission, got %v", got.Counts)
+	}
+}
+
+// fillMedia забивает очередь медиа p.
+func fillMedia(p *Peer) {
+	for len(p.Media) < cap(p.Media) {
+		p.Media <- relay.Wrap([]byte{0x13})
+	}
+}
+
+// drainMedia забирает всё из очереди медиа p.
+func drainMedia(p *Peer) (msgs [][]byte) {
+	for {
+		select {
+		case m := <-p.Media:
+			msgs = append(msgs, m.Bytes())
+		default:
+			return msgs
+		}
+	}
+}
+
+// drain забирает всё из очереди.
+func drain(q chan []byte) (msgs [][]byte) {
+	for {
+		select {
+		case m := <-q:
+			msgs = append(msgs, m)
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestBroadcastMedia_SlowPeerSkipsToKeyframe(t *testing.T) {
+	h := NewHub()
+	alice := join(t, h, "test", "alice")
+	bob := join(t, h, "test", "bob")
+	r := alice.Room
+	r.TryAcquire(alice)
+
+	c1 := mediatest.WebMCluster(true, 0x11)
+	c2 := mediatest.WebMCluster(false, 0x22)
+	c3 := mediatest.WebMCluster(true, 0x33)
+	c4 := mediatest.WebMCluster(false, 0x44)
+	send := func(data []byte) { r.BroadcastMedia(alice, relay.Wrap(append([]byte{0x13}, data...))) }
+
+	send(slices.Concat(mediatest.WebMInit(), c1[:10]))
+	fillMedia(bob)
+	// Очередь занята: обрывок c1 и c2 пропускаются, управляющее сообщение — нет.
+	send(c1[10:])
+	r.Broadcast(nil, []byte{0x14})
+	send(c2)
+	if n := h.Dropped(); n != 2 {
+		t.Fatalf("expected 2 dropped chunks, got %d", n)
+	}
+	if msgs := drain(bob.Control); len(msgs) != 1 || !bytes.Equal(msgs[0], []byte{0x14}) {
+		t.Fatalf("expected control message to get through, got %x", msgs)
+	}
+	drainMedia(bob)
+
+	// Буфер освободился, но продолжаем только с ключевого фрагмента —
+	// даже если он начинается посреди чанка.
+	c5 := mediatest.WebMCluster(false, 0x55)
+	send(c5[:5])
+	send(slices.Concat(c5[5:], c3))
+	send(c4)
+
+	got := drainMedia(bob)
+	want := [][]byte{slices.Concat([]byte{0x13}, c3), slices.Concat([]byte{0x13}, c4)}
+	if len(got) != len(want) || !bytes.Equal(got[0], want[0]) || !bytes.Equal(got[1], want[1]) {
+		t.Fatalf("expected bob to resume exactly at keyframe cluster, got %d messages: %x", len(got), got)
+	}
+	if err := bob.session.Err(); err != nil {
+		t.Fatalf("bob should stay connected, got %v", err)
+	}
+}
+
+func TestSlowConsumerDisconnected(t *testing.T) {
+	h := NewHub(WithSlowConsumerTimeout(20 * time.Millisecond))
+	alice := join(t, h, "test", "alice")
+	sess, err := h.Join("test", JoinOptions{Name: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := sess.Peer
+	r := alice.Room
+	r.TryAcquire(alice)
+
+	r.BroadcastMedia(alice, relay.Wrap(append([]byte{0x13}, mediatest.WebMInit()...)))
+	fillMedia(bob)
+	r.BroadcastMedia(alice, relay.Wrap(append([]byte{0x13}, mediatest.WebMCluster(false, 0x11)...)))
+	time.Sleep(30 * time.Millisecond)
+	r.BroadcastMedia(alice, relay.Wrap(append([]byte{0x13}, mediatest.WebMCluster(false, 0x22)...)))
+
+	select {
+	case <-sess.Done():
+	default:
+		t.Fatal("expected slow consumer session to be closed")
+	}
+	if !errors.Is(sess.Err(), ErrSlowConsumer) || h.SlowConsumerKicks() != 1 {
+		t.Fatalf("expected ErrSlowConsumer, got %v (kicks %d)", sess.Err(), h.SlowConsumerKicks())
+	}
+}
+
+func TestControlBacklogDisconnects(t *testing.T) {
+	h := NewHub()
+	join(t, h, "test", "alice")
+	sess, err := h.Join("test", JoinOptions{Name: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := sess.Peer.Room
+
+	for range cap(sess.Peer.Control) + 1 {
+		r.SendTo(sess.Peer, []byte{0x14})
+	}
+	if !errors.Is(sess.Err(), ErrSlowConsumer) {
+		t.Fatalf("expected ErrSlowConsumer after control backlog, got %v", sess.Err())
+	}
+}
+
+func TestBroadcastMedia_SlowPeerMissedInit(t *testing.T) {
+	h := NewHub()
+	alice := join(t, h, "test", "alice")
+	bob := join(t, h, "test", "bob")
+	r := alice.Room
+	r.TryAcquire(alice)
+
+	init := mediatest.WebMInit()
+	c3 := mediatest.WebMCluster(true, 0x33)
+	fillMedia(bob)
+	r.BroadcastMedia(alice, relay.Wrap(slices.Concat([]byte{0x13}, init, mediatest.WebMCluster(true, 0x11))))
+	drainMedia(bob)
+	r.BroadcastMedia(alice, relay.Wrap(slices.Concat([]byte{0x13}, c3)))
+
+	// Пропущен init-сегмент — продолжаем с него и ключевого фрагмента.
+	got := drainMedia(bob)
+	if want := slices.Concat([]byte{0x13}, init, c3); len(got) != 1 || !bytes.Equal(got[0], want) {
+		t.Fatalf("expected init + keyframe cluster, got %x", got)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	h := NewHub(WithRoomPassword("ops", "hunter2"))
+	sess, err := h.Join("side", JoinOptions{Name: "alice", Password: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		room, password string
+		private        bool
+		err            error
+	}{
+		{"ops", "hunter2", true, nil},
+		{"ops", "", true, ErrWrongPassword},
+		{"side", "s3cret", true, nil},
+		{"side", "hunter2", true, ErrWrongPassword},
+		{"open", "", false, nil},
+	} {
+		private, err := h.CheckPassword(tc.room, tc.password)
+		if private != tc.private || !errors.Is(err, tc.err) {
+			t.Errorf("%s/%q: got %v, %v; want %v, %v", tc.room, tc.password, private, err, tc.private, tc.err)
+		}
+	}
+
+	// Комната закрылась — её пароль забыт.
+	h.Leave(sess.Peer)
+	if private, err := h.CheckPassword("side", ""); private || err != nil {
+		t.Errorf("closed room: got %v, %v", private, err)
+	}
+}
+
+func TestPasswordHash_CachesVerified(t *testing.T) {
+	h := newPasswordHash("hunter2")
+	if h.match("wrong") || len(h.verified) != 0 {
+		t.Fatal("wrong password must not match or be cached")
+	}
+	if !h.match("hunter2") {
+		t.Fatal("expected the password to match")
+	}
+
+	// Подошедший пароль больше не проверяется PBKDF2: даже с испорченным
+	// ключом он подходит, а остальные — нет.
+	h.key = make([]byte, len(h.key))
+	if !h.match("hunter2") {
+		t.Error("verified password must match from the cache")
+	}
+	if h.match("hunter3") {
+		t.Error("unverified password must still go through PBKDF2")
+	}
+
+	h = newPasswordHash("hunter2")
+	h.verified = make(map[[32]byte]struct{})
+	for i := range maxVerified {
+		h.verified[[32]byte{byte(i + 1)}] = struct{}{}
+	}
+	if !h.match("hunter2") || len(h.verified) != 1 {
+		t.Errorf("cache must stay bounded, got %d entries", len(h.verified))
+	}
+}
@@ -0,0 +1,154 @@
+package room
+
+import (
+	"errors"
+	"time"
+)
+
+// Session — одно подключение клиента к участнику. При переподключении
+// с тем же resume-токеном участник остаётся прежним (с ID, местом в комнате
+// и эфиром), а сессия создаётся новая.
+type Session struct {
+	Peer    *Peer
+	Resumed bool // подключение подхватило уже существующего участника
+
+	done chan struct{}
+	err  error // почему закрыт done; под Room.mu
+}
+
+func newSession(p *Peer, resumed bool) *Session {
+	return &Session{Peer: p, Resumed: resumed, done: make(chan struct{})}
+}
+
+// ErrSessionReplaced — участника подхватило новое подключение того же клиента.
+var ErrSessionReplaced = errors.New("room: session replaced by a newer connection")
+
+// Done закрывается, когда соединение сессии нужно закрыть: участника
+// подхватила более новая сессия или клиент не успевает за потоком.
+// Причину возвращает Err.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err — почему закрыт Done (ErrSessionReplaced или ErrSlowConsumer);
+// nil, пока Done открыт.
+func (s *Session) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// end закрывает Done с причиной err. Вызывается под Room.mu; false —
+// сессия уже закрыта.
+func (s *Session) end(err error) bool {
+	if s.err != nil {
+		return false
+	}
+	s.err = err
+	close(s.done)
+	return true
+}
+
+// Reconnecting сообщает, что соединение участника оборвалось и он
+// в пределах grace-периода может вернуться.
+func (p *Peer) Reconnecting() bool {
+	p.Room.mu.Lock()
+	defer p.Room.mu.Unlock()
+	return p.detached
+}
+
+// peerByTokenLocked ищет участника, которого подхватит вход с
+// resume-токеном. Имя и роль должны совпасть: одного токена мало —
+// утёкший токен не даёт слушателю чужую роль и эфир, такой вход
+// становится новым участником.
+func (r *Room) peerByTokenLocked(token, name string, role Role) *Peer {
+	if len(token) < minResumeTokenLen {
+		return nil
+	}
+	for p := range r.peers {
+		if p.resumeToken == token && p.Name == name && p.Role == role {
+			return p
+		}
+	}
+	return nil
+}
+
+// reattachLocked передаёт участника новой сессии. Старая, если ещё жива
+// (сервер не успел заметить обрыв), получает Done.
+func (r *Room) reattachLocked(p *Peer) *Session {
+	if !p.detached {
+		p.session.end(ErrSessionReplaced)
+	}
+	if p.graceTimer != nil {
+		p.graceTimer.Stop()
+		p.graceTimer = nil
+	}
+	p.detached = false
+	p.session = newSession(p, true)
+
+	// Что не успело уйти в старое соединение — устарело.
+	for len(p.Control) > 0 {
+		<-p.Control
+	}
+	for len(p.Media) > 0 {
+		(<-p.Media).Release()
+	}
+
+	if r.Talker == p {
+		// Talker после переподключения перезапускает MediaRecorder —
+		// поток начнётся с нового init-сегмента.
+		r.resetCacheLocked(newMediaCache())
+		r.resetMediaSkipLocked()
+		r.resetIdleLocked()
+	} else {
+		p.mediaSkip = false
+		r.replayLocked(p)
+	}
+	return p.session
+}
+
+// detach помечает участника переподключающимся и запускает таймер grace-периода.
+// Из очереди на эфир участник выходит: клиент после переподключения о ней не помнит.
+// Возвращает false, если сессия уже не текущая.
+func (r *Room) detach(s *Session, grace time.Duration, expire func()) (ok, dequeued bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := s.Peer
+	if _, ok := r.peers[p]; !ok || p.session != s || p.detached {
+		return false, false
+	}
+	p.detached = true
+	p.graceTimer = time.AfterFunc(grace, expire)
+	return true, r.dequeueLocked(p)
+}
+
+// Disconnect вызывается, когда соединение сессии закрылось. Если клиент
+// ушёл сам (resumable=false) или grace-период выключен — участник покидает
+// комнату сразу. Иначе он остаётся в комнате (с эфиром, если держал его)
+// и ждёт переподключения; по истечении grace-периода — уходит (EventLeft).
+// Для сессии, которую уже подхватила более новая, ничего не делает.
+func (h *Hub) Disconnect(s *Session, resumable bool) {
+	p := s.Peer
+	if !resumable || h.grace <= 0 {
+		h.leave(p, s)
+		return
+	}
+
+	expire := func() {
+		p.Room.log.Info("peer did not reconnect", "event", "resume_expired", "peer_id", p.ID, "peer", p.Name, "grace", h.grace)
+		h.leave(p, s)
+	}
+	ok, dequeued := p.Room.detach(s, h.grace, expire)
+	if !ok {
+		return
+	}
+	p.Room.log.Info("peer disconnected, waiting for reconnect", "event", "peer_disconnected", "peer_id", p.ID, "peer", p.Name, "grace", h.grace)
+	if dequeued {
+		h.emit(Event{Type: EventQueueChanged, Room: p.Room, Peer: p})
+	}
+	h.emit(Event{Type: EventDisconnected, Room: p.Room, Peer: p})
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"teletalkie/internal/recorder"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// recordingJSON — запись в ответе API: метаданные сайдкара и ссылка на медиа.
+type recordingJSON struct {
+	recorder.Meta
+	URL string `json:"url"`
+}
+
+// recordingsPage — ответ GET /api/rooms/{room}/recordings.
+type recordingsPage struct {
+	Recordings []recordingJSON `json:"recordings"`
+	Total      int             `json:"total"`
+	Offset     int             `json:"offset"`
+	Limit      int             `json:"limit"`
+}
+
+// handleListRecordings — GET /api/rooms/{room}/recordings
+//
+// Query: talker — точное имя; from, to — RFC 3339, полуинтервал [from, to)
+// по времени начала; offset, limit — пагинация (limit по умолчанию 50, максимум 500).
+// Записи отсортированы от новых к старым. Доступ — как в комнату
+// (authorizeRoom); записи, сделанные с паролем, видны, только пока
+// комната приватная и пароль указан.
+func (s *Server) handleListRecordings(w http.ResponseWriter, r *http.Request) {
+	roomID := r.PathValue("room")
+	private, status, err := s.authorizeRoom(r, roomID)
+	if status != 0 {
+		s.log.Warn("auth failed", "event", "auth_failed", "room", roomID, "remote_addr", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	q := r.URL.Query()
+
+	filter := recorder.Filter{Talker: q.Get("talker")}
+	if filter.From, err = parseTimeParam(q.Get("from")); err != nil {
+		http.Error(w, "bad from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.To, err = parseTimeParam(q.Get("to")); err != nil {
+		http.Error(w, "bad to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	offset, err := parseIntParam(q.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		http.Error(w, "bad offset", http.StatusBadRequest)
+		return
+	}
+	limit, err := parseIntParam(q.Get("limit"), defaultPageLimit)
+	if err != nil || limit <= 0 {
+		http.Error(w, "bad limit", http.StatusBadRequest)
+		return
+	}
+	limit = min(limit, maxPageLimit)
+
+	all, err := s.recorder.List(roomID, filter)
+	if err != nil {
+		s.log.Error("list recordings failed", "room", roomID, "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !private {
+		all = slices.DeleteFunc(all, func(m recorder.Meta) bool { return m.Private })
+	}
+
+	page := recordingsPage{
+		Recordings: []recordingJSON{},
+		Total:      len(all),
+		Offset:     offset,
+		Limit:      limit,
+	}
+	if offset < len(all) {
+		for _, m := range all[offset:min(offset+limit, len(all))] {
+			page.Recordings = append(page.Recordings, recordingJSON{
+				Meta: m,
+				URL:  "/api/recordings/" + m.ID,
+			})
+		}
+	}
+
+	s.writeJSON(w, page)
+}
+
+// handleGetRecording — GET /api/recordings/{id}: медиафайл записи.
+// Range-запросы обслуживает http.ServeContent — плеер может перематывать.
+// Доступ — как к списку записей комнаты записи.
+func (s *Server) handleGetRecording(w http.ResponseWriter, r *http.Request) {
+	f, meta, err := s.recorder.Open(r.PathValue("id"))
+	if errors.Is(err, recorder.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		s.log.Error("open recording failed", "recording", r.PathValue("id"), "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	private, status, err := s.authorizeRoom(r, meta.Room)
+	if status == 0 && meta.Private && !private {
+		status, err = http.StatusForbidden, errors.New("recording of a closed private room")
+	}
+	if status != 0 {
+		s.log.Warn("auth failed", "event", "auth_failed", "room", meta.Room, "recording", meta.ID, "remote_addr", r.RemoteAddr, "err", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	modTime := meta.StartedAt
+	if meta.EndedAt != nil {
+		modTime = *meta.EndedAt
+	}
+
+	w.Header().Set("Content-Type", "video/"+meta.Format)
+	http.ServeContent(w, r, meta.File, modTime, f)
+}
+
+func parseTimeParam(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func parseIntParam(v string, def int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.log.Warn("write json failed", "err", err)
+	}
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"teletalkie/internal/media/mediatest"
+	"teletalkie/internal/recorder"
+	"teletalkie/internal/room"
+	"teletalkie/web"
+)
+
+// setupRecordingServer поднимает сервер с записью и записывает по одной
+// передаче на каждого talker'а в room1.
+func setupRecordingServer(t *testing.T, talkers ...string) (*httptest.Server, []byte) {
+	t.Helper()
+	rec, stream := recordTalkers(t, false, talkers...)
+	srv := New(":0", web.FS, room.NewHub(), WithRecorder(rec))
+	ts := httptest.NewServer(srv.mux)
+	t.Cleanup(ts.Close)
+	return ts, stream
+}
+
+// recordTalkers записывает по одной передаче на каждого talker'а в room1.
+func recordTalkers(t *testing.T, private bool, talkers ...string) (*recorder.Recorder, []byte) {
+	t.Helper()
+	rec, err := recorder.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := slices.Concat(mediatest.WebMInit(), mediatest.WebMCluster(true, 0x11))
+	for _, name := range talkers {
+		rec.Start("room1", name, "", private)
+		rec.Write("room1", "", stream)
+		rec.Stop("room1", "")
+		time.Sleep(2 * time.Millisecond) // разные started_at
+	}
+	return rec, stream
+}
+
+// getStatus делает GET с заголовками "ключ", "значение"... и возвращает статус.
+func getStatus(t *testing.T, ts *httptest.Server, path string, header ...string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func getPage(t *testing.T, ts *httptest.Server, path string) recordingsPage {
+	t.Helper()
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", path, resp.StatusCode)
+	}
+	var page recordingsPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func TestListRecordings(t *testing.T) {
+	ts, _ := setupRecordingServer(t, "alice", "bob", "alice")
+
+	page := getPage(t, ts, "/api/rooms/room1/recordings")
+	if page.Total != 3 || len(page.Recordings) != 3 {
+		t.Fatalf("expected 3 recordings, got total=%d len=%d", page.Total, len(page.Recordings))
+	}
+	// От новых к старым.
+	if page.Recordings[0].Talker != "alice" || page.Recordings[1].Talker != "bob" {
+		t.Fatalf("unexpected order: %+v", page.Recordings)
+	}
+
+	page = getPage(t, ts, "/api/rooms/room1/recordings?talker=alice")
+	if page.Total != 2 {
+		t.Fatalf("talker filter: expected 2, got %d", page.Total)
+	}
+
+	page = getPage(t, ts, "/api/rooms/room1/recordings?limit=1&offset=1")
+	if page.Total != 3 || len(page.Recordings) != 1 || page.Recordings[0].Talker != "bob" {
+		t.Fatalf("pagination: unexpected page %+v", page)
+	}
+
+	future := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	page = getPage(t, ts, "/api/rooms/room1/recordings?from="+future)
+	if page.Total != 0 || page.Recordings == nil {
+		t.Fatalf("time filter: expected empty list, got %+v", page)
+	}
+
+	page = getPage(t, ts, "/api/rooms/other/recordings")
+	if page.Total != 0 {
+		t.Fatalf("other room: expected 0, got %d", page.Total)
+	}
+
+	resp, err := http.Get(ts.URL + "/api/rooms/room1/recordings?from=yesterday")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad from: expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestGetRecording(t *testing.T) {
+	ts, stream := setupRecordingServer(t, "alice")
+
+	page := getPage(t, ts, "/api/rooms/room1/recordings")
+	if len(page.Recordings) != 1 {
+		t.Fatalf("expected 1 recording, got %d", len(page.Recordings))
+	}
+
+	resp, err := http.Get(ts.URL + page.Recordings[0].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != string(stream) {
+		t.Fatalf("full GET: status %d, %d bytes", resp.StatusCode, len(body))
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "video/webm" {
+		t.Fatalf("content-type %q", ct)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+page.Recordings[0].URL, nil)
+	req.Header.Set("Range", "bytes=4-9")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(body) != string(stream[4:10]) {
+		t.Fatalf("range GET: status %d, body %v", resp.StatusCode, body)
+	}
+
+	for _, id := range []string{"nope", "..", "..%2F..%2Fetc%2Fpasswd"} {
+		resp, err = http.Get(ts.URL + "/api/recordings/" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("GET %s: expected 404, got %d", id, resp.StatusCode)
+		}
+	}
+}
+
+func TestRecordingsRequireToken(t *testing.T) {
+	rec, _ := recordTalkers(t, false, "alice")
+	srv := New(":0", web.FS, room.NewHub(), WithRecorder(rec), WithAuthenticator(TokenAuth{Secret: testSecret}))
+	ts := httptest.NewServer(srv.mux)
+	t.Cleanup(ts.Close)
+
+	metas, err := rec.List("room1", recorder.Filter{})
+	if err != nil || len(metas) != 1 {
+		t.Fatalf("list: %v, %d recordings", err, len(metas))
+	}
+	list, file := "/api/rooms/room1/recordings", "/api/recordings/"+metas[0].ID
+	good := "Bearer " + issueToken(t, "room1", "alice", time.Hour)
+	other := "Bearer " + issueToken(t, "room2", "alice", time.Hour)
+
+	for _, tc := range []struct {
+		path, auth string
+		want       int
+	}{
+		{list, "", http.StatusUnauthorized},
+		{file, "", http.StatusUnauthorized},
+		{list, "Bearer garbage", http.StatusUnauthorized},
+		{list, other, http.StatusForbidden},
+		{file, other, http.StatusForbidden},
+		{list, good, http.StatusOK},
+		{file, good, http.StatusOK},
+	} {
+		if got := getStatus(t, ts, tc.path, "Authorization", tc.auth); got != tc.want {
+			t.Errorf("GET %s (auth %.12q): status %d, want %d", tc.path, tc.auth, got, tc.want)
+		}
+	}
+}
+
+func TestRecordingsOfPrivateRoom(t *testing.T) {
+	rec, _ := recordTalkers(t, true, "alice")
+	metas, err := rec.List("room1", recorder.Filter{})
+	if err != nil || len(metas) != 1 {
+		t.Fatalf("list: %v, %d recordings", err, len(metas))
+	}
+	list, file := "/api/rooms/room1/recordings", "/api/recordings/"+metas[0].ID
+
+	srv := New(":0", web.FS, room.NewHub(room.WithRoomPassword("room1", "hunter2")), WithRecorder(rec))
+	ts := httptest.NewServer(srv.mux)
+	t.Cleanup(ts.Close)
+	for _, path := range []string{list, file, list + "?password=wrong", file + "?password=wrong"} {
+		if got := getStatus(t, ts, path); got != http.StatusForbidden {
+			t.Errorf("GET %s: status %d, want 403", path, got)
+		}
+	}
+	if page := getPage(t, ts, list+"?password=hunter2"); page.Total != 1 {
+		t.Errorf("with password: total %d, want 1", page.Total)
+	}
+	if got := getStatus(t, ts, file+"?password=hunter2"); got != http.StatusOK {
+		t.Errorf("GET recording with password: status %d", got)
+	}
+
+	// Комната больше не приватная (пароль был у закрытой комнаты):
+	// проверить пароль нечем — записи не отдаются никому.
+	srv = New(":0", web.FS, room.NewHub(), WithRecorder(rec))
+	open := httptest.NewServer(srv.mux)
+	t.Cleanup(open.Close)
+	if page := getPage(t, open, list+"?password=hunter2"); page.Total != 0 {
+		t.Errorf("closed private room: total %d, want 0", page.Total)
+	}
+	if got := getStatus(t, open, file+"?password=hunter2"); got != http.StatusForbidden {
+		t.Errorf("closed private room: GET recording status %d, want 403", got)
+	}
+}
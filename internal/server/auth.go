@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"teletalkie/internal/room"
+	"teletalkie/internal/token"
+)
+
+// errMissingParams — в запросе нет room/name: это ошибка клиента, а не отказ в доступе.
+var errMissingParams = errors.New("missing room or name query param")
+
+// Identity — кто подключается к комнате, по мнению Authenticator'а.
+type Identity struct {
+	Room string
+	Name string
+	Role string // пусто — роль по умолчанию
+}
+
+// Authenticator проверяет запрос на подключение к /ws до upgrade.
+// Ошибка приводит к закрытию WebSocket с кодом StatusPolicyViolation.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// AnonymousAuth пускает всех: комната и имя берутся из ?room=&name=.
+type AnonymousAuth struct{}
+
+// Authenticate реализует Authenticator.
+func (AnonymousAuth) Authenticate(r *http.Request) (Identity, error) {
+	q := r.URL.Query()
+	id := Identity{Room: q.Get("room"), Name: q.Get("name")}
+	if id.Room == "" || id.Name == "" {
+		return Identity{}, errMissingParams
+	}
+	return id, nil
+}
+
+// TokenAuth требует join-токен, подписанный Secret (см. пакет token).
+// Токен передаётся в ?token= или заголовком Authorization: Bearer.
+// Комната, имя и роль берутся из токена; ?room=, если указан, должен совпадать.
+type TokenAuth struct {
+	Secret []byte
+}
+
+// Authenticate реализует Authenticator.
+func (a TokenAuth) Authenticate(r *http.Request) (Identity, error) {
+	tok := r.URL.Query().Get("token")
+	if tok == "" {
+		tok, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if tok == "" {
+		return Identity{}, errors.New("join token required")
+	}
+
+	c, err := token.Verify(a.Secret, tok, time.Now())
+	if err != nil {
+		return Identity{}, err
+	}
+	if room := r.URL.Query().Get("room"); room != "" && room != c.Room {
+		return Identity{}, errors.New("token is not valid for this room")
+	}
+	return Identity{Room: c.Room, Name: c.Name, Role: c.Role}, nil
+}
+
+// authorizeRoom пускает к данным комнаты вне /ws — к её записям. Запрос
+// проходит тот же Authenticator, что и /ws (без room и name — анонимно,
+// если Authenticator это допускает); комната из токена должна совпасть
+// с roomID, а к приватной комнате нужен ?password=. private — комната
+// сейчас приватная: записи, сделанные с паролем, отдаются только тогда.
+// При отказе возвращается HTTP-статус.
+func (s *Server) authorizeRoom(r *http.Request, roomID string) (private bool, status int, err error) {
+	ident, err := s.auth.Authenticate(r)
+	if err != nil && !errors.Is(err, errMissingParams) {
+		return false, http.StatusUnauthorized, err
+	}
+	if ident.Room != "" && ident.Room != roomID {
+		return false, http.StatusForbidden, errors.New("token is not valid for this room")
+	}
+	private, err = s.hub.CheckPassword(roomID, r.URL.Query().Get("password"))
+	if errors.Is(err, room.ErrWrongPassword) {
+		return true, http.StatusForbidden, errors.New("wrong room password")
+	}
+	return private, 0, err
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"teletalkie/internal/room"
+	"teletalkie/internal/token"
+	"teletalkie/web"
+)
+
+var testSecret = []byte("test-secret-test-secret")
+
+func setupTokenServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := New(":0", web.FS, room.NewHub(), WithAuthenticator(TokenAuth{Secret: testSecret}))
+	ts := httptest.NewServer(srv.mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func issueToken(t *testing.T, roomID, name string, ttl time.Duration) string {
+	t.Helper()
+	return issueRoleToken(t, roomID, name, "member", ttl)
+}
+
+func issueRoleToken(t *testing.T, roomID, name, role string, ttl time.Duration) string {
+	t.Helper()
+	tok, err := token.Issue(testSecret, token.Claims{
+		Room:    roomID,
+		Name:    name,
+		Role:    role,
+		Expires: time.Now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func dialQuery(t *testing.T, ts *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, "ws"+ts.URL[len("http"):]+"/ws?"+query, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+	return conn
+}
+
+// expectClose читает из соединения до закрытия и проверяет close-код.
+func expectClose(t *testing.T, conn *websocket.Conn, want websocket.StatusCode) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		_, _, err := conn.Read(ctx)
+		if err == nil {
+			continue
+		}
+		if got := websocket.CloseStatus(err); got != want {
+			t.Fatalf("expected close status %v, got %v (%v)", want, got, err)
+		}
+		return
+	}
+}
+
+func TestTokenAuth_Valid(t *testing.T) {
+	ts := setupTokenServer(t)
+
+	conn := dialQuery(t, ts, "token="+issueToken(t, "ops", "alice", time.Hour))
+	if resp := readMsg(t, conn); resp[0] != MsgPeerInfo {
+		t.Fatalf("expected PEER_INFO after join, got 0x%02x", resp[0])
+	}
+}
+
+func TestTokenAuth_Rejected(t *testing.T) {
+	ts := setupTokenServer(t)
+
+	forged, err := token.Issue([]byte("wrong secret"), token.Claims{Room: "ops", Name: "mallory", Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, query := range map[string]string{
+		"no token":   "room=ops&name=alice",
+		"expired":    "token=" + issueToken(t, "ops", "alice", -time.Minute),
+		"forged":     "token=" + forged,
+		"wrong room": "room=other&token=" + issueToken(t, "ops", "alice", time.Hour),
+		"garbage":    "token=garbage",
+	} {
+		t.Run(name, func(t *testing.T) {
+			expectClose(t, dialQuery(t, ts, query), websocket.StatusPolicyViolation)
+		})
+	}
+}
+
+func TestTokenAuth_UnknownRole(t *testing.T) {
+	ts := setupTokenServer(t)
+	conn := dialQuery(t, ts, "token="+issueRoleToken(t, "room1", "alice", "superuser", time.Hour))
+	expectClose(t, conn, websocket.StatusPolicyViolation)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"teletalkie/internal/room"
+)
+
+// chatRequest — payload MsgChat от клиента.
+type chatRequest struct {
+	Text    string `json:"text"`
+	ReplyTo string `json:"reply_to,omitempty"`
+}
+
+// chatJSON — сообщение чата в MsgChatMessage и MsgChatHistory.
+type chatJSON struct {
+	ID       string    `json:"id"`
+	SenderID string    `json:"sender_id"`
+	Sender   string    `json:"sender"`
+	Text     string    `json:"text"`
+	Time     time.Time `json:"ts"`
+	ReplyTo  string    `json:"reply_to,omitempty"`
+}
+
+func toChatJSON(m room.ChatMessage) chatJSON {
+	return chatJSON{
+		ID:       m.ID,
+		SenderID: m.SenderID,
+		Sender:   m.Sender,
+		Text:     m.Text,
+		Time:     m.Time,
+		ReplyTo:  m.ReplyTo,
+	}
+}
+
+// handleChat — сообщение в текстовый чат комнаты. Рассылается всем,
+// включая отправителя: так он узнаёт ID и время сообщения.
+func (s *Server) handleChat(peer *room.Peer, payload []byte, logger *slog.Logger) {
+	var req chatRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		s.sendError(peer, ErrCodeBadRequest, "malformed chat message")
+		return
+	}
+
+	m, err := peer.Room.PostChat(peer, req.Text, req.ReplyTo)
+	switch {
+	case errors.Is(err, room.ErrChatLimited):
+		s.sendError(peer, ErrCodeRateLimited, err.Error())
+		return
+	case errors.Is(err, room.ErrChatEmpty) || errors.Is(err, room.ErrChatTooLong):
+		s.sendError(peer, ErrCodeBadRequest, err.Error())
+		return
+	case err != nil:
+		logger.Error("chat failed", "err", err)
+		return
+	}
+
+	if msg := jsonMessage(logger, MsgChatMessage, toChatJSON(m)); msg != nil {
+		peer.Room.Broadcast(nil, msg)
+	}
+}
+
+// sendChatHistory отправляет зашедшему историю чата одним сообщением.
+func (s *Server) sendChatHistory(peer *room.Peer, logger *slog.Logger) {
+	history := peer.Room.ChatHistory()
+	if len(history) == 0 {
+		return
+	}
+	list := make([]chatJSON, 0, len(history))
+	for _, m := range history {
+		list = append(list, toChatJSON(m))
+	}
+	if msg := jsonMessage(logger, MsgChatHistory, list); msg != nil {
+		peer.Room.SendTo(peer, msg)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"cmp"
+	"slices"
+
+	"teletalkie/internal/metrics"
+	"teletalkie/internal/room"
+)
+
+// maxRoomSeries — сколько комнат получают свою серию
+// teletalkie_room_peers. Комнаты создаёт любой клиент, и без предела
+// число серий (и размер /metrics) ничем не ограничено.
+const maxRoomSeries = 20
+
+// serverMetrics — счётчики сервера для /metrics.
+type serverMetrics struct {
+	reg *metrics.Registry
+
+	pttGrants     *metrics.Counter
+	pttDenials    *metrics.Counter
+	relayedChunks *metrics.Counter
+	relayedBytes  *metrics.Counter
+	writeErrors   *metrics.Counter
+	pingFailures  *metrics.Counter
+}
+
+// newServerMetrics регистрирует метрики hub'а. roomLabels — можно ли
+// называть комнаты в метках; с join-токенами нельзя: имя комнаты — часть
+// того, что даёт доступ.
+func newServerMetrics(hub *room.Hub, roomLabels bool) *serverMetrics {
+	reg := metrics.NewRegistry()
+	m := &serverMetrics{
+		reg:           reg,
+		pttGrants:     reg.NewCounter("teletalkie_ptt_grants_total", "Floor grants, including queue hand-offs and pre-emptions."),
+		pttDenials:    reg.NewCounter("teletalkie_ptt_denials_total", "PTT requests denied because the floor was busy."),
+		relayedChunks: reg.NewCounter("teletalkie_relayed_chunks_total", "Media chunks written to listeners."),
+		relayedBytes:  reg.NewCounter("teletalkie_relayed_bytes_total", "Media bytes written to listeners."),
+		writeErrors:   reg.NewCounter("teletalkie_write_errors_total", "WebSocket write errors."),
+		pingFailures:  reg.NewCounter("teletalkie_ping_failures_total", "WebSocket keepalive pings that failed."),
+	}
+	reg.CounterFunc("teletalkie_dropped_messages_total", "Media chunks skipped for peers that could not keep up.", hub.Dropped)
+	reg.CounterFunc("teletalkie_slow_consumer_disconnects_total", "Connections closed because the peer could not keep up.", hub.SlowConsumerKicks)
+
+	reg.GaugeFunc("teletalkie_rooms", "Rooms currently open.", func() float64 {
+		return float64(len(hub.Rooms()))
+	})
+	// Имена приватных комнат в /metrics не попадают, как и все имена
+	// без roomLabels, и комнаты сверх maxRoomSeries: их участники
+	// считаются одной суммой.
+	if roomLabels {
+		reg.GaugeVecFunc("teletalkie_room_peers", "Peers per open (not password-protected) room, including reconnecting ones; only the largest rooms are listed.", "room", func() map[string]float64 {
+			listed, _ := roomPeers(hub)
+			return listed
+		})
+	}
+	reg.GaugeFunc("teletalkie_unlisted_room_peers", "Peers in rooms without their own teletalkie_room_peers series, including reconnecting ones.", func() float64 {
+		if !roomLabels {
+			n := 0
+			for _, r := range hub.Rooms() {
+				n += r.PeerCount()
+			}
+			return float64(n)
+		}
+		_, rest := roomPeers(hub)
+		return float64(rest)
+	})
+	reg.GaugeFunc("teletalkie_active_talkers", "Rooms where someone holds the floor.", func() float64 {
+		n := 0
+		for _, r := range hub.Rooms() {
+			if r.CurrentTalker() != nil {
+				n++
+			}
+		}
+		return float64(n)
+	})
+	return m
+}
+
+// roomPeers делит участников комнат на серии по комнатам — не больше
+// maxRoomSeries самых больших открытых комнат — и сумму остальных.
+func roomPeers(hub *room.Hub) (listed map[string]float64, rest int) {
+	type roomCount struct {
+		id    string
+		peers int
+	}
+	var open []roomCount
+	for _, r := range hub.Rooms() {
+		if r.Private() {
+			rest += r.PeerCount()
+		} else {
+			open = append(open, roomCount{r.ID, r.PeerCount()})
+		}
+	}
+	slices.SortFunc(open, func(a, b roomCount) int {
+		return cmp.Or(cmp.Compare(b.peers, a.peers), cmp.Compare(a.id, b.id))
+	})
+	listed = make(map[string]float64)
+	for i, rc := range open {
+		if i < maxRoomSeries {
+			listed[rc.id] = float64(rc.peers)
+		} else {
+			rest += rc.peers
+		}
+	}
+	return listed, rest
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"teletalkie/internal/qr"
+)
+
+// qrScale — пикселей на модуль в PNG: ссылка с комнатой укладывается
+// в версию 3–5, это около 300 пикселей.
+const qrScale = 8
+
+// handleQR — GET /api/qr?room=
+//
+// PNG с QR-кодом ссылки для входа: адрес, по которому пришёл запрос,
+// и комната, если задана, — клиент подставит её в форму входа.
+func (s *Server) handleQR(w http.ResponseWriter, r *http.Request) {
+	link := url.URL{Scheme: "http", Host: r.Host, Path: "/"}
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		link.Scheme = "https"
+	}
+	if room := r.URL.Query().Get("room"); room != "" {
+		link.RawQuery = url.Values{"room": {room}}.Encode()
+	}
+
+	code, err := qr.Encode([]byte(link.String()), qr.M)
+	if errors.Is(err, qr.ErrTooLong) {
+		http.Error(w, "room name is too long", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	img, err := code.PNG(qrScale)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(img)
+}
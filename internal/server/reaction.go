@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+
+	"teletalkie/internal/room"
+)
+
+// reactionJSON — payload MsgReactionEvent.
+type reactionJSON struct {
+	From     string         `json:"from"`
+	Name     string         `json:"name"`
+	Emoji    string         `json:"emoji"`
+	TalkerID string         `json:"talker"`
+	Counts   map[string]int `json:"counts"`
+}
+
+// handleReaction — реакция на текущую передачу. Рассылается всем,
+// включая talker'а и отправителя, вместе с итогом по передаче.
+func (s *Server) handleReaction(peer *room.Peer, payload []byte, logger *slog.Logger) {
+	r, err := peer.Room.React(peer, string(payload))
+	switch {
+	case errors.Is(err, room.ErrRateLimited):
+		s.sendError(peer, ErrCodeRateLimited, err.Error())
+		return
+	case err != nil:
+		s.sendError(peer, ErrCodeBadRequest, err.Error())
+		return
+	}
+
+	if s.recorder != nil {
+		s.recorder.SetReactions(peer.Room.ID, r.Talker.ID, r.Counts)
+	}
+	msg := jsonMessage(logger, MsgReactionEvent, reactionJSON{
+		From:     peer.ID,
+		Name:     peer.Name,
+		Emoji:    r.Emoji,
+		TalkerID: r.Talker.ID,
+		Counts:   r.Counts,
+	})
+	if msg != nil {
+		peer.Room.Broadcast(nil, msg)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+
+	"teletalkie/internal/media/mediatest"
+	"teletalkie/internal/relay"
+	"teletalkie/internal/room"
+	"teletalkie/web"
+)
+
+// BenchmarkRelay — путь медиа-чанка от чтения из соединения talker'а до
+// очередей слушателей. copy — прежняя схема (conn.Read через io.ReadAll
+// и копия payload'а в новое сообщение), pooled — текущая: чтение в буфер
+// из пула и один буфер на всех. Write-loop'ы заменены синхронным
+// опустошением очередей, чтобы не было пропусков из-за backpressure.
+//
+//	go test ./internal/server -run '^$' -bench Relay -benchmem
+func BenchmarkRelay(b *testing.B) {
+	paths := []struct {
+		name  string
+		relay func(s *Server, talker *room.Peer, r io.Reader, hint int)
+	}{
+		{"copy", func(s *Server, talker *room.Peer, r io.Reader, _ int) {
+			data, _ := io.ReadAll(r)
+			msg := make([]byte, len(data))
+			msg[0] = MsgRelayChunk
+			copy(msg[1:], data[1:])
+			talker.Room.BroadcastMedia(talker, relay.Wrap(msg))
+		}},
+		{"pooled", func(s *Server, talker *room.Peer, r io.Reader, hint int) {
+			buf, _ := relay.ReadFrom(r, hint)
+			s.handleMediaChunk(talker, buf)
+			buf.Release()
+		}},
+	}
+	for _, listeners := range []int{50, 200} {
+		for _, size := range []int{64 << 10, 1 << 20} {
+			for _, p := range paths {
+				name := fmt.Sprintf("listeners=%d/size=%dKiB/%s", listeners, size>>10, p.name)
+				b.Run(name, func(b *testing.B) {
+					benchmarkRelay(b, listeners, size, p.relay)
+				})
+			}
+		}
+	}
+}
+
+func benchmarkRelay(b *testing.B, listeners, size int, relayChunk func(*Server, *room.Peer, io.Reader, int)) {
+	hub := room.NewHub()
+	s := New(":0", web.FS, hub)
+	hub.SetEventHandler(nil) // PEER_INFO и эфир здесь не нужны
+
+	join := func(name string) *room.Peer {
+		sess, err := hub.Join("bench", room.JoinOptions{Name: name})
+		if err != nil {
+			b.Fatal(err)
+		}
+		return sess.Peer
+	}
+	talker := join("talker")
+	peers := make([]*room.Peer, listeners)
+	for i := range peers {
+		peers[i] = join(fmt.Sprintf("listener-%d", i))
+	}
+	talker.Room.TryAcquire(talker)
+
+	flush := func() {
+		for _, p := range peers {
+			for len(p.Media) > 0 {
+				msg := <-p.Media
+				io.Discard.Write(msg.Bytes())
+				msg.Release()
+			}
+		}
+	}
+
+	// Кластеры с ключевым кадром через каждые 10 чанков, как у MediaRecorder
+	// с чанками по 100 мс и ключевым кадром раз в секунду.
+	block := mediatest.Element(0xA3, append([]byte{0x80 | mediatest.VideoTrack, 0, 0, 0}, make([]byte, size)...))
+	chunks := make([][]byte, 10)
+	for i := range chunks {
+		chunks[i] = slices.Concat([]byte{MsgMediaChunk}, mediatest.WebMCluster(i == 0, byte(i)), block)
+	}
+	init := slices.Concat([]byte{MsgMediaChunk}, mediatest.WebMInit())
+	relayChunk(s, talker, bytes.NewReader(init), len(init))
+	flush()
+
+	b.SetBytes(int64(len(chunks[0])))
+	b.ReportAllocs()
+	for i := 0; b.Loop(); i++ {
+		msg := chunks[i%len(chunks)]
+		relayChunk(s, talker, bytes.NewReader(msg), len(msg))
+		flush()
+	}
+}
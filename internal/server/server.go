@@ -4,14 +4,20 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/fs"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/coder/websocket"
 
+	"teletalkie/internal/recorder"
+	"teletalkie/internal/relay"
 	"teletalkie/internal/room"
 )
 
@@ -21,35 +27,126 @@ const (
 	MsgPTTOn      byte = 0x01 // запрос эфира
 	MsgPTTOff     byte = 0x02 // освобождение эфира
 	MsgMediaChunk byte = 0x03 // медиа-чанк от talker'а
+	MsgChat       byte = 0x04 // JSON: сообщение в текстовый чат
+	MsgReaction   byte = 0x05 // реакция на текущую передачу; payload — эмодзи (UTF-8)
 
 	// Server → Client
-	MsgPTTGranted  byte = 0x10 // эфир захвачен
-	MsgPTTDenied   byte = 0x11 // эфир занят
-	MsgPTTReleased byte = 0x12 // эфир освободился
-	MsgRelayChunk  byte = 0x13 // медиа-чанк для listener'а
-	MsgPeerInfo    byte = 0x14 // JSON: список участников
+	MsgPTTGranted      byte = 0x10 // эфир захвачен
+	MsgPTTDenied       byte = 0x11 // эфир занят
+	MsgPTTReleased     byte = 0x12 // эфир освободился
+	MsgRelayChunk      byte = 0x13 // медиа-чанк для listener'а
+	MsgPeerInfo        byte = 0x14 // JSON: список участников
+	MsgWrongPassword   byte = 0x15 // неверный пароль комнаты, следом закрытие соединения
+	MsgPTTQueued       byte = 0x16 // эфир занят, запрос в очереди; payload — позиция, uint16 BE
+	MsgPTTRevoked      byte = 0x17 // сервер отобрал эфир; payload — причина (room.RevokeReason)
+	MsgPTTPreempted    byte = 0x18 // эфир перехватил участник с большим приоритетом; payload — его ID
+	MsgError           byte = 0x19 // запрос отклонён; payload — код (ErrCode*) и текст
+	MsgChatMessage     byte = 0x1A // JSON: сообщение чата
+	MsgChatHistory     byte = 0x1B // JSON: история чата (массив), при входе
+	MsgReactionEvent   byte = 0x1C // JSON: реакция и итоговые счётчики по передаче
+	MsgServerGoingAway byte = 0x1D // JSON: сервер останавливается, когда переподключаться; следом закрытие 1001
 )
 
+// Коды ошибок в MsgError.
+const (
+	ErrCodeListenOnly  byte = 0x01 // участник подключён только слушать
+	ErrCodeBadRequest  byte = 0x02 // некорректное сообщение
+	ErrCodeRateLimited byte = 0x03 // слишком часто
+)
+
+// peerJSON — участник в PEER_INFO.
+type peerJSON struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Role         string `json:"role"`
+	Reconnecting bool   `json:"reconnecting,omitempty"` // соединение оборвалось, ждём возврата
+}
+
 // peerInfoPayload — JSON-структура для PEER_INFO сообщения.
 type peerInfoPayload struct {
-	Peers  []string `json:"peers"`
-	Talker string   `json:"talker"`
+	Peers  []peerJSON `json:"peers"`
+	Talker string     `json:"talker"`          // ID talker'а, пусто — эфир свободен
+	Queue  []string   `json:"queue,omitempty"` // ID ждущих эфира, по порядку
+	You    string     `json:"you,omitempty"`   // ID получателя; только в первом PEER_INFO после входа
 }
 
 // Server — HTTP + WebSocket сервер TeleTalkie.
 type Server struct {
-	hub  *room.Hub
-	mux  *http.ServeMux
-	addr string
+	hub             *room.Hub
+	mux             *http.ServeMux
+	addr            string
+	recorder        *recorder.Recorder // nil — запись выключена
+	auth            Authenticator
+	log             *slog.Logger
+	metrics         *serverMetrics
+	metricsEndpoint bool
+	caCert          []byte // DER; nil — /ca.crt не отдаётся
+
+	httpSrv  *http.Server
+	connsMu  sync.Mutex
+	conns    int // открытые WebSocket'ы, для Shutdown
+	connsWG  sync.WaitGroup
+	closing  bool
+	shutdown chan struct{} // закрывается в Shutdown
+}
+
+// Option — опция сервера для New.
+type Option func(*Server)
+
+// WithRecorder включает запись каждой PTT-передачи на диск.
+func WithRecorder(rec *recorder.Recorder) Option {
+	return func(s *Server) {
+		s.recorder = rec
+	}
+}
+
+// WithLogger задаёт логгер сервера (по умолчанию slog.Default()).
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		s.log = l
+	}
+}
+
+// WithMetricsEndpoint включает или выключает GET /metrics (по умолчанию
+// выключен: эндпоинт без аутентификации). Счётчики считаются в любом случае.
+func WithMetricsEndpoint(enabled bool) Option {
+	return func(s *Server) {
+		s.metricsEndpoint = enabled
+	}
+}
+
+// WithAuthenticator задаёт проверку подключений к /ws (по умолчанию AnonymousAuth).
+func WithAuthenticator(a Authenticator) Option {
+	return func(s *Server) {
+		s.auth = a
+	}
+}
+
+// WithCACert отдаёт сертификат локального CA (DER) по GET /ca.crt, чтобы
+// его можно было скачать и установить на телефон.
+func WithCACert(der []byte) Option {
+	return func(s *Server) {
+		s.caCert = der
+	}
 }
 
 // New создаёт новый сервер.
-func New(addr string, webFS fs.FS, hub *room.Hub) *Server {
+func New(addr string, webFS fs.FS, hub *room.Hub, opts ...Option) *Server {
 	s := &Server{
-		hub:  hub,
-		mux:  http.NewServeMux(),
-		addr: addr,
+		hub:      hub,
+		mux:      http.NewServeMux(),
+		addr:     addr,
+		auth:     AnonymousAuth{},
+		log:      slog.Default(),
+		shutdown: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	_, anonymous := s.auth.(AnonymousAuth)
+	s.metrics = newServerMetrics(hub, anonymous)
+	s.httpSrv = &http.Server{Addr: addr, Handler: s.mux}
+	hub.SetEventHandler(s.handleRoomEvent)
 
 	// Специальные обработчики для PWA файлов с правильными MIME-типами
 	s.mux.HandleFunc("/manifest.json", func(w http.ResponseWriter, r *http.Request) {
@@ -64,41 +161,68 @@ func New(addr string, webFS fs.FS, hub *room.Hub) *Server {
 
 	s.mux.Handle("/", http.FileServer(http.FS(webFS)))
 	s.mux.HandleFunc("/ws", s.handleWS)
+	s.mux.HandleFunc("GET /api/qr", s.handleQR)
+	if s.metricsEndpoint {
+		s.mux.Handle("GET /metrics", s.metrics.reg)
+	}
+
+	if s.caCert != nil {
+		s.mux.HandleFunc("GET /ca.crt", s.handleCACert)
+	}
+
+	// API записей доступно только если запись включена.
+	if s.recorder != nil {
+		s.mux.HandleFunc("GET /api/rooms/{room}/recordings", s.handleListRecordings)
+		s.mux.HandleFunc("GET /api/recordings/{id}", s.handleGetRecording)
+	}
 
 	return s
 }
 
-// ListenAndServe запускает HTTP-сервер.
+// ListenAndServe запускает HTTP-сервер. После Shutdown возвращает
+// http.ErrServerClosed.
 func (s *Server) ListenAndServe() error {
-	log.Printf("server: listening on %s (http)", s.addr)
-	return http.ListenAndServe(s.addr, s.mux)
+	s.log.Info("listening", "addr", s.addr, "proto", "http")
+	return s.httpSrv.ListenAndServe()
 }
 
-// ListenAndServeTLS запускает HTTPS-сервер с переданным TLS-сертификатом.
-func (s *Server) ListenAndServeTLS(cert tls.Certificate) error {
-	tlsCfg := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-	}
-
+// ListenAndServeTLS запускает HTTPS-сервер. Сертификат берётся из
+// tlsCfg — в том числе через GetCertificate, если его нужно менять на
+// ходу. После Shutdown возвращает http.ErrServerClosed.
+func (s *Server) ListenAndServeTLS(tlsCfg *tls.Config) error {
 	ln, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return err
 	}
 
 	tlsLn := tls.NewListener(ln, tlsCfg)
-	log.Printf("server: listening on %s (https)", s.addr)
-	return http.Serve(tlsLn, s.mux)
+	s.log.Info("listening", "addr", s.addr, "proto", "https")
+	return s.httpSrv.Serve(tlsLn)
+}
+
+// handleCACert — GET /ca.crt. Такой MIME-тип Android и iOS открывают
+// как установку сертификата, а не как файл.
+func (s *Server) handleCACert(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="teletalkie-ca.crt"`)
+	w.Write(s.caCert)
 }
 
 // handleWS — WebSocket upgrade и обслуживание клиента.
 func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
-	roomID := r.URL.Query().Get("room")
-	name := r.URL.Query().Get("name")
-
-	if roomID == "" || name == "" {
-		http.Error(w, "missing room or name query param", http.StatusBadRequest)
+	ident, authErr := s.auth.Authenticate(r)
+	if errors.Is(authErr, errMissingParams) {
+		http.Error(w, authErr.Error(), http.StatusBadRequest)
 		return
 	}
+	role, err := room.ParseRole(ident.Role)
+	if authErr == nil && err != nil {
+		authErr = err
+	}
+	// Слушать может кто угодно — даже с токеном dispatcher'а.
+	if listen, _ := strconv.ParseBool(r.URL.Query().Get("listen")); listen {
+		role = room.RoleListener
+	}
 
 	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		// Разрешаем любой origin для разработки.
@@ -107,184 +231,376 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 		// Типичный размер чанка: 50-500KB для видео.
 		CompressionMode: websocket.CompressionDisabled, // отключаем сжатие для бинарных данных
 	})
+	if err != nil {
+		s.log.Warn("websocket accept failed", "event", "ws_accept_failed", "remote_addr", r.RemoteAddr, "err", err)
+		return
+	}
 	// Устанавливаем лимит чтения после Accept
 	conn.SetReadLimit(2 * 1024 * 1024) // 2MB
+
+	if !s.trackConn() {
+		conn.Close(websocket.StatusGoingAway, "server shutting down")
+		return
+	}
+	defer s.untrackConn()
+
+	// Отказ отдаём через close-код: браузер не видит HTTP-статус неудачного upgrade.
+	if authErr != nil {
+		s.log.Warn("auth failed", "event", "auth_failed", "room", ident.Room, "remote_addr", r.RemoteAddr, "err", authErr)
+		conn.Close(websocket.StatusPolicyViolation, "auth: "+authErr.Error())
+		return
+	}
+
+	sess, err := s.hub.Join(ident.Room, room.JoinOptions{
+		Name:        ident.Name,
+		Role:        role,
+		ResumeToken: r.URL.Query().Get("resume"),
+		Password:    r.URL.Query().Get("password"),
+	})
+	if errors.Is(err, room.ErrRoomFull) {
+		conn.Close(websocket.StatusPolicyViolation, "room is full")
+		return
+	}
 	if err != nil {
-		log.Printf("server: websocket accept error: %v", err)
+		// Сообщаем причину отдельным типом, чтобы клиент показал форму пароля,
+		// а не переподключался.
+		writeCtx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		conn.Write(writeCtx, websocket.MessageBinary, []byte{MsgWrongPassword})
+		cancel()
+		conn.Close(websocket.StatusPolicyViolation, "wrong room password")
 		return
 	}
 
-	peer := s.hub.Join(roomID, name)
+	peer := sess.Peer
+	logger := s.log.With("room", peer.Room.ID, "peer_id", peer.ID, "peer", peer.Name, "remote_addr", r.RemoteAddr)
+	// X-Request-ID проставляет reverse proxy (см. Caddyfile) — по нему
+	// соединение находится в его access-логе.
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		logger = logger.With("request_id", id)
+	}
 
-	// Контекст отменяется при закрытии соединения.
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
-	// Запускаем write-loop в отдельной горутине.
-	go s.writeLoop(ctx, conn, peer)
+	// Talker вернулся в эфир: клиент перезапускает запись с нового
+	// init-сегмента — начинаем и новый файл.
+	if sess.Resumed && peer.Room.CurrentTalker() == peer && s.recorder != nil {
+		s.recorder.Stop(peer.Room.ID, peer.ID)
+		s.recorder.Start(peer.Room.ID, peer.Name, peer.ID, peer.Room.Private())
+	}
+
+	// Запускаем write-loop в отдельной горутине. Когда он закрывает
+	// соединение, read-loop тоже должен завершиться.
+	go func() {
+		s.writeLoop(ctx, conn, sess, logger)
+		cancel()
+	}()
 
-	// Оповещаем всех в комнате о новом участнике.
-	s.broadcastPeerInfo(peer.Room)
+	// Новичку — PEER_INFO с его ID, остальным — обычный.
+	s.sendPeerInfo(peer, logger)
+	s.sendChatHistory(peer, logger)
 
 	// Read-loop блокирует текущую горутину.
-	s.readLoop(ctx, conn, peer)
+	graceful := s.readLoop(ctx, conn, peer, logger)
 
-	// Клиент отключился — убираем из комнаты.
-	s.hub.Leave(peer)
+	// Клиент отключился. Если соединение оборвалось — участник ждёт
+	// переподключения, иначе уходит; остальное — в handleRoomEvent.
+	// При остановке сервера ждать некого.
+	s.hub.Disconnect(sess, !graceful && !s.shuttingDown())
 	conn.CloseNow()
+}
 
-	// Оповещаем оставшихся участников.
-	s.broadcastPeerInfo(peer.Room)
+// handleRoomEvent реагирует на события комнат: смену talker'а, очередь
+// на эфир, обрывы и уходы участников. Эфир может перейти к участнику и без
+// его запроса в этот момент (из очереди), поэтому всё оповещение об эфире — здесь.
+func (s *Server) handleRoomEvent(ev room.Event) {
+	switch ev.Type {
+	case room.EventFloorGranted:
+		s.metrics.pttGrants.Inc()
+		if s.recorder != nil {
+			s.recorder.Start(ev.Room.ID, ev.Peer.Name, ev.Peer.ID, ev.Room.Private())
+		}
+		ev.Room.SendTo(ev.Peer, []byte{MsgPTTGranted})
+		s.broadcastPeerInfo(ev.Room)
+	case room.EventFloorRevoked:
+		if s.recorder != nil {
+			s.recorder.StopWithReason(ev.Room.ID, ev.Peer.ID, "revoked: "+ev.Reason.String())
+		}
+		ev.Room.SendTo(ev.Peer, []byte{MsgPTTRevoked, byte(ev.Reason)})
+	case room.EventFloorPreempted:
+		if s.recorder != nil {
+			s.recorder.StopWithReason(ev.Room.ID, ev.Peer.ID, "preempted by "+ev.By.String())
+		}
+		ev.Room.SendTo(ev.Peer, append([]byte{MsgPTTPreempted}, ev.By.ID...))
+	case room.EventFloorReleased:
+		if s.recorder != nil {
+			s.recorder.Stop(ev.Room.ID, ev.Peer.ID)
+		}
+		// Оповещаем всех остальных что эфир свободен.
+		ev.Room.Broadcast(ev.Peer, []byte{MsgPTTReleased})
+		s.broadcastPeerInfo(ev.Room)
+	case room.EventQueueChanged:
+		for i, p := range ev.Room.Queue() {
+			ev.Room.SendTo(p, []byte{MsgPTTQueued, byte((i + 1) >> 8), byte(i + 1)})
+		}
+		s.broadcastPeerInfo(ev.Room)
+	case room.EventDisconnected, room.EventLeft:
+		s.broadcastPeerInfo(ev.Room)
+	}
 }
 
 // readLoop читает сообщения из WebSocket, парсит тип и обрабатывает.
-func (s *Server) readLoop(ctx context.Context, conn *websocket.Conn, peer *room.Peer) {
+// Сообщение читается в буфер из пула relay; медиа-чанк уходит слушателям
+// в нём же, без копирования. Возвращает true, если клиент закрыл
+// соединение сам (ушёл из комнаты).
+func (s *Server) readLoop(ctx context.Context, conn *websocket.Conn, peer *room.Peer, logger *slog.Logger) (graceful bool) {
+	hint := 0 // размер прошлого сообщения: чанки talker'а обычно близки по размеру
 	for {
-		typ, data, err := conn.Read(ctx)
+		typ, r, err := conn.Reader(ctx)
+		var buf *relay.Buffer
+		if err == nil {
+			buf, err = relay.ReadFrom(r, hint)
+		}
 		if err != nil {
 			// Проверяем является ли это нормальным закрытием
 			if websocket.CloseStatus(err) == websocket.StatusNormalClosure ||
 				websocket.CloseStatus(err) == websocket.StatusGoingAway ||
 				websocket.CloseStatus(err) == websocket.StatusNoStatusRcvd {
-				log.Printf("server: client %q disconnected gracefully (status: %v)", peer.Name, websocket.CloseStatus(err))
-			} else {
-				log.Printf("server: read error for %q: %v", peer.Name, err)
+				logger.Info("client closed connection", "event", "ws_closed", "status", int(websocket.CloseStatus(err)))
+				return true
 			}
-			return
+			logger.Warn("read failed", "event", "ws_read_failed", "err", err)
+			return false
 		}
 
-		// Ожидаем только бинарные сообщения.
-		if typ != websocket.MessageBinary {
-			log.Printf("server: ignoring non-binary message from %q", peer.Name)
-			continue
-		}
+		hint = buf.Len()
+		s.handleMessage(peer, typ, buf, logger)
+		buf.Release()
+	}
+}
 
-		if len(data) == 0 {
-			continue
-		}
+// handleMessage разбирает одно сообщение клиента. Обработчики не держат
+// buf после возврата — кроме медиа, на которое комнаты берут свои ссылки.
+func (s *Server) handleMessage(peer *room.Peer, typ websocket.MessageType, buf *relay.Buffer, logger *slog.Logger) {
+	// Ожидаем только бинарные сообщения.
+	if typ != websocket.MessageBinary {
+		logger.Debug("ignoring non-binary message", "event", "bad_message")
+		return
+	}
+	data := buf.Bytes()
+	if len(data) == 0 {
+		return
+	}
 
-		msgType := data[0]
-		payload := data[1:]
+	msgType := data[0]
+	payload := data[1:]
 
-		switch msgType {
-		case MsgPTTOn:
-			s.handlePTTOn(ctx, conn, peer)
+	switch msgType {
+	case MsgPTTOn:
+		s.handlePTTOn(peer)
 
-		case MsgPTTOff:
-			s.handlePTTOff(peer)
+	case MsgPTTOff:
+		s.handlePTTOff(peer)
 
-		case MsgMediaChunk:
-			s.handleMediaChunk(peer, payload)
+	case MsgMediaChunk:
+		s.handleMediaChunk(peer, buf)
 
-		default:
-			log.Printf("server: unknown message type 0x%02x from %q", msgType, peer.Name)
-		}
+	case MsgChat:
+		s.handleChat(peer, payload, logger)
+
+	case MsgReaction:
+		s.handleReaction(peer, payload, logger)
+
+	default:
+		logger.Debug("unknown message type", "event", "bad_message", "type", fmt.Sprintf("0x%02x", msgType))
 	}
 }
 
-// writeLoop читает из канала peer.Send и пишет в WebSocket.
-// Также отправляет ping каждые 30 секунд для поддержания соединения.
-func (s *Server) writeLoop(ctx context.Context, conn *websocket.Conn, peer *room.Peer) {
+// writeLoop — единственный, кто пишет в соединение. Забирает очереди
+// участника: Control — в первую очередь, чтобы эфир и PEER_INFO не ждали
+// за видео, затем Media. Отправляет ping каждые 30 секунд и закрывает
+// соединение, когда сессия закрыта (участника подхватило новое соединение
+// или клиент не успевает за потоком) или сервер останавливается.
+func (s *Server) writeLoop(ctx context.Context, conn *websocket.Conn, sess *room.Session, logger *slog.Logger) {
+	peer := sess.Peer
+	media := peer.Media
 	pingTicker := time.NewTicker(30 * time.Second)
 	defer pingTicker.Stop()
 
 	for {
+		select {
+		case msg, ok := <-peer.Control:
+			if !ok || !s.writeMsg(ctx, conn, msg, logger) {
+				return
+			}
+			continue
+		default:
+		}
+
 		select {
 		case <-ctx.Done():
 			return
+		case <-s.shutdown:
+			s.writeGoingAway(ctx, conn, peer, logger)
+			return
+		case <-sess.Done():
+			if errors.Is(sess.Err(), room.ErrSlowConsumer) {
+				// Клиент переподключится и получит эфир с ключевого кадра.
+				conn.Close(websocket.StatusTryAgainLater, "slow consumer")
+			} else {
+				logger.Info("peer reconnected, closing stale connection", "event", "ws_superseded")
+			}
+			return
 		case <-pingTicker.C:
 			// Отправляем ping для keepalive
 			pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 			err := conn.Ping(pingCtx)
 			cancel()
 			if err != nil {
-				log.Printf("server: ping error for %q: %v", peer.Name, err)
+				s.metrics.pingFailures.Inc()
+				logger.Warn("ping failed", "event", "ws_ping_failed", "err", err)
 				return
 			}
-		case msg, ok := <-peer.Send:
-			if !ok {
-				// Канал закрыт — peer покинул комнату.
+		case msg, ok := <-peer.Control:
+			// Канал закрыт — peer покинул комнату.
+			if !ok || !s.writeMsg(ctx, conn, msg, logger) {
 				return
 			}
-			writeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-			err := conn.Write(writeCtx, websocket.MessageBinary, msg)
-			cancel()
-			if err != nil {
-				log.Printf("server: write error for %q: %v", peer.Name, err)
+		case msg, ok := <-media:
+			if !ok {
+				media = nil
+				continue
+			}
+			ok = s.writeMsg(ctx, conn, msg.Bytes(), logger)
+			n := msg.Len() - 1
+			msg.Release()
+			if !ok {
 				return
 			}
+			s.metrics.relayedChunks.Inc()
+			s.metrics.relayedBytes.Add(uint64(n))
 		}
 	}
 }
 
-// handlePTTOn — peer запрашивает эфир.
-func (s *Server) handlePTTOn(ctx context.Context, conn *websocket.Conn, peer *room.Peer) {
-	if peer.Room.TryAcquire(peer) {
-		// Эфир захвачен — подтверждаем talker'у.
-		writeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		conn.Write(writeCtx, websocket.MessageBinary, []byte{MsgPTTGranted})
-		cancel()
-		// Оповещаем всех кто сейчас говорит.
-		s.broadcastPeerInfo(peer.Room)
-	} else {
-		// Эфир занят — отказ.
-		writeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		conn.Write(writeCtx, websocket.MessageBinary, []byte{MsgPTTDenied})
-		cancel()
+// writeMsg пишет одно сообщение; false — соединение больше не годится.
+func (s *Server) writeMsg(ctx context.Context, conn *websocket.Conn, msg []byte, logger *slog.Logger) bool {
+	writeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := conn.Write(writeCtx, websocket.MessageBinary, msg); err != nil {
+		s.metrics.writeErrors.Inc()
+		logger.Warn("write failed", "event", "ws_write_failed", "bytes", len(msg), "err", err)
+		return false
 	}
+	return true
 }
 
-// handlePTTOff — peer освобождает эфир.
+// handlePTTOn — peer запрашивает эфир. GRANTED и QUEUED отправляет
+// handleRoomEvent; здесь — только отказ.
+func (s *Server) handlePTTOn(peer *room.Peer) {
+	if !peer.Role.CanTalk() {
+		s.sendError(peer, ErrCodeListenOnly, "listen-only peers cannot take the floor")
+		return
+	}
+	if granted, pos := peer.Room.RequestFloor(peer); !granted && pos == 0 {
+		s.metrics.pttDenials.Inc()
+		peer.Room.SendTo(peer, []byte{MsgPTTDenied})
+	}
+}
+
+// handlePTTOff — peer освобождает эфир или выходит из очереди.
+// Оповещение — в handleRoomEvent.
 func (s *Server) handlePTTOff(peer *room.Peer) {
 	peer.Room.Release(peer)
-	// Оповещаем всех остальных что эфир свободен.
-	peer.Room.Broadcast(peer, []byte{MsgPTTReleased})
-	// Обновляем список участников (talker сброшен).
-	s.broadcastPeerInfo(peer.Room)
 }
 
 // handleMediaChunk — relay медиа-чанка от talker'а ко всем.
-func (s *Server) handleMediaChunk(peer *room.Peer, payload []byte) {
-	// Только текущий talker может слать чанки.
-	if peer.Room.Talker != peer {
+// Room кэширует init-сегмент и последний ключевой фрагмент, чтобы
+// зашедшие посреди передачи сразу могли начать воспроизведение.
+// MEDIA_CHUNK и RELAY_CHUNK отличаются только типом, поэтому слушателям
+// уходит тот же буфер с переписанным первым байтом.
+func (s *Server) handleMediaChunk(peer *room.Peer, buf *relay.Buffer) {
+	if !peer.Role.CanTalk() {
+		s.sendError(peer, ErrCodeListenOnly, "listen-only peers cannot send media")
 		return
 	}
-	// Оборачиваем в серверный тип и рассылаем.
-	msg := make([]byte, 1+len(payload))
-	msg[0] = MsgRelayChunk
-	copy(msg[1:], payload)
-	peer.Room.Broadcast(peer, msg)
+	// Буфер ещё ни у кого, кроме нас, — менять его можно.
+	buf.Bytes()[0] = MsgRelayChunk
+	// Чанки принимаются только от текущего talker'а. Если эфир перехватят
+	// до записи, Recorder отбросит чанк по talkerID.
+	if peer.Room.BroadcastMedia(peer, buf) && s.recorder != nil {
+		s.recorder.Write(peer.Room.ID, peer.ID, buf.Bytes()[1:])
+	}
+}
+
+// sendError отправляет участнику MsgError.
+func (s *Server) sendError(peer *room.Peer, code byte, text string) {
+	msg := make([]byte, 0, 2+len(text))
+	msg = append(msg, MsgError, code)
+	msg = append(msg, text...)
+	peer.Room.SendTo(peer, msg)
 }
 
 // broadcastPeerInfo рассылает PEER_INFO всем участникам комнаты.
 func (s *Server) broadcastPeerInfo(r *room.Room) {
+	msg := peerInfoMessage(r, "", s.log)
+	if msg == nil {
+		return
+	}
+	// Рассылаем всем (sender=nil — получат все).
+	r.Broadcast(nil, msg)
+}
+
+// sendPeerInfo — PEER_INFO при входе: новичок узнаёт из поля you свой ID,
+// остальные получают обычный список.
+func (s *Server) sendPeerInfo(peer *room.Peer, logger *slog.Logger) {
+	if msg := peerInfoMessage(peer.Room, peer.ID, logger); msg != nil {
+		peer.Room.SendTo(peer, msg)
+	}
+	if msg := peerInfoMessage(peer.Room, "", logger); msg != nil {
+		peer.Room.Broadcast(peer, msg)
+	}
+}
+
+func peerInfoMessage(r *room.Room, you string, logger *slog.Logger) []byte {
 	peers := r.Peers()
 
-	names := make([]string, 0, len(peers))
+	list := make([]peerJSON, 0, len(peers))
 	for _, p := range peers {
-		names = append(names, p.Name)
+		list = append(list, peerJSON{ID: p.ID, Name: p.Name, Role: string(p.Role), Reconnecting: p.Reconnecting()})
 	}
 
-	talkerName := ""
-	if r.Talker != nil {
-		talkerName = r.Talker.Name
+	talkerID := ""
+	if talker := r.CurrentTalker(); talker != nil {
+		talkerID = talker.ID
+	}
+
+	var queue []string
+	for _, p := range r.Queue() {
+		queue = append(queue, p.ID)
 	}
 
 	info := peerInfoPayload{
-		Peers:  names,
-		Talker: talkerName,
+		Peers:  list,
+		Talker: talkerID,
+		Queue:  queue,
+		You:    you,
 	}
 
-	jsonData, err := json.Marshal(info)
+	return jsonMessage(logger, MsgPeerInfo, info)
+}
+
+// jsonMessage собирает сообщение протокола с JSON-payload'ом; nil — ошибка
+// маршалинга, она пишется в logger.
+func jsonMessage(logger *slog.Logger, typ byte, v any) []byte {
+	jsonData, err := json.Marshal(v)
 	if err != nil {
-		log.Printf("server: marshal peer info error: %v", err)
-		return
+		logger.Error("marshal payload failed", "type", fmt.Sprintf("0x%02x", typ), "err", err)
+		return nil
 	}
 
 	msg := make([]byte, 1+len(jsonData))
-	msg[0] = MsgPeerInfo
+	msg[0] = typ
 	copy(msg[1:], jsonData)
-
-	// Рассылаем всем (sender=nil — получат все).
-	r.Broadcast(nil, msg)
+	return msg
 }
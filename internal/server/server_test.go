@@ -1,13 +1,27 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/coder/websocket"
 
+	"teletalkie/internal/media/mediatest"
+	"teletalkie/internal/qr"
+	"teletalkie/internal/recorder"
 	"teletalkie/internal/room"
 	"teletalkie/web"
 )
@@ -211,3 +225,704 @@ func TestPeerInfoOnJoinAndLeave(t *testing.T) {
 		t.Fatalf("alice: expected PEER_INFO (0x%02x) on bob join, got 0x%02x", MsgPeerInfo, resp[0])
 	}
 }
+
+func readPeerInfo(t *testing.T, conn *websocket.Conn) peerInfoPayload {
+	t.Helper()
+	resp := readMsg(t, conn)
+	if resp[0] != MsgPeerInfo {
+		t.Fatalf("expected PEER_INFO (0x%02x), got 0x%02x", MsgPeerInfo, resp[0])
+	}
+	var info peerInfoPayload
+	if err := json.Unmarshal(resp[1:], &info); err != nil {
+		t.Fatalf("decode PEER_INFO: %v", err)
+	}
+	return info
+}
+
+func TestPeerInfoDistinguishesSameNames(t *testing.T) {
+	ts, _ := setupTestServer(t)
+
+	first := dial(t, ts, "room1", "alice")
+	me := readPeerInfo(t, first)
+	if me.You == "" || len(me.Peers) != 1 || me.Peers[0].ID != me.You {
+		t.Fatalf("first alice: expected own ID in you and peers, got %+v", me)
+	}
+
+	second := dial(t, ts, "room1", "alice")
+	other := readPeerInfo(t, second)
+	if other.You == "" || other.You == me.You {
+		t.Fatalf("second alice: expected a distinct ID, got %q (first %q)", other.You, me.You)
+	}
+
+	// Остальные получают список без you.
+	info := readPeerInfo(t, first)
+	if info.You != "" || len(info.Peers) != 2 {
+		t.Fatalf("first alice: expected two peers and no you, got %+v", info)
+	}
+
+	sendMsg(t, second, []byte{MsgPTTOn})
+	readMsgSkip(t, second) // GRANTED
+	if info := readPeerInfo(t, first); info.Talker != other.You {
+		t.Fatalf("expected talker %q, got %q", other.You, info.Talker)
+	}
+}
+
+func TestLateJoinerReceivesInitSegment(t *testing.T) {
+	ts, _ := setupTestServer(t)
+
+	alice := dial(t, ts, "room1", "alice")
+	carol := dial(t, ts, "room1", "carol")
+
+	sendMsg(t, alice, []byte{MsgPTTOn})
+	readMsgSkip(t, alice) // GRANTED
+
+	init := mediatest.WebMInit()
+	c1 := mediatest.WebMCluster(true, 0x11)
+	sendMsg(t, alice, slices.Concat([]byte{MsgMediaChunk}, init, c1))
+
+	// Carol была в комнате с начала — дожидаемся, что чанк разослан.
+	if resp := readMsgSkip(t, carol); resp[0] != MsgRelayChunk {
+		t.Fatalf("carol: expected relay chunk, got 0x%02x", resp[0])
+	}
+
+	// Bob заходит посреди передачи — первым получает init-сегмент и ключевой кластер.
+	bob := dial(t, ts, "room1", "bob")
+	resp := readMsgSkip(t, bob)
+	if resp[0] != MsgRelayChunk || !bytes.Equal(resp[1:], slices.Concat(init, c1)) {
+		t.Fatalf("bob: expected replay of init + keyframe cluster, got %d bytes", len(resp))
+	}
+
+	// Дальше идут live-чанки.
+	c2 := mediatest.WebMCluster(false, 0x22)
+	sendMsg(t, alice, slices.Concat([]byte{MsgMediaChunk}, c2))
+	resp = readMsgSkip(t, bob)
+	if resp[0] != MsgRelayChunk || !bytes.Equal(resp[1:], c2) {
+		t.Fatalf("bob: expected live chunk after replay, got %d bytes", len(resp))
+	}
+}
+
+func TestRecordingOnPTT(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := recorder.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(":0", web.FS, room.NewHub(), WithRecorder(rec))
+	ts := httptest.NewServer(srv.mux)
+	t.Cleanup(ts.Close)
+
+	alice := dial(t, ts, "room1", "alice")
+	bob := dial(t, ts, "room1", "bob")
+
+	sendMsg(t, alice, []byte{MsgPTTOn})
+	readMsgSkip(t, alice) // GRANTED
+
+	stream := slices.Concat(mediatest.WebMInit(), mediatest.WebMCluster(true, 0x11))
+	sendMsg(t, alice, slices.Concat([]byte{MsgMediaChunk}, stream))
+	readMsgSkip(t, bob) // RELAY_CHUNK
+
+	sendMsg(t, alice, []byte{MsgPTTOff})
+	readMsgSkip(t, bob) // PTT_RELEASED — передача завершена
+
+	files, _ := filepath.Glob(filepath.Join(dir, "room1", "*.webm"))
+	if len(files) != 1 {
+		t.Fatalf("expected one recording, got %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, stream) {
+		t.Fatalf("recording has %d bytes, want %d", len(data), len(stream))
+	}
+}
+
+func TestWrongRoomPassword(t *testing.T) {
+	ts, _ := setupTestServer(t)
+
+	alice := dialQuery(t, ts, "room=secret&name=alice&password=hunter2")
+	readMsg(t, alice) // PEER_INFO
+
+	bob := dialQuery(t, ts, "room=secret&name=bob&password=wrong")
+	if resp := readMsg(t, bob); len(resp) != 1 || resp[0] != MsgWrongPassword {
+		t.Fatalf("bob: expected WRONG_PASSWORD (0x%02x), got %v", MsgWrongPassword, resp)
+	}
+	expectClose(t, bob, websocket.StatusPolicyViolation)
+
+	carol := dialQuery(t, ts, "room=secret&name=carol&password=hunter2")
+	if resp := readMsg(t, carol); resp[0] != MsgPeerInfo {
+		t.Fatalf("carol: expected PEER_INFO with correct password, got 0x%02x", resp[0])
+	}
+}
+
+func TestRoomFull(t *testing.T) {
+	srv := New(":0", web.FS, room.NewHub(room.WithMaxPeers(1)))
+	ts := httptest.NewServer(srv.mux)
+	t.Cleanup(ts.Close)
+
+	alice := dial(t, ts, "room1", "alice")
+	readMsg(t, alice) // PEER_INFO
+
+	bob := dial(t, ts, "room1", "bob")
+	expectClose(t, bob, websocket.StatusPolicyViolation)
+}
+
+func TestResumeKeepsFloor(t *testing.T) {
+	ts, _ := setupTestServer(t)
+	const q = "room=room1&name=alice&resume=0123456789abcdef0123"
+
+	alice := dialQuery(t, ts, q)
+	me := readPeerInfo(t, alice)
+	bob := dial(t, ts, "room1", "bob")
+	readPeerInfo(t, bob)
+
+	sendMsg(t, alice, []byte{MsgPTTOn})
+	readMsgSkip(t, alice) // GRANTED
+
+	// Обрыв без close-фрейма — alice остаётся в комнате как переподключающаяся.
+	alice.CloseNow()
+	for {
+		info := readPeerInfo(t, bob)
+		if len(info.Peers) == 2 && info.Talker == me.You && slices.ContainsFunc(info.Peers, func(p peerJSON) bool {
+			return p.ID == me.You && p.Reconnecting
+		}) {
+			break
+		}
+	}
+
+	alice = dialQuery(t, ts, q)
+	info := readPeerInfo(t, alice)
+	if info.You != me.You || info.Talker != me.You {
+		t.Fatalf("expected resumed alice to keep ID %q and the floor, got %+v", me.You, info)
+	}
+
+	// Эфир по-прежнему у alice — bob получает отказ.
+	sendMsg(t, bob, []byte{MsgPTTOn})
+	if resp := readMsgSkip(t, bob); resp[0] != MsgPTTDenied {
+		t.Fatalf("bob: expected PTT_DENIED, got 0x%02x", resp[0])
+	}
+}
+
+func TestFloorQueue(t *testing.T) {
+	srv := New(":0", web.FS, room.NewHub(room.WithFloorQueue(true)))
+	ts := httptest.NewServer(srv.mux)
+	t.Cleanup(ts.Close)
+
+	alice := dial(t, ts, "room1", "alice")
+	bob := dial(t, ts, "room1", "bob")
+
+	sendMsg(t, alice, []byte{MsgPTTOn})
+	if resp := readMsgSkip(t, alice); resp[0] != MsgPTTGranted {
+		t.Fatalf("alice: expected PTT_GRANTED, got 0x%02x", resp[0])
+	}
+
+	sendMsg(t, bob, []byte{MsgPTTOn})
+	if resp := readMsgSkip(t, bob); !bytes.Equal(resp, []byte{MsgPTTQueued, 0, 1}) {
+		t.Fatalf("bob: expected PTT_QUEUED position 1, got %v", resp)
+	}
+
+	// Alice отпускает — эфир сам переходит к bob.
+	sendMsg(t, alice, []byte{MsgPTTOff})
+	if resp := readMsgSkip(t, bob); resp[0] != MsgPTTReleased {
+		t.Fatalf("bob: expected PTT_RELEASED, got 0x%02x", resp[0])
+	}
+	if resp := readMsgSkip(t, bob); resp[0] != MsgPTTGranted {
+		t.Fatalf("bob: expected PTT_GRANTED from queue, got 0x%02x", resp[0])
+	}
+}
+
+func TestMaxTalkRevokesFloor(t *testing.T) {
+	hub := room.NewHub(room.WithTalkLimits(room.TalkLimits{MaxTalk: 50 * time.Millisecond}))
+	srv := New(":0", web.FS, hub)
+	ts := httptest.NewServer(srv.mux)
+	t.Cleanup(ts.Close)
+
+	alice := dial(t, ts, "room1", "alice")
+	bob := dial(t, ts, "room1", "bob")
+
+	sendMsg(t, alice, []byte{MsgPTTOn})
+	readMsgSkip(t, alice) // GRANTED
+
+	if resp := readMsgSkip(t, alice); !bytes.Equal(resp, []byte{MsgPTTRevoked, byte(room.RevokeMaxTalk)}) {
+		t.Fatalf("alice: expected PTT_REVOKED (max talk), got %v", resp)
+	}
+	if resp := readMsgSkip(t, bob); resp[0] != MsgPTTReleased {
+		t.Fatalf("bob: expected PTT_RELEASED, got 0x%02x", resp[0])
+	}
+}
+
+func TestDispatcherPreemptsMember(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := recorder.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(":0", web.FS, room.NewHub(), WithRecorder(rec), WithAuthenticator(TokenAuth{Secret: testSecret}))
+	ts := httptest.NewServer(srv.mux)
+	t.Cleanup(ts.Close)
+
+	alice := dialQuery(t, ts, "token="+issueToken(t, "room1", "alice", time.Hour))
+	disp := dialQuery(t, ts, "token="+issueRoleToken(t, "room1", "dispatch", "dispatcher", time.Hour))
+	dispID := readPeerInfo(t, disp).You
+
+	sendMsg(t, alice, []byte{MsgPTTOn})
+	readMsgSkip(t, alice) // GRANTED
+	sendMsg(t, alice, slices.Concat([]byte{MsgMediaChunk}, mediatest.WebMInit(), mediatest.WebMCluster(true, 0x11)))
+	readMsgSkip(t, disp) // RELAY_CHUNK
+
+	sendMsg(t, disp, []byte{MsgPTTOn})
+	if resp := readMsgSkip(t, disp); resp[0] != MsgPTTReleased {
+		t.Fatalf("dispatcher: expected PTT_RELEASED of alice's transmission, got 0x%02x", resp[0])
+	}
+	if resp := readMsgSkip(t, disp); resp[0] != MsgPTTGranted {
+		t.Fatalf("dispatcher: expected PTT_GRANTED, got 0x%02x", resp[0])
+	}
+	resp := readMsgSkip(t, alice)
+	if resp[0] != MsgPTTPreempted || string(resp[1:]) != dispID {
+		t.Fatalf("alice: expected PTT_PREEMPTED by %q, got %v", dispID, resp)
+	}
+
+	// Member не может перебить dispatcher'а.
+	sendMsg(t, alice, []byte{MsgPTTOn})
+	if resp := readMsgSkip(t, alice); resp[0] != MsgPTTDenied {
+		t.Fatalf("alice: expected PTT_DENIED, got 0x%02x", resp[0])
+	}
+
+	metas, err := rec.List("room1", recorder.Filter{Talker: "alice"})
+	if err != nil || len(metas) != 1 {
+		t.Fatalf("expected alice's recording, got %v (%v)", metas, err)
+	}
+	if !strings.HasPrefix(metas[0].EndReason, "preempted by") {
+		t.Fatalf("expected preemption in end_reason, got %q", metas[0].EndReason)
+	}
+}
+
+func TestListenOnlyPeer(t *testing.T) {
+	ts, _ := setupTestServer(t)
+
+	alice := dial(t, ts, "room1", "alice")
+	readPeerInfo(t, alice)
+	monitor := dialQuery(t, ts, "room=room1&name=monitor&listen=1")
+	me := readPeerInfo(t, monitor)
+
+	info := readPeerInfo(t, alice)
+	i := slices.IndexFunc(info.Peers, func(p peerJSON) bool { return p.ID == me.You })
+	if i < 0 || info.Peers[i].Role != string(room.RoleListener) {
+		t.Fatalf("expected monitor marked as listener in PEER_INFO, got %+v", info.Peers)
+	}
+
+	sendMsg(t, monitor, []byte{MsgPTTOn})
+	if resp := readMsgSkip(t, monitor); resp[0] != MsgError || resp[1] != ErrCodeListenOnly {
+		t.Fatalf("monitor: expected listen-only error, got %v", resp)
+	}
+
+	sendMsg(t, monitor, []byte{MsgMediaChunk, 0xFF})
+	if resp := readMsgSkip(t, monitor); resp[0] != MsgError || resp[1] != ErrCodeListenOnly {
+		t.Fatalf("monitor: expected listen-only error for media, got %v", resp)
+	}
+
+	// Эфир остался свободен.
+	sendMsg(t, alice, []byte{MsgPTTOn})
+	if resp := readMsgSkip(t, alice); resp[0] != MsgPTTGranted {
+		t.Fatalf("alice: expected PTT_GRANTED, got 0x%02x", resp[0])
+	}
+}
+
+func TestListenerRoleFromToken(t *testing.T) {
+	ts := setupTokenServer(t)
+
+	monitor := dialQuery(t, ts, "token="+issueRoleToken(t, "room1", "monitor", "listener", time.Hour))
+	readPeerInfo(t, monitor)
+
+	sendMsg(t, monitor, []byte{MsgPTTOn})
+	if resp := readMsgSkip(t, monitor); resp[0] != MsgError || resp[1] != ErrCodeListenOnly {
+		t.Fatalf("monitor: expected listen-only error, got %v", resp)
+	}
+}
+
+func readChat(t *testing.T, conn *websocket.Conn) chatJSON {
+	t.Helper()
+	resp := readMsgSkip(t, conn)
+	if resp[0] != MsgChatMessage {
+		t.Fatalf("expected CHAT_MESSAGE (0x%02x), got 0x%02x", MsgChatMessage, resp[0])
+	}
+	var m chatJSON
+	if err := json.Unmarshal(resp[1:], &m); err != nil {
+		t.Fatalf("decode chat: %v", err)
+	}
+	return m
+}
+
+func TestChatBroadcastAndReply(t *testing.T) {
+	ts, _ := setupTestServer(t)
+
+	alice := dial(t, ts, "room1", "alice")
+	aliceID := readPeerInfo(t, alice).You
+	bob := dial(t, ts, "room1", "bob")
+
+	sendMsg(t, alice, append([]byte{MsgChat}, `{"text":"  привет  "}`...))
+	// Сообщение получают все, включая отправителя.
+	first := readChat(t, alice)
+	if got := readChat(t, bob); got != first {
+		t.Fatalf("bob got %+v, alice got %+v", got, first)
+	}
+	if first.ID == "" || first.SenderID != aliceID || first.Sender != "alice" || first.Text != "привет" || first.Time.IsZero() {
+		t.Fatalf("unexpected chat message: %+v", first)
+	}
+
+	sendMsg(t, bob, append([]byte{MsgChat}, `{"text":"и тебе","reply_to":"`+first.ID+`"}`...))
+	if reply := readChat(t, alice); reply.ReplyTo != first.ID || reply.Sender != "bob" {
+		t.Fatalf("expected reply to %q from bob, got %+v", first.ID, reply)
+	}
+	readChat(t, bob) // собственный ответ
+
+	sendMsg(t, bob, append([]byte{MsgChat}, `{"text":"   "}`...))
+	if resp := readMsgSkip(t, bob); resp[0] != MsgError || resp[1] != ErrCodeBadRequest {
+		t.Fatalf("bob: expected bad request error for empty message, got %v", resp)
+	}
+}
+
+func TestChatHistoryReplayedToNewcomer(t *testing.T) {
+	ts, _ := setupTestServer(t)
+
+	alice := dial(t, ts, "room1", "alice")
+	for _, text := range []string{"one", "two"} {
+		sendMsg(t, alice, append([]byte{MsgChat}, `{"text":"`+text+`"}`...))
+		readChat(t, alice)
+	}
+
+	bob := dial(t, ts, "room1", "bob")
+	readPeerInfo(t, bob)
+	resp := readMsg(t, bob)
+	if resp[0] != MsgChatHistory {
+		t.Fatalf("bob: expected CHAT_HISTORY after PEER_INFO, got 0x%02x", resp[0])
+	}
+	var history []chatJSON
+	if err := json.Unmarshal(resp[1:], &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Text != "one" || history[1].Text != "two" {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+}
+
+func TestChatRateLimited(t *testing.T) {
+	ts, _ := setupTestServer(t)
+
+	alice := dial(t, ts, "room1", "alice")
+	bob := dial(t, ts, "room1", "bob")
+	readPeerInfo(t, bob)
+
+	const sent = 30
+	for range sent {
+		sendMsg(t, alice, append([]byte{MsgChat}, `{"text":"spam"}`...))
+	}
+	chats, limited := 0, 0
+	for range sent {
+		switch resp := readMsgSkip(t, alice); {
+		case resp[0] == MsgChatMessage:
+			chats++
+		case resp[0] == MsgError && resp[1] == ErrCodeRateLimited:
+			limited++
+		default:
+			t.Fatalf("alice: unexpected message %v", resp)
+		}
+	}
+	if limited == 0 || chats+limited != sent {
+		t.Fatalf("expected part of the spam rate-limited: %d delivered, %d limited", chats, limited)
+	}
+	// Остальным уходят только принятые сообщения.
+	for range chats {
+		readChat(t, bob)
+	}
+}
+
+func TestReactionBroadcast(t *testing.T) {
+	ts, _ := setupTestServer(t)
+
+	alice := dial(t, ts, "room1", "alice")
+	aliceID := readPeerInfo(t, alice).You
+	bob := dial(t, ts, "room1", "bob")
+	bobID := readPeerInfo(t, bob).You
+
+	sendMsg(t, bob, append([]byte{MsgReaction}, "👍"...))
+	if resp := readMsgSkip(t, bob); resp[0] != MsgError || resp[1] != ErrCodeBadRequest {
+		t.Fatalf("bob: expected error without transmission, got %v", resp)
+	}
+
+	sendMsg(t, alice, []byte{MsgPTTOn})
+	if resp := readMsgSkip(t, alice); resp[0] != MsgPTTGranted {
+		t.Fatalf("alice: expected PTT_GRANTED, got 0x%02x", resp[0])
+	}
+
+	sendMsg(t, bob, append([]byte{MsgReaction}, "👍"...))
+	// Реакцию получают все, включая talker'а.
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		resp := readMsgSkip(t, conn)
+		if resp[0] != MsgReactionEvent {
+			t.Fatalf("expected REACTION, got 0x%02x", resp[0])
+		}
+		var ev reactionJSON
+		if err := json.Unmarshal(resp[1:], &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.From != bobID || ev.Emoji != "👍" || ev.TalkerID != aliceID || ev.Counts["👍"] != 1 {
+			t.Fatalf("unexpected reaction: %+v", ev)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	srv := New(":0", web.FS, room.NewHub(), WithMetricsEndpoint(true))
+	ts := httptest.NewServer(srv.mux)
+	t.Cleanup(ts.Close)
+
+	alice := dial(t, ts, "room1", "alice")
+	bob := dial(t, ts, "room1", "bob")
+	readPeerInfo(t, bob)
+	dialQuery(t, ts, "room=secret-ops&name=carol&password=hunter2")
+
+	sendMsg(t, alice, []byte{MsgPTTOn})
+	if resp := readMsgSkip(t, alice); resp[0] != MsgPTTGranted {
+		t.Fatalf("alice: expected PTT_GRANTED, got 0x%02x", resp[0])
+	}
+	sendMsg(t, bob, []byte{MsgPTTOn})
+	if resp := readMsgSkip(t, bob); resp[0] != MsgPTTDenied {
+		t.Fatalf("bob: expected PTT_DENIED, got 0x%02x", resp[0])
+	}
+	sendMsg(t, alice, append([]byte{MsgMediaChunk}, "chunk"...))
+	if resp := readMsgSkip(t, bob); resp[0] != MsgRelayChunk {
+		t.Fatalf("bob: expected RELAY_CHUNK, got 0x%02x", resp[0])
+	}
+
+	scrape := func() string {
+		resp, err := http.Get(ts.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	// Счётчик relay растёт после записи в сокет — bob мог прочитать чанк раньше.
+	body := scrape()
+	for deadline := time.Now().Add(time.Second); !strings.Contains(body, "teletalkie_relayed_chunks_total 1\n") && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		body = scrape()
+	}
+
+	for deadline := time.Now().Add(time.Second); !strings.Contains(body, "teletalkie_unlisted_room_peers 1\n") && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		body = scrape()
+	}
+
+	if strings.Contains(body, "secret-ops") {
+		t.Errorf("private room name leaked into metrics:\n%s", body)
+	}
+	for _, line := range []string{
+		"teletalkie_rooms 2",
+		`teletalkie_room_peers{room="room1"} 2`,
+		"teletalkie_unlisted_room_peers 1",
+		"teletalkie_active_talkers 1",
+		"teletalkie_ptt_grants_total 1",
+		"teletalkie_ptt_denials_total 1",
+		"teletalkie_relayed_chunks_total 1",
+		"teletalkie_relayed_bytes_total 5",
+		"teletalkie_dropped_messages_total 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetrics_RoomLabels(t *testing.T) {
+	scrape := func(t *testing.T, srv *Server) string {
+		t.Helper()
+		ts := httptest.NewServer(srv.mux)
+		defer ts.Close()
+		resp, err := http.Get(ts.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	join := func(t *testing.T, hub *room.Hub, roomID string, peers int) {
+		t.Helper()
+		for i := range peers {
+			if _, err := hub.Join(roomID, room.JoinOptions{Name: fmt.Sprint("p", i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("capped", func(t *testing.T) {
+		hub := room.NewHub()
+		join(t, hub, "big", 3)
+		for i := range maxRoomSeries + 4 {
+			join(t, hub, fmt.Sprintf("r%02d", i), 1)
+		}
+		body := scrape(t, New(":0", web.FS, hub, WithMetricsEndpoint(true)))
+		if n := strings.Count(body, "teletalkie_room_peers{"); n != maxRoomSeries {
+			t.Errorf("got %d room series, want %d:\n%s", n, maxRoomSeries, body)
+		}
+		// Самые большие комнаты — в сериях, остальные — в сумме.
+		for _, line := range []string{`teletalkie_room_peers{room="big"} 3`, "teletalkie_unlisted_room_peers 5"} {
+			if !strings.Contains(body, line+"\n") {
+				t.Errorf("metrics missing %q:\n%s", line, body)
+			}
+		}
+	})
+
+	t.Run("token auth", func(t *testing.T) {
+		hub := room.NewHub()
+		join(t, hub, "ops-7f3a", 2)
+		body := scrape(t, New(":0", web.FS, hub, WithMetricsEndpoint(true), WithAuthenticator(TokenAuth{Secret: testSecret})))
+		if strings.Contains(body, "ops-7f3a") || strings.Contains(body, "teletalkie_room_peers{") {
+			t.Errorf("room names must stay out of metrics with join tokens:\n%s", body)
+		}
+		if !strings.Contains(body, "teletalkie_unlisted_room_peers 2\n") {
+			t.Errorf("expected peers counted in the total:\n%s", body)
+		}
+	})
+}
+
+func TestCACertDownload(t *testing.T) {
+	der := []byte{0x30, 0x82, 0x01, 0x02}
+	ts := httptest.NewServer(New(":0", web.FS, room.NewHub(), WithCACert(der)).mux)
+	t.Cleanup(ts.Close)
+
+	resp, err := http.Get(ts.URL + "/ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-x509-ca-cert" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	if !bytes.Equal(body, der) {
+		t.Fatalf("body %x, want %x", body, der)
+	}
+
+	// Без CA путь не перехватывается — остаётся за статикой.
+	ts2, _ := setupTestServer(t)
+	resp, err = http.Get(ts2.URL + "/ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("without CA: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestQRCode(t *testing.T) {
+	ts, _ := setupTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/api/qr?room=" + url.QueryEscape("ops 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// Картинка — код ссылки на тот же адрес с комнатой.
+	code, err := qr.Encode([]byte(ts.URL+"/?room=ops+1"), qr.M)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := code.PNG(qrScale)
+	if !bytes.Equal(body, want) {
+		t.Fatal("PNG does not encode the join link")
+	}
+
+	resp, err = http.Get(ts.URL + "/api/qr?room=" + strings.Repeat("x", 3000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("too long room: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestShutdownNotifiesClients(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := recorder.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(":0", web.FS, room.NewHub(), WithRecorder(rec))
+	ts := httptest.NewServer(srv.mux)
+	t.Cleanup(ts.Close)
+
+	alice := dial(t, ts, "room1", "alice")
+	sendMsg(t, alice, []byte{MsgPTTOn})
+	if resp := readMsgSkip(t, alice); resp[0] != MsgPTTGranted {
+		t.Fatalf("alice: expected PTT_GRANTED, got 0x%02x", resp[0])
+	}
+	sendMsg(t, alice, append([]byte{MsgMediaChunk}, mediatest.WebMInit()...))
+	// Сайдкар появляется с первым записанным чанком.
+	var paths []string
+	for deadline := time.Now().Add(time.Second); len(paths) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		paths, _ = filepath.Glob(filepath.Join(dir, "room1", "*.json"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- srv.Shutdown(ctx) }()
+
+	resp := readMsgSkip(t, alice)
+	if resp[0] != MsgServerGoingAway {
+		t.Fatalf("alice: expected SERVER_GOING_AWAY, got 0x%02x", resp[0])
+	}
+	var hint goingAwayJSON
+	if err := json.Unmarshal(resp[1:], &hint); err != nil || hint.RetryAfterMs <= 0 {
+		t.Fatalf("bad going-away payload %q: %v", resp[1:], err)
+	}
+	if _, _, err := alice.Read(ctx); websocket.CloseStatus(err) != websocket.StatusGoingAway {
+		t.Fatalf("alice: expected close 1001, got %v", err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	// Запись передачи завершена с причиной.
+	if len(paths) != 1 {
+		t.Fatalf("expected 1 recording, got %d", len(paths))
+	}
+	data, _ := os.ReadFile(paths[0])
+	var meta recorder.Meta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.EndedAt == nil || meta.EndReason != "server shutdown" {
+		t.Fatalf("expected finalized recording, got %+v", meta)
+	}
+
+	// Новые подключения после Shutdown закрываются сразу.
+	late := dial(t, ts, "room1", "bob")
+	if _, _, err := late.Read(ctx); websocket.CloseStatus(err) != websocket.StatusGoingAway {
+		t.Fatalf("bob: expected close 1001, got %v", err)
+	}
+}
+
+func TestJSONMessage_LogsToGivenLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil)).With("request_id", "req-42")
+
+	if msg := jsonMessage(logger, MsgChatMessage, map[string]any{"bad": make(chan int)}); msg != nil {
+		t.Fatalf("expected nil for an unmarshalable payload, got %q", msg)
+	}
+	if out := buf.String(); !strings.Contains(out, `"request_id":"req-42"`) || !strings.Contains(out, "marshal payload failed") {
+		t.Fatalf("error must go to the connection logger, got %q", out)
+	}
+}
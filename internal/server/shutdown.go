@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"teletalkie/internal/room"
+)
+
+// shutdownRetryAfter — через сколько клиенту советуют переподключаться
+// после MsgServerGoingAway: обычно столько занимает перезапуск.
+const shutdownRetryAfter = 3 * time.Second
+
+// goingAwayJSON — payload MsgServerGoingAway.
+type goingAwayJSON struct {
+	RetryAfterMs int64 `json:"retry_after_ms"`
+}
+
+// trackConn регистрирует WebSocket-соединение для Shutdown. false — сервер
+// уже останавливается, соединение нужно закрыть.
+func (s *Server) trackConn() bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns++
+	s.connsWG.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn() {
+	s.connsMu.Lock()
+	s.conns--
+	s.connsMu.Unlock()
+	s.connsWG.Done()
+}
+
+func (s *Server) shuttingDown() bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	return s.closing
+}
+
+// writeGoingAway — последнее, что write-loop пишет при остановке сервера:
+// то, что успело встать в Control, MsgServerGoingAway и закрытие с кодом 1001.
+func (s *Server) writeGoingAway(ctx context.Context, conn *websocket.Conn, peer *room.Peer, logger *slog.Logger) {
+	for pending := true; pending; {
+		select {
+		case msg, ok := <-peer.Control:
+			pending = ok && s.writeMsg(ctx, conn, msg, logger)
+		default:
+			pending = false
+		}
+	}
+	msg := jsonMessage(logger, MsgServerGoingAway, goingAwayJSON{RetryAfterMs: shutdownRetryAfter.Milliseconds()})
+	s.writeMsg(ctx, conn, msg, logger)
+	conn.Close(websocket.StatusGoingAway, "server shutting down")
+}
+
+// Shutdown останавливает сервер: перестаёт принимать подключения,
+// завершает идущие записи, рассылает клиентам MsgServerGoingAway с
+// подсказкой, когда переподключаться, и закрывает WebSocket'ы с кодом 1001.
+// Ждёт, пока все соединения завершатся, но не дольше ctx.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connsMu.Lock()
+	if s.closing {
+		s.connsMu.Unlock()
+		return errors.New("server: already shut down")
+	}
+	s.closing = true
+	conns := s.conns
+	s.connsMu.Unlock()
+
+	s.log.Info("shutting down", "event", "shutdown", "connections", conns)
+
+	// Эфир, который освободится при закрытии соединений, может перейти
+	// следующему в очереди — новые записи уже не начинаем.
+	if s.recorder != nil {
+		s.recorder.Close("server shutdown")
+	}
+
+	// Write-loop'ы сами оповестят клиентов и закроют соединения.
+	close(s.shutdown)
+
+	err := s.httpSrv.Shutdown(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		s.connsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = errors.Join(err, ctx.Err())
+	}
+	return err
+}
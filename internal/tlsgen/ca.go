@@ -0,0 +1,309 @@
+package tlsgen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFile = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 90 * 24 * time.Hour
+	leafRenew    = 7 * 24 * time.Hour // перевыпускать leaf за неделю до конца срока
+
+	// Сколько адресов и имён сверх адресов интерфейсов и leafNames leaf
+	// переносит из прежнего при перевыпуске: клиентам на двух адресах или
+	// именах не нужен новый ключ на каждом соединении, а SNI из сети не
+	// раздувает сертификат бесконечно.
+	maxExtraIPs   = 16
+	maxExtraNames = 4
+)
+
+// lanRanges — адреса, за которые может поручиться локальный CA (name
+// constraints): частные сети, CGNAT, loopback и link-local. Даже если
+// ключ CA утечёт, им не подписать сертификат публичного сайта.
+var lanRanges = mustParseCIDRs(
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10",
+	"127.0.0.0/8", "169.254.0.0/16",
+	"::1/128", "fc00::/7", "fe80::/10",
+)
+
+// lanDomains — имена, за которые может поручиться локальный CA.
+var lanDomains = []string{"localhost", "local"}
+
+// leafNames — имена в leaf-сертификатах: teletalkie.local сервер
+// объявляет по mDNS (пакет mdns). Если имя в сети занято, сервер
+// объявляет teletalkie-2.local и так далее — такие имена попадают
+// в leaf, когда клиент приходит на них (SNI).
+var leafNames = []string{"localhost", "teletalkie.local"}
+
+// CA — локальный корневой сертификат. Его один раз устанавливают на
+// телефоны, после чего им доверяют все выпущенные им leaf-сертификаты —
+// и после перезапуска сервера, и после смены IP.
+type CA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+
+	mu   sync.Mutex
+	leaf *tls.Certificate
+}
+
+// LoadOrCreateCA загружает CA из dir, а если его там нет или срок его
+// истёк — создаёт новый и сохраняет (ключ — с правами 0600). created
+// сообщает, что CA новый и его нужно установить на устройства.
+func LoadOrCreateCA(dir string) (ca *CA, created bool, err error) {
+	certPath, keyPath := filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile)
+	certPEM, err := os.ReadFile(certPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, false, fmt.Errorf("tlsgen: %w", err)
+	default:
+		keyPEM, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, false, fmt.Errorf("tlsgen: %w", err)
+		}
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, false, fmt.Errorf("tlsgen: load CA from %s: %w", dir, err)
+		}
+		if !pair.Leaf.IsCA {
+			return nil, false, fmt.Errorf("tlsgen: %s is not a CA certificate", certPath)
+		}
+		if time.Now().Before(pair.Leaf.NotAfter) {
+			return &CA{cert: pair.Leaf, key: pair.PrivateKey.(crypto.Signer)}, false, nil
+		}
+	}
+
+	ca, keyPEM, err := newCA()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, false, fmt.Errorf("tlsgen: %w", err)
+	}
+	// Ключ пишется первым: без ca.pem каталог считается пустым, так что
+	// оборванная запись исправится при следующем запуске.
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		return nil, false, fmt.Errorf("tlsgen: %w", err)
+	}
+	if err := os.WriteFile(certPath, ca.PEM(), 0o644); err != nil {
+		return nil, false, fmt.Errorf("tlsgen: %w", err)
+	}
+	return ca, true, nil
+}
+
+func newCA() (*CA, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tlsgen: generate key: %w", err)
+	}
+	serialNumber, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	name := "TeleTalkie Local CA"
+	if host, err := os.Hostname(); err == nil {
+		name += " (" + host + ")"
+	}
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"TeleTalkie"},
+			CommonName:   name,
+		},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		PermittedDNSDomains:   lanDomains,
+		PermittedIPRanges:     lanRanges,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tlsgen: create CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tlsgen: parse CA certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tlsgen: marshal key: %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return &CA{cert: cert, key: key}, keyPEM, nil
+}
+
+// DER — сертификат CA для установки на устройства.
+func (ca *CA) DER() []byte { return ca.cert.Raw }
+
+// PEM — сертификат CA в PEM.
+func (ca *CA) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// GetCertificate — для tls.Config.GetCertificate. Отдаёт leaf-сертификат,
+// подписанный CA, для localhost, teletalkie.local и LAN-адресов
+// интерфейсов. Leaf перевыпускается, если клиент пришёл на адрес или
+// mDNS-имя teletalkie-N.local, которых в нём нет (сменился IP, появился
+// интерфейс, имя в сети оказалось занято), и незадолго до конца срока.
+// Новый leaf сохраняет адреса и имена прежнего.
+func (ca *CA) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var local net.IP
+	if hello.Conn != nil {
+		if a, ok := hello.Conn.LocalAddr().(*net.TCPAddr); ok {
+			local = a.IP
+		}
+	}
+	name := renamedHost(hello.ServerName)
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if ca.leaf != nil && covers(ca.leaf.Leaf, local, name) && time.Until(ca.leaf.Leaf.NotAfter) > leafRenew {
+		return ca.leaf, nil
+	}
+	var ips []net.IP
+	var names []string
+	if ca.leaf != nil {
+		ips = slices.Clone(ca.leaf.Leaf.IPAddresses)
+		names = slices.Clone(ca.leaf.Leaf.DNSNames)
+	}
+	if local != nil {
+		ips = append(ips, local)
+	}
+	if name != "" {
+		names = append(names, name)
+	}
+	leaf, err := ca.issue(ips, names)
+	if err != nil {
+		return nil, err
+	}
+	ca.leaf = leaf
+	return leaf, nil
+}
+
+// covers сообщает, есть ли ip и name в сертификате. Адрес, за который
+// CA поручиться не может, перевыпуском не исправить — считается покрытым.
+func covers(cert *x509.Certificate, ip net.IP, name string) bool {
+	if name != "" && !slices.Contains(cert.DNSNames, name) {
+		return false
+	}
+	return ip == nil || !lanIP(ip) || slices.ContainsFunc(cert.IPAddresses, ip.Equal)
+}
+
+// renamedHost возвращает SNI в нижнем регистре, если это имя вида
+// teletalkie-N.local, и "" для остальных: кто угодно в сети может
+// прислать любой SNI, а в leaf попадают только имена сервера.
+func renamedHost(sni string) string {
+	sni = strings.ToLower(strings.TrimSuffix(sni, "."))
+	n, ok := strings.CutPrefix(sni, "teletalkie-")
+	if !ok {
+		return ""
+	}
+	n, ok = strings.CutSuffix(n, ".local")
+	if !ok || n == "" || len(n) > 4 || strings.Trim(n, "0123456789") != "" {
+		return ""
+	}
+	return sni
+}
+
+// issue выпускает leaf для leafNames, LAN-адресов интерфейсов и
+// последних maxExtraIPs из extraIPs и maxExtraNames из extraNames.
+func (ca *CA) issue(extraIPs []net.IP, extraNames []string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("tlsgen: generate key: %w", err)
+	}
+	serialNumber, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && lanIP(ipNet.IP) {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+	var moreIPs []net.IP
+	for _, ip := range slices.Backward(extraIPs) {
+		if len(moreIPs) < maxExtraIPs && lanIP(ip) &&
+			!slices.ContainsFunc(ips, ip.Equal) && !slices.ContainsFunc(moreIPs, ip.Equal) {
+			moreIPs = append(moreIPs, ip)
+		}
+	}
+	ips = append(ips, moreIPs...)
+	names := slices.Clip(leafNames)
+	for _, name := range slices.Backward(extraNames) {
+		if len(names) < len(leafNames)+maxExtraNames && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"TeleTalkie"},
+		},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(leafValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              names,
+		IPAddresses:           ips,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("tlsgen: create certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("tlsgen: parse certificate: %w", err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// lanIP сообщает, может ли локальный CA поручиться за ip.
+func lanIP(ip net.IP) bool {
+	return slices.ContainsFunc(lanRanges, func(n *net.IPNet) bool { return n.Contains(ip) })
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
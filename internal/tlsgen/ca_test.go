@@ -0,0 +1,207 @@
+package tlsgen
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// addrConn — net.Conn, у которого есть только локальный адрес.
+type addrConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr { return c.local }
+
+func hello(ip string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{Conn: addrConn{local: &net.TCPAddr{IP: net.ParseIP(ip), Port: 8080}}}
+}
+
+func verify(t *testing.T, ca *CA, cert *tls.Certificate, host string) error {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	_, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: host})
+	return err
+}
+
+func TestLoadOrCreateCA_Persists(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	ca, created, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created {
+		t.Fatal("expected a new CA in an empty directory")
+	}
+	if fi, err := os.Stat(filepath.Join(dir, caKeyFile)); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("CA key must be private: %v %v", fi.Mode(), err)
+	}
+
+	again, created, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created || !bytes.Equal(again.DER(), ca.DER()) {
+		t.Fatal("expected the same CA after reload")
+	}
+
+	// Leaf, выпущенный загруженным CA, проверяется исходным сертификатом.
+	cert, err := again.GetCertificate(hello("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(t, ca, cert, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"localhost", "teletalkie.local"} {
+		if err := verify(t, ca, cert, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetCertificate_ReissuesForNewIP(t *testing.T) {
+	ca, _, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := ca.GetCertificate(hello("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same, _ := ca.GetCertificate(hello("127.0.0.1")); same != first {
+		t.Fatal("expected the cached leaf for a covered address")
+	}
+
+	// Новый адрес (например, DHCP выдал другой IP) — новый leaf.
+	cert, err := ca.GetCertificate(hello("192.168.77.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert == first {
+		t.Fatal("expected a new leaf for an uncovered address")
+	}
+	if err := verify(t, ca, cert, "192.168.77.5"); err != nil {
+		t.Fatal(err)
+	}
+
+	// За публичный адрес CA не ручается — перевыпуск бесполезен.
+	if same, _ := ca.GetCertificate(hello("8.8.8.8")); same != cert {
+		t.Fatal("expected no reissue for a public address")
+	}
+}
+
+func TestGetCertificate_RenamedMDNSHost(t *testing.T) {
+	ca, _, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := ca.GetCertificate(hello("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// teletalkie.local в сети занят, сервер объявил teletalkie-2.local.
+	h := hello("127.0.0.1")
+	h.ServerName = "Teletalkie-2.local"
+	cert, err := ca.GetCertificate(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert == first {
+		t.Fatal("expected a new leaf for the renamed host")
+	}
+	for _, name := range []string{"teletalkie-2.local", "teletalkie.local"} {
+		if err := verify(t, ca, cert, name); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Произвольные имена из SNI в leaf не попадают.
+	for _, sni := range []string{"evil.local", "teletalkie-x.local", "teletalkie-2.example.com", "teletalkie.local"} {
+		h.ServerName = sni
+		if same, _ := ca.GetCertificate(h); same != cert {
+			t.Errorf("SNI %q: unexpected reissue", sni)
+		}
+	}
+}
+
+func TestGetCertificate_KeepsPreviousSANs(t *testing.T) {
+	ca, _, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hellos := []*tls.ClientHelloInfo{hello("192.168.77.5"), hello("10.1.2.3"), hello("10.1.2.3"), hello("10.1.2.3")}
+	hellos[2].ServerName = "teletalkie-2.local"
+	hellos[3].ServerName = "teletalkie-3.local"
+	for _, h := range hellos {
+		if _, err := ca.GetCertificate(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Клиенты на разных адресах и именах чередуются — leaf тот же.
+	cert := ca.leaf
+	for range 3 {
+		for _, h := range hellos {
+			if got, _ := ca.GetCertificate(h); got != cert {
+				t.Fatalf("%v %q: unexpected reissue", h.Conn.LocalAddr(), h.ServerName)
+			}
+		}
+	}
+	for _, host := range []string{"192.168.77.5", "10.1.2.3", "teletalkie-2.local", "teletalkie-3.local", "teletalkie.local"} {
+		if err := verify(t, ca, cert, host); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Имён из SNI — не больше maxExtraNames, последние остаются.
+	h := hello("10.1.2.3")
+	for i := 4; i < 12; i++ {
+		h.ServerName = fmt.Sprintf("teletalkie-%d.local", i)
+		if _, err := ca.GetCertificate(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names := ca.leaf.Leaf.DNSNames
+	if len(names) != len(leafNames)+maxExtraNames || !slices.Contains(names, "teletalkie-11.local") {
+		t.Errorf("names = %q", names)
+	}
+}
+
+func TestCA_NameConstraints(t *testing.T) {
+	ca, _, err := LoadOrCreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Даже подписанный CA сертификат публичного адреса не проходит проверку.
+	cert, err := ca.issue(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := *cert.Leaf
+	template.IPAddresses = []net.IP{net.ParseIP("8.8.8.8")}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.cert, cert.Leaf.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evil, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verify(t, ca, &tls.Certificate{Leaf: evil}, "8.8.8.8")
+	var invalid x509.CertificateInvalidError
+	if !errors.As(err, &invalid) || invalid.Reason != x509.CANotAuthorizedForThisName {
+		t.Fatalf("expected name constraints to reject a public address, got %v", err)
+	}
+}
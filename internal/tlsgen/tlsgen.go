@@ -22,9 +22,9 @@ func SelfSigned() (tls.Certificate, error) {
 		return tls.Certificate{}, fmt.Errorf("tlsgen: generate key: %w", err)
 	}
 
-	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	serialNumber, err := newSerial()
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("tlsgen: serial number: %w", err)
+		return tls.Certificate{}, err
 	}
 
 	template := x509.Certificate{
@@ -71,3 +71,12 @@ func SelfSigned() (tls.Certificate, error) {
 
 	return tlsCert, nil
 }
+
+// newSerial — случайный 128-битный серийный номер сертификата.
+func newSerial() (*big.Int, error) {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("tlsgen: serial number: %w", err)
+	}
+	return n, nil
+}
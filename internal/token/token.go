@@ -0,0 +1,84 @@
+// Package token выпускает и проверяет join-токены: HMAC-SHA256 подпись
+// над JSON с комнатой, именем, ролью и сроком действия.
+//
+// Формат: base64url(JSON claims) + "." + base64url(HMAC-SHA256(secret, первая часть)).
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed = errors.New("token: malformed")
+	ErrSignature = errors.New("token: bad signature")
+	ErrExpired   = errors.New("token: expired")
+)
+
+// Claims — содержимое токена.
+type Claims struct {
+	Room    string `json:"room"`
+	Name    string `json:"name"`
+	Role    string `json:"role,omitempty"`
+	Expires int64  `json:"exp"` // unix-время в секундах
+}
+
+// ExpiresAt возвращает срок действия как time.Time.
+func (c Claims) ExpiresAt() time.Time {
+	return time.Unix(c.Expires, 0)
+}
+
+// Issue подписывает claims секретом.
+func Issue(secret []byte, c Claims) (string, error) {
+	if len(secret) == 0 {
+		return "", errors.New("token: empty secret")
+	}
+	if c.Room == "" || c.Name == "" || c.Expires == 0 {
+		return "", errors.New("token: room, name and expiry are required")
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + sign(secret, payload), nil
+}
+
+// Verify проверяет подпись и срок действия токена.
+func Verify(secret []byte, tok string, now time.Time) (Claims, error) {
+	payload, sig, ok := strings.Cut(tok, ".")
+	if !ok || payload == "" || sig == "" {
+		return Claims{}, ErrMalformed
+	}
+	if !hmac.Equal([]byte(sig), []byte(sign(secret, payload))) {
+		return Claims{}, ErrSignature
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Claims{}, ErrMalformed
+	}
+	var c Claims
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Claims{}, ErrMalformed
+	}
+	if c.Room == "" || c.Name == "" {
+		return Claims{}, ErrMalformed
+	}
+	if !now.Before(c.ExpiresAt()) {
+		return Claims{}, ErrExpired
+	}
+	return c, nil
+}
+
+func sign(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
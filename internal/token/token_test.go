@@ -0,0 +1,73 @@
+package token
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var secret = []byte("0123456789abcdef0123456789abcdef")
+
+func issue(t *testing.T, c Claims) string {
+	t.Helper()
+	tok, err := Issue(secret, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func TestIssueVerify(t *testing.T) {
+	now := time.Now()
+	want := Claims{Room: "ops", Name: "alice", Role: "dispatcher", Expires: now.Add(time.Hour).Unix()}
+
+	got, err := Verify(secret, issue(t, want), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestVerify_Expired(t *testing.T) {
+	now := time.Now()
+	tok := issue(t, Claims{Room: "ops", Name: "alice", Expires: now.Add(-time.Second).Unix()})
+
+	if _, err := Verify(secret, tok, now); !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected ErrExpired, got %v", err)
+	}
+}
+
+func TestVerify_Tampered(t *testing.T) {
+	now := time.Now()
+	tok := issue(t, Claims{Room: "ops", Name: "alice", Expires: now.Add(time.Hour).Unix()})
+	forged := issue(t, Claims{Room: "ops", Name: "mallory", Expires: now.Add(time.Hour).Unix()})
+
+	// Чужой payload с подписью от другого токена.
+	payload, _, _ := strings.Cut(forged, ".")
+	_, sig, _ := strings.Cut(tok, ".")
+	if _, err := Verify(secret, payload+"."+sig, now); !errors.Is(err, ErrSignature) {
+		t.Fatalf("expected ErrSignature, got %v", err)
+	}
+
+	if _, err := Verify([]byte("another secret"), tok, now); !errors.Is(err, ErrSignature) {
+		t.Fatalf("wrong secret: expected ErrSignature, got %v", err)
+	}
+
+	for _, bad := range []string{"", "abc", "abc.", ".abc"} {
+		if _, err := Verify(secret, bad, now); !errors.Is(err, ErrMalformed) {
+			t.Fatalf("%q: expected ErrMalformed, got %v", bad, err)
+		}
+	}
+}
+
+func TestIssue_RequiresFields(t *testing.T) {
+	if _, err := Issue(secret, Claims{Name: "alice", Expires: 1}); err == nil {
+		t.Fatal("expected error for empty room")
+	}
+	if _, err := Issue(nil, Claims{Room: "ops", Name: "alice", Expires: 1}); err == nil {
+		t.Fatal("expected error for empty secret")
+	}
+}
@@ -25,12 +25,23 @@ const MSG = {
   PTT_ON: 0x01,
   PTT_OFF: 0x02,
   MEDIA_CHUNK: 0x03,
+  CHAT: 0x04,
+  REACTION: 0x05,
   // Server → Client
   PTT_GRANTED: 0x10,
   PTT_DENIED: 0x11,
   PTT_RELEASED: 0x12,
   RELAY_CHUNK: 0x13,
   PEER_INFO: 0x14,
+  WRONG_PASSWORD: 0x15,
+  PTT_QUEUED: 0x16,
+  PTT_REVOKED: 0x17,
+  PTT_PREEMPTED: 0x18,
+  ERROR: 0x19,
+  CHAT_MESSAGE: 0x1a,
+  CHAT_HISTORY: 0x1b,
+  REACTION_EVENT: 0x1c,
+  SERVER_GOING_AWAY: 0x1d,
 };
 
 // ── DOM ──
@@ -38,12 +49,15 @@ const loginScreen = document.getElementById("login-screen");
 const roomScreen = document.getElementById("room-screen");
 const nameInput = document.getElementById("name-input");
 const roomInput = document.getElementById("room-input");
+const passwordInput = document.getElementById("password-input");
+const listenOnlyInput = document.getElementById("listen-only-input");
 const joinBtn = document.getElementById("join-btn");
 const loginError = document.getElementById("login-error");
 const roomNameEl = document.getElementById("room-name");
 const userNameEl = document.getElementById("user-name");
 const leaveBtn = document.getElementById("leave-btn");
 const pttBtn = document.getElementById("ptt-btn");
+const pttOverlay = document.getElementById("ptt-overlay");
 // const statusEl = document.getElementById("status"); // removed from UI
 const remoteVideo = document.getElementById("remote-video");
 const localVideo = document.getElementById("local-video");
@@ -51,6 +65,14 @@ const talkerLabel = document.getElementById("talker-label");
 const talkerNameEl = document.getElementById("talker-name");
 const noStreamEl = document.getElementById("no-stream");
 const peersList = document.getElementById("peers-list");
+const chatList = document.getElementById("chat-list");
+const chatForm = document.getElementById("chat-form");
+const chatInput = document.getElementById("chat-input");
+const chatReply = document.getElementById("chat-reply");
+const chatReplyText = document.getElementById("chat-reply-text");
+const chatReplyCancel = document.getElementById("chat-reply-cancel");
+const reactionBar = document.getElementById("reaction-bar");
+const reactionCounts = document.getElementById("reaction-counts");
 const unmuteBtn = document.getElementById("unmute-btn");
 const rotateBtn = document.getElementById("rotate-btn");
 const refreshBtn = document.getElementById("refresh-btn");
@@ -96,12 +118,16 @@ let canvasStream = null; // stream с canvas для отправки
 let canvasElements = null; // { canvas, tempVideo } для cleanup
 let recorder = null; // MediaRecorder
 let recorderInitialized = false; // флаг что recorder создан с правильным stream
-let pttState = "idle"; // idle | requesting | talking
+let pttState = "idle"; // idle | requesting | queued | talking
 let pttMode = "hold"; // hold | toggle
 let currentRoom = "";
 let currentName = "";
+let currentPassword = ""; // пароль комнаты (только в памяти, для реконнекта)
+let listenOnly = false; // вошли только слушать: без PTT и камеры
 let reconnectTimer = null;
-let currentTalker = ""; // имя текущего talker'а (из PEER_INFO)
+let reconnectDelay = 2000; // сервер может подсказать другую (SERVER_GOING_AWAY)
+let currentTalker = ""; // ID текущего talker'а (из PEER_INFO)
+let myPeerID = ""; // свой ID, выданный сервером (поле you в PEER_INFO)
 let canvasAnimationId = null; // requestAnimationFrame ID для canvas рендеринга
 
 // ── MSE состояние ──
@@ -110,6 +136,33 @@ let sourceBuffer = null;
 let chunkQueue = [];
 let mseReady = false;
 
+// ── Resume-токен: с ним после переподключения сервер выдаёт прежний ID ──
+// Хранится в sessionStorage — у каждой вкладки свой.
+function resumeToken() {
+  let tok = sessionStorage.getItem("resumeToken");
+  if (!tok) {
+    const bytes = crypto.getRandomValues(new Uint8Array(16));
+    tok = Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
+    sessionStorage.setItem("resumeToken", tok);
+  }
+  return tok;
+}
+
+// ── Join-токен (?token=…, выдаётся `teletalkie token issue`) ──
+const joinToken = new URLSearchParams(location.search).get("token") || "";
+
+// Payload токена — base64url(JSON) до точки; подпись проверяет сервер.
+function decodeTokenClaims(tok) {
+  try {
+    const b64 = tok.split(".")[0].replace(/-/g, "+").replace(/_/g, "/");
+    const bytes = Uint8Array.from(atob(b64), (c) => c.charCodeAt(0));
+    return JSON.parse(new TextDecoder().decode(bytes));
+  } catch (e) {
+    console.warn("[auth] can't decode join token:", e);
+    return null;
+  }
+}
+
 // ── Выбор mimeType для MediaRecorder (только H.264 Baseline + AAC) ──
 const H264_MIME_CANDIDATES = [
   "video/mp4;codecs=avc1.42E01E,mp4a.40.2", // H.264 Baseline + AAC
@@ -163,8 +216,25 @@ function pickMSEMimeType() {
 
 // Загружаем сохраненные данные при загрузке страницы
 window.addEventListener("DOMContentLoaded", () => {
-  const savedName = localStorage.getItem("teletalkie_name");
-  const savedRoom = localStorage.getItem("teletalkie_room");
+  let savedName = localStorage.getItem("teletalkie_name");
+  let savedRoom = localStorage.getItem("teletalkie_room");
+
+  // Ссылка из QR-кода (?room=…) выбирает комнату.
+  const linkRoom = new URLSearchParams(location.search).get("room");
+  if (linkRoom) {
+    savedRoom = linkRoom;
+  }
+
+  // Токен задаёт комнату и имя — они важнее сохранённых.
+  const claims = joinToken ? decodeTokenClaims(joinToken) : null;
+  if (claims) {
+    savedName = claims.name;
+    savedRoom = claims.room;
+  }
+
+  listenOnlyInput.checked =
+    localStorage.getItem("teletalkie_listen_only") === "1" ||
+    claims?.role === "listener";
 
   if (savedName) {
     nameInput.value = savedName;
@@ -204,6 +274,9 @@ nameInput.addEventListener("keydown", (e) => {
 roomInput.addEventListener("keydown", (e) => {
   if (e.key === "Enter") handleJoin();
 });
+passwordInput.addEventListener("keydown", (e) => {
+  if (e.key === "Enter") handleJoin();
+});
 
 leaveBtn.addEventListener("click", () => {
   if (confirm("Выйти из комнаты?")) {
@@ -323,9 +396,12 @@ function handleJoin() {
   // Сохраняем в localStorage
   localStorage.setItem("teletalkie_name", name);
   localStorage.setItem("teletalkie_room", room);
+  localStorage.setItem("teletalkie_listen_only", listenOnlyInput.checked ? "1" : "0");
 
   currentRoom = room;
   currentName = name;
+  currentPassword = passwordInput.value;
+  listenOnly = listenOnlyInput.checked;
   connect(room, name);
 }
 
@@ -354,7 +430,11 @@ function leaveRoom() {
   pttState = "idle";
   currentRoom = "";
   currentName = "";
+  currentPassword = "";
+  listenOnly = false;
   currentTalker = "";
+  clearChat();
+  myPeerID = "";
   if (reconnectTimer) {
     clearTimeout(reconnectTimer);
     reconnectTimer = null;
@@ -372,17 +452,30 @@ function leaveRoom() {
 // ── WebSocket ──
 function connect(roomID, name) {
   const proto = location.protocol === "https:" ? "wss:" : "ws:";
-  const url = `${proto}//${location.host}/ws?room=${encodeURIComponent(roomID)}&name=${encodeURIComponent(name)}`;
+  let url = `${proto}//${location.host}/ws?room=${encodeURIComponent(roomID)}&name=${encodeURIComponent(name)}`;
+  url += `&resume=${resumeToken()}`;
+  if (joinToken) {
+    url += `&token=${encodeURIComponent(joinToken)}`;
+  }
+  if (currentPassword) {
+    url += `&password=${encodeURIComponent(currentPassword)}`;
+  }
+  if (listenOnly) {
+    url += "&listen=1";
+  }
 
-  ws = new WebSocket(url);
+  const socket = new WebSocket(url);
+  ws = socket;
   ws.binaryType = "arraybuffer";
 
   ws.addEventListener("open", () => {
     console.log("[ws] connected");
+    noStreamEl.textContent = "Эфир свободен";
     showRoomScreen(roomID, name);
   });
 
   ws.addEventListener("close", (e) => {
+    if (ws !== socket) return; // соединение уже заменено или закрыто нами
     console.log(
       "[ws] closed, code:",
       e.code,
@@ -391,6 +484,11 @@ function connect(roomID, name) {
       "wasClean:",
       e.wasClean,
     );
+    // 1008 Policy Violation — сервер отказал в доступе, переподключаться бессмысленно.
+    if (e.code === 1008) {
+      handleAccessDenied(e.reason);
+      return;
+    }
     handleDisconnect();
   });
 
@@ -433,6 +531,36 @@ function handleMessage(data) {
     case MSG.PEER_INFO:
       onPeerInfo(payload);
       break;
+    case MSG.PTT_QUEUED:
+      onPTTQueued(payload);
+      break;
+    case MSG.PTT_REVOKED:
+      onPTTRevoked(payload);
+      break;
+    case MSG.PTT_PREEMPTED:
+      onPTTPreempted(payload);
+      break;
+    case MSG.ERROR:
+      onServerError(payload);
+      break;
+    case MSG.CHAT_MESSAGE:
+      onChatMessage(payload);
+      break;
+    case MSG.CHAT_HISTORY:
+      onChatHistory(payload);
+      break;
+    case MSG.REACTION_EVENT:
+      onReaction(payload);
+      break;
+    case MSG.SERVER_GOING_AWAY:
+      onServerGoingAway(payload);
+      break;
+    case MSG.WRONG_PASSWORD:
+      console.warn("[ws] wrong room password");
+      leaveRoom();
+      showLoginError("Неверный пароль комнаты");
+      passwordInput.focus();
+      break;
     default:
       console.warn("[ws] unknown message type:", type);
   }
@@ -445,13 +573,20 @@ function showRoomScreen(roomID, name) {
   roomNameEl.textContent = roomID;
   userNameEl.textContent = name;
   pttBtn.disabled = false;
+  pttOverlay.hidden = listenOnly;
   console.log("[room] connected");
 }
 
 function handleDisconnect() {
   stopTalking();
   teardownMSE();
-  pttState = "idle";
+  // Сервер держит за нами эфир, пока ждёт переподключения: состояние
+  // talking сохраняем, после реконнекта его сверит onPeerInfo.
+  if (pttState !== "talking") {
+    pttState = "idle";
+    pttBtn.classList.remove("talking");
+    delete pttBtn.dataset.queue;
+  }
 
   if (!loginScreen.hidden) return; // ещё на экране входа
 
@@ -464,14 +599,38 @@ function handleDisconnect() {
   }
 }
 
+function handleAccessDenied(reason) {
+  console.warn("[ws] access denied:", reason);
+  leaveRoom();
+  showLoginError("Доступ запрещён" + (reason ? ": " + reason : ""));
+}
+
 function scheduleReconnect() {
   if (reconnectTimer) return;
+  const delay = reconnectDelay;
+  reconnectDelay = 2000;
   reconnectTimer = setTimeout(() => {
     reconnectTimer = null;
     if (roomScreen.hidden) return; // уже вышли на экран входа
     console.log("[ws] reconnecting...");
     connect(currentRoom, currentName);
-  }, 2000);
+  }, delay);
+}
+
+// SERVER_GOING_AWAY: сервер останавливается (перезапуск). Следом придёт
+// close 1001; переподключаемся не раньше подсказанного срока, с разбросом,
+// чтобы все клиенты не пришли одновременно.
+function onServerGoingAway(payload) {
+  let hint = {};
+  try {
+    hint = JSON.parse(new TextDecoder().decode(payload));
+  } catch (e) {
+    console.error("[ws] going-away parse error:", e);
+  }
+  const after = hint.retry_after_ms || 2000;
+  reconnectDelay = after + Math.random() * after;
+  console.warn("[ws] server going away, reconnect in", Math.round(reconnectDelay), "ms");
+  noStreamEl.textContent = "Сервер перезапускается…";
 }
 
 // ── PTT кнопка (mouse + touch) ──
@@ -493,12 +652,13 @@ function pttUp() {
     pttState = "idle";
     pttBtn.classList.remove("talking");
     console.log("[ptt] released");
-  } else if (pttState === "requesting") {
-    // Отпустили до получения ответа — всё равно шлём OFF
+  } else if (pttState === "requesting" || pttState === "queued") {
+    // Отпустили до получения эфира — OFF заодно убирает из очереди
     playPTTOff();
     wsSend(MSG.PTT_OFF);
     pttState = "idle";
     pttBtn.classList.remove("talking");
+    delete pttBtn.dataset.queue;
     console.log("[ptt] cancelled");
   }
 }
@@ -613,7 +773,10 @@ document.addEventListener("keyup", (e) => {
 
 function onPTTGranted() {
   console.log("[ptt] granted");
-  if (pttState !== "requesting") {
+  delete pttBtn.dataset.queue;
+  pttBtn.title = "";
+  reactionCounts.textContent = "";
+  if (pttState !== "requesting" && pttState !== "queued") {
     // Уже отпустили кнопку — сразу отпускаем эфир
     wsSend(MSG.PTT_OFF);
     return;
@@ -629,11 +792,71 @@ function onPTTDenied() {
   pttBtn.classList.remove("talking");
 }
 
+// Эфир занят, сервер поставил нас в очередь; GRANTED придёт, когда дойдёт черёд
+function onPTTQueued(payload) {
+  if (pttState !== "requesting" && pttState !== "queued") return;
+  const pos = payload.length >= 2 ? (payload[0] << 8) | payload[1] : 0;
+  console.log("[ptt] queued, position:", pos);
+  pttState = "queued";
+  pttBtn.dataset.queue = pos;
+}
+
+// Причины PTT_REVOKED (room.RevokeReason на сервере)
+const REVOKE_REASONS = {
+  0x01: "превышено время передачи",
+  0x02: "нет видео/звука",
+};
+
+// Сервер отобрал эфир — останавливаем передачу, даже если кнопка ещё зажата
+function onPTTRevoked(payload) {
+  const reason = REVOKE_REASONS[payload[0]] || "неизвестная причина";
+  console.warn("[ptt] floor revoked:", reason);
+  loseFloor("Эфир отобран: " + reason);
+}
+
+// Эфир перехватил участник с большим приоритетом (диспетчер); payload — его ID
+function onPTTPreempted(payload) {
+  const byID = new TextDecoder().decode(payload);
+  const by = peersList.querySelector(`li[data-peer-id="${CSS.escape(byID)}"]`);
+  const byName = by ? by.dataset.peerName : byID;
+  console.warn("[ptt] floor pre-empted by:", byName);
+  loseFloor("Эфир перехвачен: " + byName);
+}
+
+// ERROR: 1 байт — код, дальше текст
+function onServerError(payload) {
+  const code = payload[0];
+  const text = new TextDecoder().decode(payload.slice(1));
+  console.warn("[ws] server error:", code, text);
+  if (code === 0x01) {
+    // Сервер считает нас слушателем — прячем PTT
+    listenOnly = true;
+    pttOverlay.hidden = true;
+    loseFloor(text);
+  } else if (code === 0x03) {
+    // Слишком часто — ненадолго гасим кнопки реакций
+    reactionBar.classList.add("cooldown");
+    setTimeout(() => reactionBar.classList.remove("cooldown"), 1000);
+  }
+}
+
+function loseFloor(notice) {
+  if (pttState === "talking") {
+    playPTTOff();
+    stopTalking();
+  }
+  pttState = "idle";
+  pttBtn.classList.remove("talking");
+  pttBtn.title = notice;
+}
+
 function onPTTReleased() {
   console.log("[ptt] channel released");
   currentTalker = "";
   talkerLabel.hidden = true;
   noStreamEl.hidden = false;
+  updateReactionBar();
+  reactionCounts.textContent = "";
   teardownMSE();
 }
 
@@ -1255,16 +1478,43 @@ function onPeerInfo(payload) {
     const text = new TextDecoder().decode(payload);
     const info = JSON.parse(text);
 
-    // Обновляем список участников
+    // Поле you приходит только в первом PEER_INFO после входа
+    if (info.you) {
+      myPeerID = info.you;
+      resumeFloor(info.talker === myPeerID);
+    }
+
+    // Обновляем список участников (имена могут совпадать — сравниваем по ID)
     peersList.innerHTML = "";
+    let talkerName = "";
+    let talkerReconnecting = false;
     if (info.peers && Array.isArray(info.peers)) {
-      for (const name of info.peers) {
+      for (const peer of info.peers) {
         const li = document.createElement("li");
-        li.textContent = name;
-        if (name === info.talker) {
+        li.textContent = peer.name;
+        li.dataset.peerId = peer.id;
+        li.dataset.peerName = peer.name;
+        if (peer.role === "dispatcher" || peer.role === "admin") {
+          li.textContent += " ★";
+        } else if (peer.role === "listener") {
+          li.textContent = "👂 " + li.textContent;
+          li.title = "Только слушает";
+        }
+        // Роль listener может прийти и из токена
+        if (peer.id === info.you && peer.role === "listener" && !listenOnly) {
+          listenOnly = true;
+          pttOverlay.hidden = true;
+        }
+        if (peer.reconnecting) {
+          li.textContent += " (переподключается)";
+          li.style.opacity = "0.5";
+        }
+        if (peer.id === info.talker) {
           li.classList.add("is-talker");
+          talkerName = peer.name;
+          talkerReconnecting = !!peer.reconnecting;
         }
-        if (name === currentName) {
+        if (peer.id === myPeerID) {
           li.style.fontWeight = "bold";
         }
         peersList.appendChild(li);
@@ -1272,9 +1522,16 @@ function onPeerInfo(payload) {
     }
 
     // Обновляем индикатор talker'а
-    if (info.talker && info.talker !== currentName) {
+    if (info.talker && info.talker !== myPeerID) {
+      // Вернувшись, talker начнёт поток заново — с нового init-сегмента
+      if (talkerReconnecting) {
+        teardownMSE();
+      }
+      if (currentTalker !== info.talker) {
+        reactionCounts.textContent = "";
+      }
       currentTalker = info.talker;
-      talkerNameEl.textContent = info.talker;
+      talkerNameEl.textContent = talkerName;
       talkerLabel.hidden = false;
       noStreamEl.hidden = true;
     } else if (!info.talker) {
@@ -1284,11 +1541,138 @@ function onPeerInfo(payload) {
         noStreamEl.hidden = false;
       }
     }
+    updateReactionBar();
   } catch (e) {
     console.error("[peer_info] parse error:", e);
   }
 }
 
+// После (пере)подключения сверяем эфир с сервером: он мог сохранить его
+// за нами на время обрыва, а мы могли за это время отпустить кнопку.
+function resumeFloor(held) {
+  if (pttState === "talking" && held) {
+    console.log("[ptt] floor kept after reconnect, resuming");
+    startTalking();
+  } else if (pttState === "talking") {
+    console.log("[ptt] floor lost while reconnecting");
+    pttState = "idle";
+    pttBtn.classList.remove("talking");
+  } else if (held) {
+    wsSend(MSG.PTT_OFF);
+  }
+}
+
+// ── Текстовый чат ──
+const chatMessages = new Map(); // id → сообщение; история при реконнекте приходит снова
+let chatReplyTo = "";
+
+function onChatMessage(payload) {
+  try {
+    addChatMessage(JSON.parse(new TextDecoder().decode(payload)));
+  } catch (e) {
+    console.error("[chat] parse error:", e);
+  }
+}
+
+function onChatHistory(payload) {
+  try {
+    for (const m of JSON.parse(new TextDecoder().decode(payload))) {
+      addChatMessage(m);
+    }
+  } catch (e) {
+    console.error("[chat] history parse error:", e);
+  }
+}
+
+function addChatMessage(m) {
+  if (chatMessages.has(m.id)) return;
+  chatMessages.set(m.id, m);
+
+  const li = document.createElement("li");
+  const quoted = m.reply_to && chatMessages.get(m.reply_to);
+  if (quoted) {
+    const q = document.createElement("span");
+    q.className = "chat-quote";
+    q.textContent = `${quoted.sender}: ${quoted.text}`;
+    li.appendChild(q);
+  }
+  const sender = document.createElement("span");
+  sender.className = "chat-sender";
+  sender.textContent = m.sender;
+  li.appendChild(sender);
+  li.appendChild(document.createTextNode(m.text));
+  li.title = new Date(m.ts).toLocaleTimeString();
+  li.addEventListener("click", () => setChatReply(m));
+
+  chatList.appendChild(li);
+  chatList.scrollTop = chatList.scrollHeight;
+}
+
+function setChatReply(m) {
+  chatReplyTo = m ? m.id : "";
+  chatReply.hidden = !m;
+  chatReplyText.textContent = m ? `↪ ${m.sender}: ${m.text}` : "";
+  if (m) chatInput.focus();
+}
+
+function clearChat() {
+  chatMessages.clear();
+  chatList.innerHTML = "";
+  setChatReply(null);
+}
+
+chatForm.addEventListener("submit", (e) => {
+  e.preventDefault();
+  const text = chatInput.value.trim();
+  if (!text) return;
+  const body = { text };
+  if (chatReplyTo) body.reply_to = chatReplyTo;
+  wsSend(MSG.CHAT, new TextEncoder().encode(JSON.stringify(body)));
+  chatInput.value = "";
+  setChatReply(null);
+});
+
+chatReplyCancel.addEventListener("click", () => setChatReply(null));
+
+// ── Реакции на текущую передачу ──
+
+// Реагировать можно только на чужую передачу
+function updateReactionBar() {
+  const show = !!currentTalker && currentTalker !== myPeerID;
+  reactionBar.hidden = !show;
+}
+
+function onReaction(payload) {
+  let r;
+  try {
+    r = JSON.parse(new TextDecoder().decode(payload));
+  } catch (e) {
+    console.error("[reaction] parse error:", e);
+    return;
+  }
+
+  // Счётчики — итог по передаче; talker'у показываем их у себя
+  if (r.talker === currentTalker || r.talker === myPeerID) {
+    reactionCounts.textContent = Object.entries(r.counts || {})
+      .map(([emoji, n]) => `${emoji}${n}`)
+      .join(" ");
+  }
+
+  const el = document.createElement("span");
+  el.className = "reaction-float";
+  el.textContent = r.emoji;
+  el.title = r.name;
+  el.style.left = `${10 + Math.random() * 70}%`;
+  el.addEventListener("animationend", () => el.remove());
+  document.getElementById("video-container").appendChild(el);
+}
+
+reactionBar.addEventListener("click", (e) => {
+  const btn = e.target.closest("button[data-emoji]");
+  if (!btn || reactionBar.classList.contains("cooldown")) return;
+  wsSend(MSG.REACTION, new TextEncoder().encode(btn.dataset.emoji));
+});
+
 // ── Утилита: отправка бинарного сообщения ──
 function wsSend(type, payload) {
   if (!ws || ws.readyState !== WebSocket.OPEN) return;